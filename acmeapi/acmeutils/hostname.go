@@ -3,6 +3,7 @@ package acmeutils
 import (
 	"fmt"
 	"golang.org/x/net/idna"
+	"net"
 	"regexp"
 	"strings"
 )
@@ -10,20 +11,61 @@ import (
 var reHostname = regexp.MustCompilePOSIX(`^([a-z0-9_-]+\.)*[a-z0-9_-]+$`)
 
 // Normalizes the hostname given. If the hostname is not valid, returns "" and
-// an error.
+// an error. The hostname may be a wildcard hostname such as "*.example.com",
+// or an IP address, which is normalized to its canonical textual form.
 func NormalizeHostname(name string) (string, error) {
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(name, "["), "]")); ip != nil {
+		return ip.String(), nil
+	}
+
 	name = strings.TrimSuffix(strings.ToLower(name), ".")
 
+	prefix := ""
+	if IsWildcardHostname(name) {
+		prefix, name = "*.", name[2:]
+	}
+
 	name, err := idna.ToASCII(name)
 	if err != nil {
-		return "", fmt.Errorf("IDN error: %#v: %v", name, err)
+		return "", fmt.Errorf("IDN error: %#v: %v", prefix+name, err)
 	}
 
 	if !reHostname.MatchString(name) {
-		return "", fmt.Errorf("invalid hostname: %#v", name)
+		return "", fmt.Errorf("invalid hostname: %#v", prefix+name)
+	}
+
+	return prefix + name, nil
+}
+
+// Returns true iff the given hostname is a wildcard hostname, i.e. its first
+// label is "*".
+func IsWildcardHostname(name string) bool {
+	return strings.HasPrefix(name, "*.")
+}
+
+// Returns true iff the given name is an IP address rather than a hostname.
+func IsIPAddress(name string) bool {
+	return net.ParseIP(name) != nil
+}
+
+// Returns true iff a certificate bearing certName as a SAN is valid for
+// hostname. certName may be a wildcard, in which case it matches any hostname
+// having exactly one additional label. If hostname is itself a wildcard, only
+// the same wildcard matches it.
+func HostnameMatches(certName, hostname string) bool {
+	certName = strings.ToLower(certName)
+	hostname = strings.ToLower(hostname)
+
+	if certName == hostname {
+		return true
+	}
+
+	if !IsWildcardHostname(certName) || IsWildcardHostname(hostname) {
+		return false
 	}
 
-	return name, nil
+	idx := strings.IndexByte(hostname, '.')
+	return idx > 0 && hostname[idx+1:] == certName[2:]
 }
 
 // Returns true iff the given string is a valid hostname.
@@ -0,0 +1,53 @@
+package acmeutils
+
+import "testing"
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		In, Out string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM.", "example.com"},
+		{"*.example.com", "*.example.com"},
+		{"*.Example.com.", "*.example.com"},
+		{"*", ""},
+		{"*.", ""},
+		{"foo.*.example.com", ""},
+		{"*.*.example.com", ""},
+		{"*example.com", ""},
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:DB8:0::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+	}
+
+	for _, tst := range tests {
+		out, err := NormalizeHostname(tst.In)
+		if out != tst.Out || (err == nil) != (tst.Out != "") {
+			t.Errorf("%q: got %q, %v; expected %q", tst.In, out, err, tst.Out)
+		}
+	}
+}
+
+func TestHostnameMatches(t *testing.T) {
+	tests := []struct {
+		CertName, Hostname string
+		Matches            bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", "*.example.com", true},
+		{"*.b.example.com", "*.example.com", false},
+		{"www.example.com", "*.example.com", false},
+		{"*.example.com", "wwwexample.com", false},
+	}
+
+	for _, tst := range tests {
+		if HostnameMatches(tst.CertName, tst.Hostname) != tst.Matches {
+			t.Errorf("%q, %q: expected %v", tst.CertName, tst.Hostname, tst.Matches)
+		}
+	}
+}
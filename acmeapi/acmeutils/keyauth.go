@@ -8,11 +8,13 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"gopkg.in/square/go-jose.v1"
 	"math/big"
+	"net"
 	"time"
 )
 
@@ -92,6 +94,63 @@ func CreateTLSSNICertificate(hostname string) (certDER []byte, privateKey crypto
 	return
 }
 
+// The OID of the acmeIdentifier X.509 extension used by the TLS-ALPN challenge.
+var ACMEIdentifierOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// Determines the value of the acmeIdentifier extension which must appear in a
+// TLS-ALPN challenge certificate. This is the DER encoding of an OCTET STRING
+// containing the SHA-256 digest of the key authorization.
+func TLSALPNIdentifierValue(accountKey interface{}, token string) ([]byte, error) {
+	ka, err := KeyAuthorization(accountKey, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(sha256Bytes([]byte(ka)))
+}
+
+// Creates a self-signed certificate and matching private key suitable for
+// responding to a TLS-ALPN challenge for the given hostname or IP address.
+// identifierValue should be a value returned by TLSALPNIdentifierValue.
+func CreateTLSALPNCertificate(hostname string, identifierValue []byte) (certDER []byte, privateKey crypto.PrivateKey, err error) {
+	crt := x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: hostname,
+		},
+		Issuer: pkix.Name{
+			CommonName: hostname,
+		},
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		ExtraExtensions: []pkix.Extension{
+			{
+				Id:       ACMEIdentifierOID,
+				Critical: true,
+				Value:    identifierValue,
+			},
+		},
+	}
+
+	if ip := net.ParseIP(hostname); ip != nil {
+		crt.IPAddresses = []net.IP{ip}
+	} else {
+		crt.DNSNames = []string{hostname}
+	}
+
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	certDER, err = x509.CreateCertificate(rand.Reader, &crt, &crt, &pk.PublicKey, pk)
+	privateKey = pk
+	return
+}
+
 // Returns JSON suitable as a generic challenge initiation response to the ACME
 // server. You pass this to RespondToChallenge as a json.RawMessage. Suitable
 // for most, but not all, challenge types.
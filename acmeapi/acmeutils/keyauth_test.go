@@ -1,6 +1,11 @@
 package acmeutils
 
-import "testing"
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"testing"
+)
 
 func TestKeyAuthorization(t *testing.T) {
 	pk, err := LoadPrivateKey([]byte(testKey))
@@ -54,3 +59,58 @@ func TestKeyAuthorization(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestTLSALPNCertificate(t *testing.T) {
+	pk, err := LoadPrivateKey([]byte(testECKey))
+	if err != nil {
+		t.Fatal()
+	}
+
+	v, err := TLSALPNIdentifierValue(pk, "foo")
+	if err != nil {
+		t.Fatal()
+	}
+
+	digest := sha256.Sum256([]byte("foo.S8MUz-12EEFgpVWWfDpvolnpTkuD9yVV6qHdzFuJyj8"))
+	if !bytes.Equal(v, append([]byte{0x04, 0x20}, digest[:]...)) {
+		t.Fatalf("%x", v)
+	}
+
+	der, _, err := CreateTLSALPNCertificate("example.com", v)
+	if err != nil {
+		t.Fatal()
+	}
+
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal()
+	}
+
+	if len(crt.DNSNames) != 1 || crt.DNSNames[0] != "example.com" {
+		t.Fatalf("%v", crt.DNSNames)
+	}
+
+	found := false
+	for _, e := range crt.Extensions {
+		if e.Id.Equal(ACMEIdentifierOID) && e.Critical && bytes.Equal(e.Value, v) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("acmeIdentifier extension not found")
+	}
+
+	der, _, err = CreateTLSALPNCertificate("2001:db8::1", v)
+	if err != nil {
+		t.Fatal()
+	}
+
+	crt, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal()
+	}
+
+	if len(crt.DNSNames) != 0 || len(crt.IPAddresses) != 1 || crt.IPAddresses[0].String() != "2001:db8::1" {
+		t.Fatalf("%v %v", crt.DNSNames, crt.IPAddresses)
+	}
+}
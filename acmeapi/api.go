@@ -10,8 +10,19 @@
 // UpsertRegistration determines automatically whether an account key is
 // already registered and registers it if it is not.
 //
+// Both RFC 8555 servers and servers implementing the earlier drafts of the
+// ACME protocol are supported; which protocol is used is determined
+// automatically from the contents of the directory. Certificates are issued
+// by RFC 8555 servers via orders (see NewOrder, FinalizeOrder and
+// WaitForOrder).
+//
 // All methods take Contexts so as to support cancellation and timeouts.
 //
+// Errors returned by the server can be told apart using errors.Is with the
+// ProblemType values, such as ErrUnauthorized or ErrCAA, or examined in
+// detail using errors.As with a *Problem. Requests which the server rejects
+// because of a bad nonce are retried automatically.
+//
 // If you have an URI for an authorization, challenge or certificate, you
 // can load it by constructing such an object and setting the URI field,
 // then calling the appropriate Load function. (The unexported fields in these
@@ -26,9 +37,12 @@
 package acmeapi
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"gopkg.in/square/go-jose.v1"
 
 	denet "github.com/hlandau/goutils/net"
@@ -37,10 +51,12 @@ import (
 	"golang.org/x/net/context/ctxhttp"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/hlandau/xlog"
 	"runtime"
@@ -53,18 +69,70 @@ import (
 var log, Log = xlog.NewQuiet("acme.api")
 
 type directoryInfo struct {
+	// Draft endpoints.
 	NewReg     string `json:"new-reg"`
 	RecoverReg string `json:"recover-reg"`
 	NewAuthz   string `json:"new-authz"`
 	NewCert    string `json:"new-cert"`
 	RevokeCert string `json:"revoke-cert"`
+
+	// RFC 8555 endpoints.
+	NewNonce      string `json:"newNonce"`
+	NewAccount    string `json:"newAccount"`
+	NewOrder      string `json:"newOrder"`
+	NewAuthzRFC   string `json:"newAuthz"` // Optional.
+	RevokeCertRFC string `json:"revokeCert"`
+	KeyChange     string `json:"keyChange"`
+	RenewalInfo   string `json:"renewalInfo"` // Optional (RFC 9773).
+
+	Meta directoryMeta `json:"meta"`
+}
+
+type directoryMeta struct {
+	TermsOfService          string   `json:"termsOfService"`
+	Website                 string   `json:"website"`
+	CAAIdentities           []string `json:"caaIdentities"`
+	ExternalAccountRequired bool     `json:"externalAccountRequired"`
+}
+
+// Returns true iff the directory describes an RFC 8555 server.
+func (di *directoryInfo) isRFC8555() bool {
+	return ValidURL(di.NewNonce) && ValidURL(di.NewAccount) && ValidURL(di.NewOrder)
 }
 
 type revokeReq struct {
-	Resource    string         `json:"resource"` // "revoke-cert"
+	Resource    string         `json:"resource,omitempty"` // "revoke-cert" (draft only)
 	Certificate denet.Base64up `json:"certificate"`
 }
 
+type accountReq struct {
+	Contact                []string        `json:"contact,omitempty"`
+	TermsOfServiceAgreed   bool            `json:"termsOfServiceAgreed,omitempty"`
+	OnlyReturnExisting     bool            `json:"onlyReturnExisting,omitempty"`
+	ExternalAccountBinding json.RawMessage `json:"externalAccountBinding,omitempty"`
+	Status                 Status          `json:"status,omitempty"`
+}
+
+type keyChangeReq struct {
+	Account string           `json:"account"`
+	OldKey  *jose.JsonWebKey `json:"oldKey"`
+}
+
+type orderReq struct {
+	Identifiers []Identifier `json:"identifiers"`
+	NotBefore   *time.Time   `json:"notBefore,omitempty"`
+	NotAfter    *time.Time   `json:"notAfter,omitempty"`
+	Replaces    string       `json:"replaces,omitempty"`
+}
+
+type finalizeReq struct {
+	CSR denet.Base64up `json:"csr"`
+}
+
+type newAuthzReq struct {
+	Identifier Identifier `json:"identifier"`
+}
+
 // Returns true if the URL given is (potentially) a valid ACME resource URL.
 //
 // The URL must be an HTTPS URL.
@@ -81,6 +149,11 @@ var TestingAllowHTTP = false
 // Client for making ACME API calls.
 //
 // You must set at least AccountKey and DirectoryURL.
+//
+// A Client may be used by multiple goroutines at once, except that methods
+// which change the account (UpsertRegistration, ChangeKey and
+// DeactivateRegistration) must not be called concurrently with any other
+// method.
 type Client struct {
 	// Account private key. Required.
 	AccountKey crypto.PrivateKey
@@ -92,10 +165,17 @@ type Client struct {
 	// Uses http.DefaultClient if nil.
 	HTTPClient *http.Client
 
-	dir            *directoryInfo
-	nonceSource    nonceSource
-	nonceReentrant int
-	initOnce       sync.Once
+	// The account URL. RFC 8555 servers identify the account making a request
+	// by this URL. It is set by UpsertRegistration, and is otherwise determined
+	// from the account key when first needed. Not used with draft servers.
+	AccountURL string
+
+	dir         *directoryInfo
+	nonceSource nonceSource
+	initOnce    sync.Once
+
+	// Protects dir, and AccountURL when it is determined automatically.
+	mutex sync.Mutex
 }
 
 // You should set this to a string identifying the code invoking this library.
@@ -110,6 +190,9 @@ func algorithmFromKey(key crypto.PrivateKey) (jose.SignatureAlgorithm, error) {
 	switch v := key.(type) {
 	case *rsa.PrivateKey:
 		return jose.RS256, nil
+	case []byte:
+		// Only used for external account binding.
+		return jose.HS256, nil
 	case *ecdsa.PrivateKey:
 		name := v.Curve.Params().Name
 		switch name {
@@ -127,17 +210,34 @@ func algorithmFromKey(key crypto.PrivateKey) (jose.SignatureAlgorithm, error) {
 	}
 }
 
+// Obtains a new nonce by making an unsigned request. This is called by
+// nonceSource when it runs out, so it must not itself need a nonce.
 func (c *Client) obtainNewNonce(ctx context.Context) error {
-	if c.nonceReentrant > 0 {
-		panic("nonce reentrancy - this should never happen")
+	c.mutex.Lock()
+	dir := c.dir
+	c.mutex.Unlock()
+
+	// RFC 8555 servers provide an endpoint specifically for obtaining nonces.
+	if dir != nil && dir.isRFC8555() {
+		res, err := c.doReq("HEAD", dir.NewNonce, nil, nil, ctx)
+		if err != nil {
+			return err
+		}
+
+		res.Body.Close()
+		return nil
 	}
-	c.nonceReentrant++
-	defer func() { c.nonceReentrant-- }()
 
 	_, err := c.forceGetDirectory(ctx)
 	return err
 }
 
+func (c *Client) init() {
+	c.initOnce.Do(func() {
+		c.nonceSource.GetNonceFunc = c.obtainNewNonce
+	})
+}
+
 func (c *Client) doReqEx(method, url string, key crypto.PrivateKey, v, r interface{}, ctx context.Context) (*http.Response, error) {
 	if !ValidURL(url) {
 		return nil, fmt.Errorf("invalid URL: %#v", url)
@@ -147,8 +247,14 @@ func (c *Client) doReqEx(method, url string, key crypto.PrivateKey, v, r interfa
 		key = c.AccountKey
 	}
 
-	c.nonceSource.GetNonceFunc = c.obtainNewNonce
+	c.init()
 
+	return retryBadNonce(func() (*http.Response, error) {
+		return c.doReqExOnce(method, url, key, v, r, ctx)
+	})
+}
+
+func (c *Client) doReqExOnce(method, url string, key crypto.PrivateKey, v, r interface{}, ctx context.Context) (*http.Response, error) {
 	var rdr io.Reader
 	if v != nil {
 		b, err := json.Marshal(v)
@@ -195,6 +301,91 @@ func (c *Client) doReqEx(method, url string, key crypto.PrivateKey, v, r interfa
 		req.Header.Set("Content-Type", "application/json")
 	}
 
+	return c.doReqFinish(req, r, ctx)
+}
+
+// Makes an RFC 8555 request. The object v is marshalled and signed with key,
+// or with the account key if key is nil. If embedJWK is set, the public key is
+// embedded in the request; otherwise the request identifies the account by
+// its URL. If v is nil, a POST-as-GET request is made.
+func (c *Client) doReqRFC(url string, key crypto.PrivateKey, embedJWK bool, v, r interface{}, ctx context.Context) (*http.Response, error) {
+	if !ValidURL(url) {
+		return nil, fmt.Errorf("invalid URL: %#v", url)
+	}
+
+	if key == nil {
+		key = c.AccountKey
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("account key must be specified")
+	}
+
+	c.init()
+
+	return retryBadNonce(func() (*http.Response, error) {
+		return c.doReqRFCOnce(url, key, embedJWK, v, r, ctx)
+	})
+}
+
+func (c *Client) doReqRFCOnce(url string, key crypto.PrivateKey, embedJWK bool, v, r interface{}, ctx context.Context) (*http.Response, error) {
+	var payload []byte
+	if v != nil {
+		var err error
+		payload, err = json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hdr := jwsHeader{
+		URL: url,
+	}
+
+	if embedJWK {
+		pk, err := publicKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		hdr.JWK = &jose.JsonWebKey{Key: pk}
+	} else {
+		// This may itself make a request, so it must be done before taking a
+		// nonce.
+		accountURL, err := c.getAccountURL(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		hdr.KeyID = accountURL
+	}
+
+	nonce, err := c.nonceSource.Nonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr.Nonce = nonce
+	b, err := signJWS(key, &hdr, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/jose+json")
+	if r != nil {
+		req.Header.Set("Accept", "application/json")
+	}
+
+	return c.doReqFinish(req, r, ctx)
+}
+
+func (c *Client) doReqFinish(req *http.Request, r interface{}, ctx context.Context) (*http.Response, error) {
+	url := req.URL.String()
 	log.Debugf("request: %s", url)
 	res, err := c.doReqActual(req, ctx)
 	log.Debugf("response: %v %v", res, err)
@@ -213,7 +404,7 @@ func (c *Client) doReqEx(method, url string, key crypto.PrivateKey, v, r interfa
 
 	if r != nil {
 		defer res.Body.Close()
-		if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		if ct := contentType(res); ct != "application/json" {
 			return res, fmt.Errorf("unexpected content type: %#v", ct)
 		}
 
@@ -226,6 +417,16 @@ func (c *Client) doReqEx(method, url string, key crypto.PrivateKey, v, r interfa
 	return res, nil
 }
 
+// Returns the media type of a response, without any parameters.
+func contentType(res *http.Response) string {
+	mt, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+
+	return mt
+}
+
 func (c *Client) doReqActual(req *http.Request, ctx context.Context) (*http.Response, error) {
 	req.Header.Set("User-Agent", userAgent(UserAgent))
 	return ctxhttp.Do(ctx, c.HTTPClient, req)
@@ -236,27 +437,111 @@ func (c *Client) forceGetDirectory(ctx context.Context) (*directoryInfo, error)
 		return nil, fmt.Errorf("must specify a directory URL")
 	}
 
-	_, err := c.doReq("GET", c.DirectoryURL, nil, &c.dir, ctx)
+	var dir *directoryInfo
+	_, err := c.doReq("GET", c.DirectoryURL, nil, &dir, ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	if !ValidURL(c.dir.NewReg) || !ValidURL(c.dir.NewAuthz) || !ValidURL(c.dir.NewCert) {
-		c.dir = nil
-		return nil, fmt.Errorf("directory does not provide required endpoints")
+	if dir == nil || (!dir.isRFC8555() && (!ValidURL(dir.NewReg) || !ValidURL(dir.NewAuthz) || !ValidURL(dir.NewCert))) {
+		dir = nil
+		err = fmt.Errorf("directory does not provide required endpoints")
 	}
 
-	return c.dir, nil
+	c.mutex.Lock()
+	c.dir = dir
+	c.mutex.Unlock()
+	return dir, err
 }
 
 func (c *Client) getDirectory(ctx context.Context) (*directoryInfo, error) {
-	if c.dir != nil {
-		return c.dir, nil
+	c.mutex.Lock()
+	dir := c.dir
+	c.mutex.Unlock()
+
+	if dir != nil {
+		return dir, nil
 	}
 
 	return c.forceGetDirectory(ctx)
 }
 
+// Returns true if the server implements RFC 8555, in which case certificates
+// must be obtained using orders. Otherwise the server implements an earlier
+// draft of the protocol and certificates are requested using
+// RequestCertificate.
+func (c *Client) SupportsOrders(ctx context.Context) (bool, error) {
+	di, err := c.getDirectory(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return di.isRFC8555(), nil
+}
+
+// Returns true if the server requires external account binding credentials
+// in order to create an account.
+func (c *Client) ExternalAccountRequired(ctx context.Context) (bool, error) {
+	di, err := c.getDirectory(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return di.isRFC8555() && di.Meta.ExternalAccountRequired, nil
+}
+
+// Returns the account URL, looking it up using the account key if it is not
+// yet known. Fails if no account exists for the key.
+func (c *Client) getAccountURL(ctx context.Context) (string, error) {
+	c.mutex.Lock()
+	accountURL := c.AccountURL
+	c.mutex.Unlock()
+
+	if accountURL != "" {
+		return accountURL, nil
+	}
+
+	di, err := c.getDirectory(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := c.doReqRFC(di.NewAccount, nil, true, &accountReq{OnlyReturnExisting: true}, nil, ctx)
+	if err != nil {
+		return "", err
+	}
+
+	res.Body.Close()
+	loc := res.Header.Get("Location")
+	if !ValidURL(loc) {
+		return "", fmt.Errorf("invalid URL: %q", loc)
+	}
+
+	c.mutex.Lock()
+	c.AccountURL = loc
+	c.mutex.Unlock()
+	return loc, nil
+}
+
+// Loads a resource at the given URL. RFC 8555 servers require this to be done
+// via an authenticated POST-as-GET request; draft servers use plain GET
+// requests. A directory URL is not needed to load resources from draft
+// servers, so if none is set, plain GET is used.
+func (c *Client) loadResource(url string, r interface{}, ctx context.Context) (*http.Response, error) {
+	if c.DirectoryURL != "" {
+		di, err := c.getDirectory(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if di.isRFC8555() {
+			return c.doReqRFC(url, nil, false, nil, r, ctx)
+		}
+	}
+
+	return c.doReq("GET", url, nil, r, ctx)
+}
+
 // API Methods
 
 var newRegCodes = []int{201, 409}
@@ -278,12 +563,20 @@ func isStatusCode(res *http.Response, codes []int) bool {
 //
 // Note that this operation requires an account key, since the registration is
 // private data requiring authentication to access.
+//
+// For RFC 8555 servers, a new account is created only if reg.AgreementURI
+// matches the terms of service currently required by the server. If it does
+// not, AgreementError is returned and no account is created.
 func (c *Client) UpsertRegistration(reg *Registration, ctx context.Context) error {
 	di, err := c.getDirectory(ctx)
 	if err != nil {
 		return err
 	}
 
+	if di.isRFC8555() {
+		return c.upsertRegistrationRFC(reg, di, ctx)
+	}
+
 	// Determine whether we need to get the registration URI.
 	endp := reg.URI
 	resource := "reg"
@@ -294,8 +587,10 @@ func (c *Client) UpsertRegistration(reg *Registration, ctx context.Context) erro
 		expectCode = newRegCodes
 	}
 
-	// Make request.
+	// Make request. The status returned by the server must not be echoed back;
+	// it is only sent when deactivating.
 	reg.Resource = resource
+	reg.Status = ""
 	res, err := c.doReq("POST", endp, reg, reg, ctx)
 	if res == nil {
 		return err
@@ -340,12 +635,238 @@ func (c *Client) UpsertRegistration(reg *Registration, ctx context.Context) erro
 	return nil
 }
 
+func (c *Client) upsertRegistrationRFC(reg *Registration, di *directoryInfo, ctx context.Context) error {
+	var err error
+	tos := di.Meta.TermsOfService
+
+	if reg.URI == "" {
+		c.mutex.Lock()
+		reg.URI = c.AccountURL
+		c.mutex.Unlock()
+	}
+
+	if reg.URI == "" {
+		// Determine whether an account already exists for the key.
+		accountURL, err := c.getAccountURL(ctx)
+		switch {
+		case err == nil:
+			reg.URI = accountURL
+		case !errors.Is(err, ErrAccountDoesNotExist):
+			return err
+		}
+	}
+
+	if reg.URI == "" {
+		// Create a new account.
+		reg.LatestAgreementURI = tos
+		if tos != "" && reg.AgreementURI != tos {
+			return &AgreementError{tos}
+		}
+
+		req := &accountReq{
+			Contact:              reg.ContactURIs,
+			TermsOfServiceAgreed: tos != "",
+		}
+
+		if reg.ExternalAccountBinding != nil {
+			req.ExternalAccountBinding, err = c.externalAccountBindingJWS(reg.ExternalAccountBinding, di.NewAccount)
+			if err != nil {
+				return err
+			}
+		} else if di.Meta.ExternalAccountRequired {
+			return ErrNoExternalAccountBinding
+		}
+
+		res, err := c.doReqRFC(di.NewAccount, nil, true, req, reg, ctx)
+		if err != nil {
+			return err
+		}
+
+		loc := res.Header.Get("Location")
+		if !ValidURL(loc) {
+			return fmt.Errorf("invalid URL: %q", loc)
+		}
+
+		reg.URI = loc
+		c.mutex.Lock()
+		c.AccountURL = loc
+		c.mutex.Unlock()
+		return nil
+	}
+
+	// Update the existing account. Agreement to the terms of service was given
+	// when the account was created; RFC 8555 servers which require agreement
+	// to new terms signal this by failing requests, so there is nothing to
+	// track here.
+	c.mutex.Lock()
+	c.AccountURL = reg.URI
+	c.mutex.Unlock()
+	req := &accountReq{
+		Contact: reg.ContactURIs,
+	}
+
+	_, err = c.doReqRFC(reg.URI, nil, false, req, reg, ctx)
+	if err != nil {
+		return err
+	}
+
+	reg.LatestAgreementURI = tos
+	reg.AgreementURI = tos
+	return nil
+}
+
+// Returns the JWS binding the account key to an external account. This is the
+// account public key, signed with the external account MAC key.
+func (c *Client) externalAccountBindingJWS(eab *ExternalAccountBinding, url string) (json.RawMessage, error) {
+	pk, err := publicKey(c.AccountKey)
+	if err != nil {
+		return nil, err
+	}
+
+	jwk, err := json.Marshal(&jose.JsonWebKey{Key: pk})
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := jwsHeader{
+		URL:   url,
+		KeyID: eab.KeyID,
+	}
+
+	return signJWS(eab.HMACKey, &hdr, jwk)
+}
+
+// Changes the account key to newKey. The account must already exist. On
+// success, c.AccountKey is set to newKey.
+//
+// Only RFC 8555 servers support this.
+func (c *Client) ChangeKey(newKey crypto.PrivateKey, ctx context.Context) error {
+	di, err := c.getDirectory(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !di.isRFC8555() || !ValidURL(di.KeyChange) {
+		return fmt.Errorf("server does not support key change")
+	}
+
+	accountURL, err := c.getAccountURL(ctx)
+	if err != nil {
+		return err
+	}
+
+	oldPK, err := publicKey(c.AccountKey)
+	if err != nil {
+		return err
+	}
+
+	newPK, err := publicKey(newKey)
+	if err != nil {
+		return err
+	}
+
+	// The request is a JWS signed by the new key, nested inside a JWS signed
+	// by the old key.
+	payload, err := json.Marshal(&keyChangeReq{
+		Account: accountURL,
+		OldKey:  &jose.JsonWebKey{Key: oldPK},
+	})
+	if err != nil {
+		return err
+	}
+
+	hdr := jwsHeader{
+		URL: di.KeyChange,
+		JWK: &jose.JsonWebKey{Key: newPK},
+	}
+
+	inner, err := signJWS(newKey, &hdr, payload)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.doReqRFC(di.KeyChange, nil, false, json.RawMessage(inner), nil, ctx)
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+	c.AccountKey = newKey
+	return nil
+}
+
+// Deactivates the account. Once deactivated, the server will refuse any further
+// requests made using the account key. If reg.URI is not set, the account URL
+// is determined from the account key.
+func (c *Client) DeactivateRegistration(reg *Registration, ctx context.Context) error {
+	di, err := c.getDirectory(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !di.isRFC8555() {
+		if reg.URI == "" {
+			// Posting to new-reg with an existing key yields the registration URL.
+			err = c.UpsertRegistration(reg, ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		reg.Resource = "reg"
+		reg.Status = StatusDeactivated
+		res, err := c.doReq("POST", reg.URI, reg, reg, ctx)
+		if res == nil {
+			return err
+		}
+
+		if !isStatusCode(res, updateRegCodes) {
+			if err != nil {
+				return err
+			}
+
+			return fmt.Errorf("unexpected status code: %d: %v", res.StatusCode, reg.URI)
+		}
+	} else {
+		if reg.URI == "" {
+			reg.URI, err = c.getAccountURL(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		req := &accountReq{
+			Status: StatusDeactivated,
+		}
+
+		_, err = c.doReqRFC(reg.URI, nil, false, req, reg, ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if reg.Status != StatusDeactivated {
+		return fmt.Errorf("account has unexpected status after deactivation: %q", reg.Status)
+	}
+
+	return nil
+}
+
 // This is a higher-level account registration method built on
 // UpsertRegistration. If a new agreement is required and its URI
 // is set in agreementURIs, it will be agreed to automatically. Otherwise
 // AgreementError will be returned.
 func (c *Client) AgreeRegistration(reg *Registration, agreementURIs map[string]struct{}, ctx context.Context) error {
 	err := c.UpsertRegistration(reg, ctx)
+	if e, ok := err.(*AgreementError); ok {
+		// RFC 8555 servers require agreement at account creation time.
+		if _, ok := agreementURIs[e.URI]; !ok {
+			return err
+		}
+
+		reg.AgreementURI = e.URI
+		err = c.UpsertRegistration(reg, ctx)
+	}
 	if err != nil {
 		return err
 	}
@@ -373,7 +894,7 @@ func (c *Client) AgreeRegistration(reg *Registration, agreementURIs map[string]s
 func (c *Client) LoadAuthorization(az *Authorization, ctx context.Context) error {
 	az.Combinations = nil
 
-	res, err := c.doReq("GET", az.URI, nil, az, ctx)
+	res, err := c.loadResource(az.URI, az, ctx)
 	if err != nil {
 		return err
 	}
@@ -403,12 +924,12 @@ func (az *Authorization) validate() error {
 		return fmt.Errorf("no challenges offered")
 	}
 
+	// Without combinations (as with RFC 8555), completing any one challenge is
+	// sufficient.
 	if az.Combinations == nil {
-		var is []int
 		for i := 0; i < len(az.Challenges); i++ {
-			is = append(is, i)
+			az.Combinations = append(az.Combinations, []int{i})
 		}
-		az.Combinations = append(az.Combinations, is)
 	}
 
 	for _, c := range az.Combinations {
@@ -427,7 +948,7 @@ func (az *Authorization) validate() error {
 // You can load a challenge from only the URI by creating a Challenge with the
 // URI set and then calling this.
 func (c *Client) LoadChallenge(ch *Challenge, ctx context.Context) error {
-	res, err := c.doReq("GET", ch.URI, nil, ch, ctx)
+	res, err := c.loadResource(ch.URI, ch, ctx)
 	if err != nil {
 		return err
 	}
@@ -447,19 +968,23 @@ func (c *Client) WaitLoadChallenge(ch *Challenge, ctx context.Context) error {
 	return c.LoadChallenge(ch, ctx)
 }
 
-// Create a new authorization for the given hostname.
+// Create a new authorization for the given hostname or IP address.
+//
+// RFC 8555 servers are not required to support this (pre-authorization);
+// authorizations are normally obtained by creating an order.
 func (c *Client) NewAuthorization(hostname string, ctx context.Context) (*Authorization, error) {
 	di, err := c.getDirectory(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	if di.isRFC8555() {
+		return c.newAuthorizationRFC(hostname, di, ctx)
+	}
+
 	az := &Authorization{
-		Resource: "new-authz",
-		Identifier: Identifier{
-			Type:  "dns",
-			Value: hostname,
-		},
+		Resource:   "new-authz",
+		Identifier: NewIdentifier(hostname),
 	}
 
 	res, err := c.doReq("POST", di.NewAuthz, az, az, ctx)
@@ -482,13 +1007,57 @@ func (c *Client) NewAuthorization(hostname string, ctx context.Context) (*Author
 	return az, nil
 }
 
+func (c *Client) newAuthorizationRFC(hostname string, di *directoryInfo, ctx context.Context) (*Authorization, error) {
+	if di.NewAuthzRFC == "" {
+		return nil, fmt.Errorf("server does not support pre-authorization")
+	}
+
+	req := &newAuthzReq{
+		Identifier: NewIdentifier(hostname),
+	}
+
+	az := &Authorization{}
+	res, err := c.doReqRFC(di.NewAuthzRFC, nil, false, req, az, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	loc := res.Header.Get("Location")
+	if res.StatusCode != 201 || !ValidURL(loc) {
+		return nil, fmt.Errorf("expected status code 201 and valid Location header: %#v", res)
+	}
+
+	az.URI = loc
+
+	err = az.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return az, nil
+}
+
 // Submit a challenge response. Only the challenge URI is required.
 //
 // The response message is signed with the given key.
 //
 // If responseKey is nil, the account key is used.
+//
+// RFC 8555 servers take no challenge response data, so for those servers the
+// response and responseKey are ignored and the challenge is simply marked as
+// ready for validation.
 func (c *Client) RespondToChallenge(ch *Challenge, response json.RawMessage, responseKey crypto.PrivateKey, ctx context.Context) error {
-	_, err := c.doReqEx("POST", ch.URI, responseKey, &response, c, ctx)
+	di, err := c.getDirectory(ctx)
+	if err != nil {
+		return err
+	}
+
+	if di.isRFC8555() {
+		_, err = c.doReqRFC(ch.URI, nil, false, struct{}{}, ch, ctx)
+		return err
+	}
+
+	_, err = c.doReqEx("POST", ch.URI, responseKey, &response, c, ctx)
 	if err != nil {
 		return err
 	}
@@ -497,12 +1066,20 @@ func (c *Client) RespondToChallenge(ch *Challenge, response json.RawMessage, res
 }
 
 // Request a certificate using a CSR in DER form.
+//
+// For RFC 8555 servers, an order is created for the names in the CSR and
+// immediately finalized, so this succeeds only if valid authorizations
+// already exist for all of the names. Use orders directly instead.
 func (c *Client) RequestCertificate(csrDER []byte, ctx context.Context) (*Certificate, error) {
 	di, err := c.getDirectory(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	if di.isRFC8555() {
+		return c.requestCertificateRFC(csrDER, ctx)
+	}
+
 	crt := &Certificate{
 		Resource: "new-cert",
 		CSR:      csrDER,
@@ -533,6 +1110,51 @@ func (c *Client) RequestCertificate(csrDER []byte, ctx context.Context) (*Certif
 	return crt, nil
 }
 
+func (c *Client) requestCertificateRFC(csrDER []byte, ctx context.Context) (*Certificate, error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, err
+	}
+
+	order := &Order{}
+	for _, name := range csr.DNSNames {
+		order.Identifiers = append(order.Identifiers, NewIdentifier(name))
+	}
+	for _, ip := range csr.IPAddresses {
+		order.Identifiers = append(order.Identifiers, NewIdentifier(ip.String()))
+	}
+
+	err = c.NewOrder(order, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.FinalizeOrder(order, csrDER, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.WaitForOrder(order, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if order.Status != StatusValid {
+		return nil, fmt.Errorf("order has unexpected status: %v", order.Status)
+	}
+
+	crt := &Certificate{
+		URI: order.CertificateURI,
+	}
+
+	err = c.LoadCertificate(crt, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return crt, nil
+}
+
 // Load or reload a certificate.
 //
 // You can load a certificate from its URI by creating a Certificate with the
@@ -541,7 +1163,7 @@ func (c *Client) RequestCertificate(csrDER []byte, ctx context.Context) (*Certif
 // Returns nil if the certificate is not yet ready, but the Certificate field
 // will remain nil.
 func (c *Client) LoadCertificate(crt *Certificate, ctx context.Context) error {
-	res, err := c.doReq("GET", crt.URI, nil, nil, ctx)
+	res, err := c.loadResource(crt.URI, nil, ctx)
 	if err != nil {
 		return err
 	}
@@ -551,7 +1173,7 @@ func (c *Client) LoadCertificate(crt *Certificate, ctx context.Context) error {
 
 func (c *Client) loadCertificate(crt *Certificate, res *http.Response, ctx context.Context) error {
 	defer res.Body.Close()
-	ct := res.Header.Get("Content-Type")
+	ct := contentType(res)
 	if ct == "application/pkix-cert" {
 		der, err := ioutil.ReadAll(denet.LimitReader(res.Body, 1*1024*1024))
 		if err != nil {
@@ -564,6 +1186,18 @@ func (c *Client) loadCertificate(crt *Certificate, res *http.Response, ctx conte
 			return err
 		}
 
+	} else if ct == "application/pem-certificate-chain" {
+		// RFC 8555 servers return the whole chain at once.
+		b, err := ioutil.ReadAll(denet.LimitReader(res.Body, 1*1024*1024))
+		if err != nil {
+			return err
+		}
+
+		crt.Certificate, crt.ExtraCertificates, err = parsePEMChain(b)
+		if err != nil {
+			return err
+		}
+
 	} else if res.StatusCode == 200 {
 		return fmt.Errorf("Certificate returned with unexpected type: %v", ct)
 	}
@@ -612,6 +1246,31 @@ func (c *Client) loadExtraCertificates(crt *Certificate, res *http.Response, ctx
 	}
 }
 
+// Parses a PEM certificate chain into the end-entity certificate and any
+// further certificates, all in DER form.
+func parsePEMChain(b []byte) ([]byte, [][]byte, error) {
+	var ders [][]byte
+	for {
+		var p *pem.Block
+		p, b = pem.Decode(b)
+		if p == nil {
+			break
+		}
+
+		if p.Type != "CERTIFICATE" {
+			return nil, nil, fmt.Errorf("unexpected PEM block in certificate chain: %q", p.Type)
+		}
+
+		ders = append(ders, p.Bytes)
+	}
+
+	if len(ders) == 0 {
+		return nil, nil, fmt.Errorf("no certificates in certificate chain")
+	}
+
+	return ders[0], ders[1:], nil
+}
+
 // Like LoadCertificate, but waits the retry time if this is not the first
 // attempt to load this certificate. To be used when polling.
 //
@@ -652,6 +1311,20 @@ func (c *Client) Revoke(certificateDER []byte, revocationKey crypto.PrivateKey,
 		return err
 	}
 
+	if di.isRFC8555() {
+		req := &revokeReq{
+			Certificate: certificateDER,
+		}
+
+		res, err := c.doReqRFC(di.RevokeCertRFC, revocationKey, revocationKey != nil, req, nil, ctx)
+		if err != nil {
+			return err
+		}
+
+		res.Body.Close()
+		return nil
+	}
+
 	if di.RevokeCert == "" {
 		return fmt.Errorf("endpoint does not support revocation")
 	}
@@ -670,6 +1343,113 @@ func (c *Client) Revoke(certificateDER []byte, revocationKey crypto.PrivateKey,
 	return nil
 }
 
+// Create a new order. order.Identifiers must be set; order.NotBefore,
+// order.NotAfter and order.Replaces may optionally be set. On success, the
+// order is filled in from the server's response and order.URI is set.
+//
+// Only RFC 8555 servers support orders.
+func (c *Client) NewOrder(order *Order, ctx context.Context) error {
+	di, err := c.getDirectory(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !di.isRFC8555() {
+		return fmt.Errorf("server does not support orders")
+	}
+
+	req := &orderReq{
+		Identifiers: order.Identifiers,
+		NotBefore:   timePtr(order.NotBefore),
+		NotAfter:    timePtr(order.NotAfter),
+		Replaces:    order.Replaces,
+	}
+
+	res, err := c.doReqRFC(di.NewOrder, nil, false, req, order, ctx)
+	if err != nil {
+		return err
+	}
+
+	loc := res.Header.Get("Location")
+	if res.StatusCode != 201 || !ValidURL(loc) {
+		return fmt.Errorf("expected status code 201 and valid Location header: %#v", res)
+	}
+
+	order.URI = loc
+	order.retryAt = retryAtDefault(res.Header, 5*time.Second)
+	return nil
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// Load or reload the details of an order via the URI.
+//
+// You can load an order from only the URI by creating an Order with the URI
+// set and then calling this.
+func (c *Client) LoadOrder(order *Order, ctx context.Context) error {
+	res, err := c.loadResource(order.URI, order, ctx)
+	if err != nil {
+		return err
+	}
+
+	order.retryAt = retryAtDefault(res.Header, 5*time.Second)
+	return nil
+}
+
+// Like LoadOrder, but waits the retry time if this is not the first attempt
+// to load this order. To be used when polling.
+func (c *Client) WaitLoadOrder(order *Order, ctx context.Context) error {
+	err := waitUntil(order.retryAt, ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.LoadOrder(order, ctx)
+}
+
+// Finalize an order by submitting a CSR in DER form. The order must be ready,
+// meaning that all of its authorizations have been completed. On success, the
+// order is updated from the server's response; it will usually be processing
+// or valid. Use WaitForOrder to wait for it to become valid.
+func (c *Client) FinalizeOrder(order *Order, csrDER []byte, ctx context.Context) error {
+	req := &finalizeReq{
+		CSR: csrDER,
+	}
+
+	res, err := c.doReqRFC(order.FinalizeURI, nil, false, req, order, ctx)
+	if err != nil {
+		return err
+	}
+
+	order.retryAt = retryAtDefault(res.Header, 5*time.Second)
+	return nil
+}
+
+// Wait for an order which is being processed to leave the processing state.
+// If the order is not being processed, this is a no-op. Only the URI is
+// required. Check the order status afterwards; if it is valid,
+// order.CertificateURI is set. May be cancelled using the context.
+func (c *Client) WaitForOrder(order *Order, ctx context.Context) error {
+	for {
+		switch order.Status {
+		case "", StatusUnknown, StatusProcessing:
+		default:
+			return nil
+		}
+
+		err := c.WaitLoadOrder(order, ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func userAgent(ua string) string {
 	if ua != "" {
 		ua += " "
@@ -3,15 +3,20 @@ package acmeapi
 import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"github.com/hlandau/goutils/test"
 	"github.com/hlandau/xlog"
 	"github.com/square/go-jose"
 	"golang.org/x/net/context"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"reflect"
 	"testing"
@@ -358,3 +363,540 @@ func TestAPI(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 }
+
+func TestOrders(t *testing.T) {
+	Log.SetSeverity(xlog.SevDebug)
+
+	mt := test.HTTPMockTransport{}
+	epk, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	cl := &Client{
+		HTTPClient: &http.Client{
+			Transport: &mt,
+		},
+		AccountKey:   epk,
+		DirectoryURL: "https://pebble.test/dir",
+	}
+
+	issuedNonces := map[string]struct{}{}
+	issueNonce := func() string {
+		var b [8]byte
+		rand.Read(b[:])
+		s := fmt.Sprintf("nonce-%s", hex.EncodeToString(b[:]))
+		issuedNonces[s] = struct{}{}
+		return s
+	}
+
+	// Checks the request signature and headers and returns the payload.
+	accountPub := &epk.PublicKey
+	checkRequest := func(rw http.ResponseWriter, req *http.Request, wantKID bool) ([]byte, bool) {
+		rw.Header().Set("Replay-Nonce", issueNonce())
+		if req.Method != "POST" || req.Header.Get("Content-Type") != "application/jose+json" {
+			t.Fatalf("bad method or content type: %v %v", req.Method, req.Header.Get("Content-Type"))
+		}
+
+		var j flattenedJWS
+		err := json.NewDecoder(req.Body).Decode(&j)
+		if err != nil {
+			t.Fatalf("malformed request body: %v", err)
+		}
+
+		hb, _ := base64.RawURLEncoding.DecodeString(j.Protected)
+		payload, _ := base64.RawURLEncoding.DecodeString(j.Payload)
+		sig, _ := base64.RawURLEncoding.DecodeString(j.Signature)
+
+		var hdr jwsHeader
+		err = json.Unmarshal(hb, &hdr)
+		if err != nil {
+			t.Fatalf("malformed protected header: %v", err)
+		}
+
+		if hdr.Algorithm != "ES256" || hdr.URL != req.URL.String() {
+			t.Fatalf("bad protected header: %#v", &hdr)
+		}
+
+		if wantKID != (hdr.KeyID == "https://pebble.test/acct/1") || wantKID == (hdr.JWK != nil) {
+			t.Fatalf("bad key identification: %#v", &hdr)
+		}
+
+		h := sha256.Sum256([]byte(j.Protected + "." + j.Payload))
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if len(sig) != 64 || !ecdsa.Verify(accountPub, h[:], r, s) {
+			t.Fatalf("bad signature")
+		}
+
+		if _, ok := issuedNonces[hdr.Nonce]; !ok {
+			rw.Header().Set("Content-Type", "application/problem+json")
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"type":"urn:ietf:params:acme:error:badNonce"}`))
+			t.Errorf("invalid nonce: %#v", hdr.Nonce)
+			return nil, false
+		}
+		delete(issuedNonces, hdr.Nonce)
+
+		return payload, true
+	}
+
+	mt.AddHandlerFunc("pebble.test/dir", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(200)
+		rw.Write([]byte(`{
+      "newNonce": "https://pebble.test/nonce-plz",
+      "newAccount": "https://pebble.test/sign-me-up",
+      "newOrder": "https://pebble.test/order-plz",
+      "revokeCert": "https://pebble.test/revoke-cert",
+      "keyChange": "https://pebble.test/rollover-account-key",
+      "meta": {
+        "termsOfService": "https://pebble.test/tos"
+      }
+    }`))
+	})
+
+	mt.AddHandlerFunc("pebble.test/nonce-plz", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "HEAD" {
+			t.Fatal()
+		}
+		rw.Header().Set("Replay-Nonce", issueNonce())
+		rw.WriteHeader(200)
+	})
+
+	// Registration
+
+	created := false
+	mt.AddHandlerFunc("pebble.test/sign-me-up", func(rw http.ResponseWriter, req *http.Request) {
+		payload, ok := checkRequest(rw, req, false)
+		if !ok {
+			return
+		}
+
+		var ar accountReq
+		json.Unmarshal(payload, &ar)
+		if !created && ar.OnlyReturnExisting {
+			rw.Header().Set("Content-Type", "application/problem+json")
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"type":"urn:ietf:params:acme:error:accountDoesNotExist"}`))
+			return
+		}
+
+		if !ar.OnlyReturnExisting {
+			if !ar.TermsOfServiceAgreed || !reflect.DeepEqual(ar.Contact, []string{"mailto:a@example.com"}) {
+				t.Fatalf("bad account request: %#v", &ar)
+			}
+			created = true
+		}
+
+		rw.Header().Set("Location", "https://pebble.test/acct/1")
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(201)
+		rw.Write([]byte(`{"status":"valid","contact":["mailto:a@example.com"],"orders":"https://pebble.test/acct/1/orders"}`))
+	})
+
+	reg := &Registration{
+		ContactURIs: []string{"mailto:a@example.com"},
+	}
+	err := cl.AgreeRegistration(reg, nil, context.TODO())
+	ae, ok := err.(*AgreementError)
+	if !ok || ae.URI != "https://pebble.test/tos" || created {
+		t.Fatalf("expected agreement error: %v", err)
+	}
+
+	err = cl.AgreeRegistration(reg, map[string]struct{}{"https://pebble.test/tos": {}}, context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if reg.URI != "https://pebble.test/acct/1" || cl.AccountURL != reg.URI || reg.Status != StatusValid || reg.OrdersURL == "" {
+		t.Fatalf("unexpected registration: %#v", reg)
+	}
+
+	// The account URL is looked up from the key if not known.
+	cl.AccountURL = ""
+
+	// New Order
+
+	mt.AddHandlerFunc("pebble.test/order-plz", func(rw http.ResponseWriter, req *http.Request) {
+		payload, ok := checkRequest(rw, req, true)
+		if !ok {
+			return
+		}
+
+		var or orderReq
+		json.Unmarshal(payload, &or)
+		if len(or.Identifiers) != 1 || or.Identifiers[0].Value != "example.com" || or.NotBefore != nil {
+			t.Fatalf("bad order request: %s", payload)
+		}
+
+		rw.Header().Set("Location", "https://pebble.test/my-order/1")
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(201)
+		rw.Write([]byte(`{
+      "status": "pending",
+      "expires": "2030-01-01T00:00:00Z",
+      "identifiers": [{"type":"dns","value":"example.com"}],
+      "authorizations": ["https://pebble.test/authZ/1"],
+      "finalize": "https://pebble.test/finalize-order/1"
+    }`))
+	})
+
+	order := &Order{
+		Identifiers: []Identifier{{Type: "dns", Value: "example.com"}},
+	}
+	err = cl.NewOrder(order, context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if order.URI != "https://pebble.test/my-order/1" || order.Status != StatusPending ||
+		!reflect.DeepEqual(order.AuthorizationURIs, []string{"https://pebble.test/authZ/1"}) ||
+		order.FinalizeURI != "https://pebble.test/finalize-order/1" {
+		t.Fatalf("unexpected order: %#v", order)
+	}
+
+	// Authorizations and challenges are loaded using POST-as-GET.
+
+	mt.AddHandlerFunc("pebble.test/authZ/1", func(rw http.ResponseWriter, req *http.Request) {
+		payload, ok := checkRequest(rw, req, true)
+		if !ok {
+			return
+		}
+		if len(payload) != 0 {
+			t.Fatalf("POST-as-GET with non-empty payload")
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(200)
+		rw.Write([]byte(`{
+      "status": "pending",
+      "identifier": {"type":"dns","value":"example.com"},
+      "challenges": [
+        {"type":"http-01","url":"https://pebble.test/chalZ/1","token":"tok","status":"pending"}
+      ]
+    }`))
+	})
+
+	az := &Authorization{URI: "https://pebble.test/authZ/1"}
+	err = cl.LoadAuthorization(az, context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if len(az.Challenges) != 1 || az.Challenges[0].URI != "https://pebble.test/chalZ/1" || az.Challenges[0].Token != "tok" {
+		t.Fatalf("unexpected authorization: %#v", az)
+	}
+
+	mt.AddHandlerFunc("pebble.test/chalZ/1", func(rw http.ResponseWriter, req *http.Request) {
+		payload, ok := checkRequest(rw, req, true)
+		if !ok {
+			return
+		}
+		if string(payload) != "{}" {
+			t.Fatalf("unexpected challenge response: %s", payload)
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(200)
+		rw.Write([]byte(`{"type":"http-01","url":"https://pebble.test/chalZ/1","token":"tok","status":"processing"}`))
+	})
+
+	err = cl.RespondToChallenge(az.Challenges[0], json.RawMessage(`{"keyAuthorization":"x"}`), nil, context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if az.Challenges[0].Status != StatusProcessing {
+		t.Fatalf("challenge not updated: %#v", az.Challenges[0])
+	}
+
+	// Finalization
+
+	mt.AddHandlerFunc("pebble.test/finalize-order/1", func(rw http.ResponseWriter, req *http.Request) {
+		payload, ok := checkRequest(rw, req, true)
+		if !ok {
+			return
+		}
+
+		var fr finalizeReq
+		json.Unmarshal(payload, &fr)
+		if string(fr.CSR) != "csr" {
+			t.Fatalf("bad finalize request: %s", payload)
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Retry-After", "0")
+		rw.WriteHeader(200)
+		rw.Write([]byte(`{"status":"processing","identifiers":[{"type":"dns","value":"example.com"}],"finalize":"https://pebble.test/finalize-order/1"}`))
+	})
+
+	mt.AddHandlerFunc("pebble.test/my-order/1", func(rw http.ResponseWriter, req *http.Request) {
+		_, ok := checkRequest(rw, req, true)
+		if !ok {
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(200)
+		rw.Write([]byte(`{"status":"valid","identifiers":[{"type":"dns","value":"example.com"}],"finalize":"https://pebble.test/finalize-order/1","certificate":"https://pebble.test/certZ/1"}`))
+	})
+
+	err = cl.FinalizeOrder(order, []byte("csr"), context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if order.Status != StatusProcessing {
+		t.Fatalf("unexpected order status: %v", order.Status)
+	}
+
+	err = cl.WaitForOrder(order, context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if order.Status != StatusValid || order.CertificateURI != "https://pebble.test/certZ/1" {
+		t.Fatalf("unexpected order: %#v", order)
+	}
+
+	// Certificate
+
+	mt.AddHandlerFunc("pebble.test/certZ/1", func(rw http.ResponseWriter, req *http.Request) {
+		_, ok := checkRequest(rw, req, true)
+		if !ok {
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/pem-certificate-chain")
+		rw.WriteHeader(200)
+		pem.Encode(rw, &pem.Block{Type: "CERTIFICATE", Bytes: []byte("cert-data")})
+		pem.Encode(rw, &pem.Block{Type: "CERTIFICATE", Bytes: []byte("issuer-cert-data")})
+	})
+
+	crt := &Certificate{URI: order.CertificateURI}
+	err = cl.LoadCertificate(crt, context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if string(crt.Certificate) != "cert-data" || len(crt.ExtraCertificates) != 1 || string(crt.ExtraCertificates[0]) != "issuer-cert-data" {
+		t.Fatalf("unexpected certificate: %#v", crt)
+	}
+
+	// Revocation
+
+	mt.AddHandlerFunc("pebble.test/revoke-cert", func(rw http.ResponseWriter, req *http.Request) {
+		payload, ok := checkRequest(rw, req, true)
+		if !ok {
+			return
+		}
+
+		var rr revokeReq
+		json.Unmarshal(payload, &rr)
+		if string(rr.Certificate) != "cert-data" || rr.Resource != "" {
+			t.Fatalf("bad revocation request: %s", payload)
+		}
+
+		rw.WriteHeader(200)
+	})
+
+	err = cl.Revoke(crt.Certificate, nil, context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Key Change
+
+	npk, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	mt.AddHandlerFunc("pebble.test/rollover-account-key", func(rw http.ResponseWriter, req *http.Request) {
+		payload, ok := checkRequest(rw, req, true)
+		if !ok {
+			return
+		}
+
+		var j flattenedJWS
+		json.Unmarshal(payload, &j)
+		hb, _ := base64.RawURLEncoding.DecodeString(j.Protected)
+		innerPayload, _ := base64.RawURLEncoding.DecodeString(j.Payload)
+		sig, _ := base64.RawURLEncoding.DecodeString(j.Signature)
+
+		var hdr struct {
+			jwsHeader
+			JWK json.RawMessage `json:"jwk"`
+		}
+		json.Unmarshal(hb, &hdr)
+		if hdr.URL != "https://pebble.test/rollover-account-key" || hdr.Nonce != "" || hdr.KeyID != "" || len(hdr.JWK) == 0 {
+			t.Fatalf("bad inner protected header: %s", hb)
+		}
+
+		h := sha256.Sum256([]byte(j.Protected + "." + j.Payload))
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if len(sig) != 64 || !ecdsa.Verify(&npk.PublicKey, h[:], r, s) {
+			t.Fatalf("bad inner signature")
+		}
+
+		var kc struct {
+			Account string          `json:"account"`
+			OldKey  json.RawMessage `json:"oldKey"`
+		}
+		json.Unmarshal(innerPayload, &kc)
+		if kc.Account != "https://pebble.test/acct/1" || len(kc.OldKey) == 0 {
+			t.Fatalf("bad key change request: %s", innerPayload)
+		}
+
+		rw.WriteHeader(200)
+	})
+
+	err = cl.ChangeKey(npk, context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if cl.AccountKey != npk {
+		t.Fatalf("account key not changed")
+	}
+
+	accountPub = &npk.PublicKey
+
+	// Contact Update and Deactivation
+
+	mt.AddHandlerFunc("pebble.test/acct/1", func(rw http.ResponseWriter, req *http.Request) {
+		payload, ok := checkRequest(rw, req, true)
+		if !ok {
+			return
+		}
+
+		var ar accountReq
+		json.Unmarshal(payload, &ar)
+		status := "valid"
+		switch {
+		case ar.Status == StatusDeactivated && ar.Contact == nil:
+			status = "deactivated"
+		case ar.Status == "" && reflect.DeepEqual(ar.Contact, []string{"mailto:b@example.com"}):
+		default:
+			t.Fatalf("bad account update request: %s", payload)
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(200)
+		fmt.Fprintf(rw, `{"status":%q,"contact":["mailto:b@example.com"]}`, status)
+	})
+
+	reg = &Registration{
+		URI:         "https://pebble.test/acct/1",
+		ContactURIs: []string{"mailto:b@example.com"},
+	}
+	err = cl.UpsertRegistration(reg, context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	err = cl.DeactivateRegistration(reg, context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if reg.Status != StatusDeactivated {
+		t.Fatalf("unexpected registration: %#v", reg)
+	}
+}
+
+func TestExternalAccountBinding(t *testing.T) {
+	epk, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cl := &Client{
+		AccountKey: epk,
+	}
+
+	eab := &ExternalAccountBinding{
+		KeyID:   "kid-1",
+		HMACKey: []byte("secret"),
+	}
+
+	b, err := cl.externalAccountBindingJWS(eab, "https://ca.test/new-account")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var j flattenedJWS
+	err = json.Unmarshal(b, &j)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	hb, _ := base64.RawURLEncoding.DecodeString(j.Protected)
+	var hdr jwsHeader
+	json.Unmarshal(hb, &hdr)
+	if hdr.Algorithm != "HS256" || hdr.KeyID != "kid-1" || hdr.URL != "https://ca.test/new-account" || hdr.Nonce != "" || hdr.JWK != nil {
+		t.Fatalf("bad protected header: %s", hb)
+	}
+
+	mac := hmac.New(sha256.New, eab.HMACKey)
+	mac.Write([]byte(j.Protected + "." + j.Payload))
+	if b64enc(mac.Sum(nil)) != j.Signature {
+		t.Fatalf("bad signature")
+	}
+
+	payload, _ := base64.RawURLEncoding.DecodeString(j.Payload)
+	var jwk jose.JsonWebKey
+	err = json.Unmarshal(payload, &jwk)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if pk, ok := jwk.Key.(*ecdsa.PublicKey); !ok || pk.X.Cmp(epk.X) != 0 || pk.Y.Cmp(epk.Y) != 0 {
+		t.Fatalf("payload is not the account public key: %s", payload)
+	}
+}
+
+func TestNewIdentifier(t *testing.T) {
+	tests := []struct {
+		Name string
+		Identifier
+	}{
+		{"example.com", Identifier{"dns", "example.com"}},
+		{"192.0.2.1", Identifier{"ip", "192.0.2.1"}},
+		{"2001:db8:0:0::1", Identifier{"ip", "2001:db8::1"}},
+	}
+
+	for _, tst := range tests {
+		ident := NewIdentifier(tst.Name)
+		if ident != tst.Identifier {
+			t.Errorf("%q: got %#v, expected %#v", tst.Name, ident, tst.Identifier)
+		}
+	}
+}
+
+func TestAuthorizationCombinations(t *testing.T) {
+	mt := test.HTTPMockTransport{}
+	cl := &Client{
+		HTTPClient: &http.Client{
+			Transport: &mt,
+		},
+	}
+
+	mt.Add("boulder.test/acme/authz/several", &http.Response{
+		StatusCode: 200,
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+	}, []byte(`{"challenges":[
+    {"type": "http-01", "uri": "https://boulder.test/acme/challenge/1"},
+    {"type": "dns-01", "uri": "https://boulder.test/acme/challenge/2"},
+    {"type": "tls-alpn-01", "uri": "https://boulder.test/acme/challenge/3"}
+  ],
+  "identifier": {"type": "dns", "value": "example.com"},
+  "status": "pending"
+  }`))
+
+	az := &Authorization{
+		URI: "https://boulder.test/acme/authz/several",
+	}
+
+	err := cl.LoadAuthorization(az, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each challenge can be completed on its own.
+	correct := [][]int{{0}, {1}, {2}}
+	if !reflect.DeepEqual(az.Combinations, correct) {
+		t.Fatalf("unexpected combinations: %v", az.Combinations)
+	}
+}
@@ -0,0 +1,132 @@
+package acmeapi
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/square/go-jose.v1"
+	"math/big"
+)
+
+// RFC 8555 requires the "url" protected header, and identifies accounts using
+// the "kid" header, neither of which go-jose allows us to set. Since ACME only
+// ever uses the flattened JSON serialization with a single signature, it is
+// simplest to construct the JWS directly.
+
+// Protected header of an RFC 8555 JWS. Exactly one of KeyID and JWK is set.
+type jwsHeader struct {
+	Algorithm string           `json:"alg"`
+	Nonce     string           `json:"nonce,omitempty"`
+	URL       string           `json:"url"`
+	KeyID     string           `json:"kid,omitempty"`
+	JWK       *jose.JsonWebKey `json:"jwk,omitempty"`
+}
+
+// A JWS in flattened JSON serialization.
+type flattenedJWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// Returns the public key corresponding to a private key.
+func publicKey(key crypto.PrivateKey) (crypto.PublicKey, error) {
+	s, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type: %T", key)
+	}
+
+	return s.Public(), nil
+}
+
+// Signs payload with key, setting hdr.Algorithm appropriately. A nil payload
+// is encoded as the empty string, as is required for POST-as-GET requests.
+func signJWS(key crypto.PrivateKey, hdr *jwsHeader, payload []byte) ([]byte, error) {
+	alg, err := algorithmFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr.Algorithm = string(alg)
+	hdrb, err := json.Marshal(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	j := flattenedJWS{
+		Protected: b64enc(hdrb),
+		Payload:   b64enc(payload),
+	}
+
+	sig, err := signBytes(key, []byte(j.Protected+"."+j.Payload))
+	if err != nil {
+		return nil, err
+	}
+
+	j.Signature = b64enc(sig)
+	return json.Marshal(&j)
+}
+
+func signBytes(key crypto.PrivateKey, data []byte) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hashBytes(crypto.SHA256, data))
+
+	case *ecdsa.PrivateKey:
+		var h crypto.Hash
+		switch k.Curve.Params().Name {
+		case "P-256":
+			h = crypto.SHA256
+		case "P-384":
+			h = crypto.SHA384
+		case "P-521":
+			h = crypto.SHA512
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve: %s", k.Curve.Params().Name)
+		}
+
+		r, s, err := ecdsa.Sign(rand.Reader, k, hashBytes(h, data))
+		if err != nil {
+			return nil, err
+		}
+
+		// JWS ECDSA signatures are the concatenation of R and S, each padded to
+		// the size of the curve.
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return append(padBigInt(r, size), padBigInt(s, size)...), nil
+
+	case []byte:
+		h := hmac.New(crypto.SHA256.New, k)
+		h.Write(data)
+		return h.Sum(nil), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %T", key)
+	}
+}
+
+func hashBytes(h crypto.Hash, data []byte) []byte {
+	hh := h.New()
+	hh.Write(data)
+	return hh.Sum(nil)
+}
+
+func padBigInt(i *big.Int, size int) []byte {
+	b := i.Bytes()
+	if len(b) >= size {
+		return b
+	}
+
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func b64enc(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -3,42 +3,44 @@ package acmeapi
 import (
 	"errors"
 	"golang.org/x/net/context"
+	"sync"
 )
 
 type nonceSource struct {
 	pool         map[string]struct{}
+	poolMutex    sync.Mutex
 	GetNonceFunc func(ctx context.Context) error
 }
 
-func (ns *nonceSource) init() {
-	if ns.pool != nil {
-		return
+// Takes a nonce from the pool, or returns "" if it is empty.
+func (ns *nonceSource) take() string {
+	ns.poolMutex.Lock()
+	defer ns.poolMutex.Unlock()
+
+	for k := range ns.pool {
+		delete(ns.pool, k)
+		return k
 	}
 
-	ns.pool = map[string]struct{}{}
+	return ""
 }
 
 func (ns *nonceSource) Nonce(ctx context.Context) (string, error) {
-	ns.init()
-
-	var k string
-	for k = range ns.pool {
-		break
-	}
+	k := ns.take()
 	if k == "" {
 		err := ns.obtainNonce(ctx)
 		if err != nil {
 			return "", err
 		}
-		for k = range ns.pool {
-			break
-		}
+
+		// Another caller may have taken the nonce obtained in the meantime, but
+		// this is unlikely and the caller will simply fail.
+		k = ns.take()
 		if k == "" {
 			return "", errors.New("failed to retrieve additional nonce")
 		}
 	}
 
-	delete(ns.pool, k)
 	return k, nil
 }
 
@@ -51,7 +53,13 @@ func (ns *nonceSource) obtainNonce(ctx context.Context) error {
 }
 
 func (ns *nonceSource) AddNonce(nonce string) {
-	ns.init()
+	ns.poolMutex.Lock()
+	defer ns.poolMutex.Unlock()
+
+	if ns.pool == nil {
+		ns.pool = map[string]struct{}{}
+	}
+
 	ns.pool[nonce] = struct{}{}
 }
 
@@ -0,0 +1,99 @@
+package acmeapi
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"strings"
+	"time"
+)
+
+// Returned by LoadRenewalInfo if the server does not provide renewal
+// information.
+var ErrRenewalInfoNotSupported = errors.New("server does not support renewal information")
+
+// How long to wait before fetching renewal information again if the server
+// does not specify, and the longest wait accepted from the server. Renewal
+// information may change at any time, for example if a certificate is to be
+// revoked, so it must be checked regularly.
+const (
+	renewalInfoRetryDefault = 6 * time.Hour
+	renewalInfoRetryMax     = 24 * time.Hour
+)
+
+// Returns the identifier used to refer to a certificate in renewal
+// information requests and in the "replaces" field of orders (RFC 9773).
+// This is formed from the certificate's authority key identifier and serial
+// number, so the certificate must have an authority key identifier.
+func CertificateIdentifier(crt *x509.Certificate) (string, error) {
+	if len(crt.AuthorityKeyId) == 0 {
+		return "", fmt.Errorf("certificate has no authority key identifier")
+	}
+
+	if crt.SerialNumber == nil || crt.SerialNumber.Sign() < 0 {
+		return "", fmt.Errorf("certificate has invalid serial number")
+	}
+
+	// The serial number is encoded as the content octets of its DER encoding,
+	// which has a leading zero byte if the high bit would otherwise be set.
+	serial := crt.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(crt.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// Returns true if the server provides renewal information for certificates,
+// in which case LoadRenewalInfo may be used and the Replaces field of new
+// orders may be set.
+func (c *Client) SupportsRenewalInfo(ctx context.Context) (bool, error) {
+	di, err := c.getDirectory(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return di.isRFC8555() && ValidURL(di.RenewalInfo), nil
+}
+
+// Fetches the renewal information for a certificate issued by the server.
+// Returns ErrRenewalInfoNotSupported if the server does not provide renewal
+// information. The RetryAfter field of the result is set from the
+// Retry-After header, or to a default if none was given.
+func (c *Client) LoadRenewalInfo(crt *x509.Certificate, ctx context.Context) (*RenewalInfo, error) {
+	di, err := c.getDirectory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !di.isRFC8555() || !ValidURL(di.RenewalInfo) {
+		return nil, ErrRenewalInfoNotSupported
+	}
+
+	id, err := CertificateIdentifier(crt)
+	if err != nil {
+		return nil, err
+	}
+
+	ri := &RenewalInfo{}
+	res, err := c.doReq("GET", strings.TrimSuffix(di.RenewalInfo, "/")+"/"+id, nil, ri, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &ri.SuggestedWindow
+	if w.Start.IsZero() || !w.End.After(w.Start) {
+		return nil, fmt.Errorf("server returned invalid renewal window: %v to %v", w.Start, w.End)
+	}
+
+	now := defaultClock.Now()
+	ri.RetryAfter = retryAtDefault(res.Header, renewalInfoRetryDefault)
+	if ri.RetryAfter.Sub(now) > renewalInfoRetryMax {
+		ri.RetryAfter = now.Add(renewalInfoRetryMax)
+	}
+
+	return ri, nil
+}
@@ -0,0 +1,109 @@
+package acmeapi
+
+import (
+	"crypto/x509"
+	"github.com/hlandau/goutils/test"
+	"golang.org/x/net/context"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCertificateIdentifier(t *testing.T) {
+	// Example from RFC 9773.
+	crt := &x509.Certificate{
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5b, 0x6b, 0x87, 0x46, 0x40, 0x41, 0xe1, 0xb3,
+			0x7b, 0x84, 0x7b, 0xa0, 0xae, 0x2c, 0xde, 0x01, 0xc8, 0xd4},
+		SerialNumber: big.NewInt(0x87654321),
+	}
+
+	id, err := CertificateIdentifier(crt)
+	if err != nil || id != "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE" {
+		t.Fatalf("unexpected identifier: %q %v", id, err)
+	}
+
+	crt.AuthorityKeyId = nil
+	_, err = CertificateIdentifier(crt)
+	if err == nil {
+		t.Fatalf("identifier unexpectedly formed without authority key identifier")
+	}
+}
+
+func TestLoadRenewalInfo(t *testing.T) {
+	mt := test.HTTPMockTransport{}
+	cl := &Client{
+		HTTPClient: &http.Client{
+			Transport: &mt,
+		},
+		DirectoryURL: "https://ca.test/dir",
+	}
+
+	directory := `{
+    "newNonce": "https://ca.test/nonce",
+    "newAccount": "https://ca.test/account",
+    "newOrder": "https://ca.test/order",
+    "renewalInfo": "https://ca.test/renewal-info"
+  }`
+	mt.AddHandlerFunc("ca.test/dir", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(200)
+		rw.Write([]byte(directory))
+	})
+
+	mt.AddHandlerFunc("ca.test/renewal-info/aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Retry-After", "3600")
+		rw.WriteHeader(200)
+		rw.Write([]byte(`{
+      "suggestedWindow": {
+        "start": "2025-01-02T04:00:00Z",
+        "end": "2025-01-03T04:00:00Z"
+      },
+      "explanationURL": "https://ca.test/docs/ari"
+    }`))
+	})
+
+	crt := &x509.Certificate{
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5b, 0x6b, 0x87, 0x46, 0x40, 0x41, 0xe1, 0xb3,
+			0x7b, 0x84, 0x7b, 0xa0, 0xae, 0x2c, 0xde, 0x01, 0xc8, 0xd4},
+		SerialNumber: big.NewInt(0x87654321),
+	}
+
+	ok, err := cl.SupportsRenewalInfo(context.TODO())
+	if err != nil || !ok {
+		t.Fatalf("renewal info not supported: %v", err)
+	}
+
+	ri, err := cl.LoadRenewalInfo(crt, context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2025, 1, 2, 4, 0, 0, 0, time.UTC)
+	if !ri.SuggestedWindow.Start.Equal(start) || !ri.SuggestedWindow.End.Equal(start.Add(24*time.Hour)) ||
+		ri.ExplanationURL != "https://ca.test/docs/ari" {
+		t.Fatalf("unexpected renewal info: %#v", ri)
+	}
+
+	d := ri.RetryAfter.Sub(time.Now())
+	if d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("unexpected retry time: %v", ri.RetryAfter)
+	}
+
+	// Servers which do not advertise renewal information are not asked.
+	cl = &Client{
+		HTTPClient:   cl.HTTPClient,
+		DirectoryURL: "https://ca.test/dir",
+	}
+	directory = `{
+    "newNonce": "https://ca.test/nonce",
+    "newAccount": "https://ca.test/account",
+    "newOrder": "https://ca.test/order"
+  }`
+
+	_, err = cl.LoadRenewalInfo(crt, context.TODO())
+	if err != ErrRenewalInfoNotSupported {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
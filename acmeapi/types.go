@@ -5,6 +5,7 @@ import (
 	"fmt"
 	denet "github.com/hlandau/goutils/net"
 	"gopkg.in/square/go-jose.v1"
+	"net"
 	"time"
 )
 
@@ -21,6 +22,15 @@ type Registration struct {
 	AuthorizationsURL string `json:"authorizations,omitempty"`
 	CertificatesURL   string `json:"certificates,omitempty"`
 
+	Status Status `json:"status,omitempty"` // "valid", "deactivated" or "revoked"
+
+	// RFC 8555 only.
+	OrdersURL string `json:"orders,omitempty"`
+
+	// RFC 8555 only. External account binding credentials, used when creating
+	// the account. Required by some servers.
+	ExternalAccountBinding *ExternalAccountBinding `json:"-"`
+
 	// This is not actually part of the registration, but it
 	// is provided when loading a registration for convenience
 	// as it is returned in the HTTP headers. It is the URI
@@ -28,6 +38,13 @@ type Registration struct {
 	LatestAgreementURI string `json:"-"`
 }
 
+// External account binding credentials, issued by a CA to tie a new ACME
+// account to an account which exists with the CA outside of ACME.
+type ExternalAccountBinding struct {
+	KeyID   string // The MAC key identifier.
+	HMACKey []byte // The MAC key.
+}
+
 // Represents a Challenge which is part of an Authorization.
 type Challenge struct {
 	URI      string `json:"uri"`      // The URI of the challenge.
@@ -38,12 +55,36 @@ type Challenge struct {
 	Validated time.Time `json:"validated,omitempty"` // RFC 3339
 	Token     string    `json:"token"`
 
+	// The error which caused the challenge to fail, if it is invalid.
+	Error *Problem `json:"error,omitempty"`
+
 	// proofOfPossession
 	Certs []denet.Base64up `json:"certs,omitempty"`
 
 	retryAt time.Time
 }
 
+// Implements encoding/json.Unmarshaler. RFC 8555 calls the challenge URI
+// "url" rather than "uri"; either is accepted.
+func (ch *Challenge) UnmarshalJSON(data []byte) error {
+	type challenge Challenge
+	v := struct {
+		*challenge
+		URL string `json:"url"`
+	}{challenge: (*challenge)(ch)}
+
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+
+	if v.URL != "" {
+		ch.URI = v.URL
+	}
+
+	return nil
+}
+
 // Represents an authorization. You can construct an authorization from only
 // the URI; the authorization information will be fetched automatically.
 type Authorization struct {
@@ -56,9 +97,66 @@ type Authorization struct {
 	Challenges   []*Challenge `json:"challenges,omitempty"`
 	Combinations [][]int      `json:"combinations,omitempty"`
 
+	// RFC 8555 only. Set if the authorization is for a wildcard name; the
+	// identifier value does not include the "*." prefix.
+	Wildcard bool `json:"wildcard,omitempty"`
+
 	retryAt time.Time
 }
 
+// Represents an RFC 8555 order. You can construct an order from only the URI;
+// the order information will be fetched automatically.
+type Order struct {
+	URI string `json:"-"` // The URI of the order.
+
+	Status      Status       `json:"status,omitempty"`
+	Expires     time.Time    `json:"expires,omitempty"` // RFC 3339
+	Identifiers []Identifier `json:"identifiers"`
+	NotBefore   time.Time    `json:"notBefore,omitempty"` // RFC 3339
+	NotAfter    time.Time    `json:"notAfter,omitempty"`  // RFC 3339
+
+	// The URIs of the authorizations which must be completed before the order
+	// can be finalized.
+	AuthorizationURIs []string `json:"authorizations,omitempty"`
+
+	// The URI to which the CSR is submitted.
+	FinalizeURI string `json:"finalize,omitempty"`
+
+	// The URI of the issued certificate, once the order is valid.
+	CertificateURI string `json:"certificate,omitempty"`
+
+	// The error which caused the order to fail, if it is invalid.
+	Error *Problem `json:"error,omitempty"`
+
+	// Optional. When creating an order, the certificate identifier (see
+	// CertificateIdentifier) of the certificate the order replaces. Only
+	// servers supporting renewal information accept this.
+	Replaces string `json:"replaces,omitempty"`
+
+	retryAt time.Time
+}
+
+// Renewal information for a certificate (RFC 9773), describing when the
+// issuer suggests that it be renewed.
+type RenewalInfo struct {
+	// The period during which the certificate should be renewed.
+	SuggestedWindow RenewalWindow `json:"suggestedWindow"`
+
+	// Optional. A page explaining why the window is as it is, e.g. because
+	// the certificate is to be revoked.
+	ExplanationURL string `json:"explanationURL,omitempty"`
+
+	// The time before which the renewal information should not be fetched
+	// again, from the Retry-After header.
+	RetryAfter time.Time `json:"-"`
+}
+
+// A period of time, during which a certificate should be renewed.
+type RenewalWindow struct {
+	Start time.Time `json:"start"` // RFC 3339
+	End   time.Time `json:"end"`   // RFC 3339
+}
+
 // Represents a certificate which has been, or is about to be, issued.
 type Certificate struct {
 	URI      string `json:"-"`        // The URI of the certificate.
@@ -79,26 +177,39 @@ type Certificate struct {
 
 // Represents an identifier for which an authorization is desired.
 type Identifier struct {
-	Type  string `json:"type"`  // must be "dns"
-	Value string `json:"value"` // dns: a hostname.
+	Type  string `json:"type"`  // "dns" or "ip"
+	Value string `json:"value"` // dns: a hostname. ip: an IP address (RFC 8738).
+}
+
+// Returns the identifier for a name, which is either a hostname or an IP
+// address.
+func NewIdentifier(name string) Identifier {
+	if ip := net.ParseIP(name); ip != nil {
+		return Identifier{Type: "ip", Value: ip.String()}
+	}
+
+	return Identifier{Type: "dns", Value: name}
 }
 
-// Represents the status of an authorization or challenge.
+// Represents the status of an account, order, authorization or challenge.
 type Status string
 
 const (
-	StatusUnknown    Status = "unknown"    // Non-final state...
-	StatusPending           = "pending"    // Non-final state.
-	StatusProcessing        = "processing" // Non-final state.
-	StatusValid             = "valid"      // Final state.
-	StatusInvalid           = "invalid"    // Final state.
-	StatusRevoked           = "revoked"    // Final state.
+	StatusUnknown     Status = "unknown"     // Non-final state...
+	StatusPending            = "pending"     // Non-final state.
+	StatusProcessing         = "processing"  // Non-final state.
+	StatusReady              = "ready"       // Non-final state. Orders only.
+	StatusValid              = "valid"       // Final state.
+	StatusInvalid            = "invalid"     // Final state.
+	StatusRevoked            = "revoked"     // Final state.
+	StatusDeactivated        = "deactivated" // Final state.
+	StatusExpired            = "expired"     // Final state.
 )
 
 // Returns true iff the status is a valid status.
 func (s Status) Valid() bool {
 	switch s {
-	case "unknown", "pending", "processing", "valid", "invalid", "revoked":
+	case "unknown", "pending", "processing", "ready", "valid", "invalid", "revoked", "deactivated", "expired":
 		return true
 	default:
 		return false
@@ -108,7 +219,7 @@ func (s Status) Valid() bool {
 // Returns true iff the status is a final status.
 func (s Status) Final() bool {
 	switch s {
-	case "valid", "invalid", "revoked":
+	case "valid", "invalid", "revoked", "deactivated", "expired":
 		return true
 	default:
 		return false
@@ -1,10 +1,14 @@
 package acmeapi
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	denet "github.com/hlandau/goutils/net"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 )
 
 // Error returned when the account agreement URI does not match the currently required
@@ -17,6 +21,136 @@ func (e *AgreementError) Error() string {
 	return fmt.Sprintf("Registration requires agreement with the following agreement: %#v", e.URI)
 }
 
+// Error returned when creating an account with a server which requires
+// external account binding, if no external account binding credentials were
+// provided. An externalAccountRequired problem returned by the server matches
+// ErrExternalAccountRequired instead.
+var ErrNoExternalAccountBinding = errors.New("server requires external account binding credentials")
+
+// An RFC 7807 problem document, used by ACME servers to describe errors.
+type Problem struct {
+	// The problem type URI, e.g. "urn:ietf:params:acme:error:rateLimited".
+	Type string `json:"type,omitempty"`
+
+	// A human-readable description of the problem.
+	Detail string `json:"detail,omitempty"`
+
+	// The HTTP status code, if given.
+	Status int `json:"status,omitempty"`
+
+	// For subproblems, the identifier to which the subproblem relates.
+	Identifier *Identifier `json:"identifier,omitempty"`
+
+	// Problems relating to specific identifiers, if the problem relates to
+	// more than one.
+	Subproblems []*Problem `json:"subproblems,omitempty"`
+}
+
+// An ACME error type, identified by its problem type URI. An error returned
+// by a Client method because the server returned a problem document matches
+// the ProblemType of that problem, and of any of its subproblems, under
+// errors.Is:
+//
+//   if errors.Is(err, acmeapi.ErrCAA) {
+//     ...
+//   }
+//
+// To examine the problem itself, including the identifiers to which any
+// subproblems relate, use errors.As with a *Problem.
+//
+// Servers implementing drafts of the ACME protocol use the "urn:acme:error:"
+// namespace instead of "urn:ietf:params:acme:error:"; their problems match
+// the same values.
+type ProblemType string
+
+func (pt ProblemType) Error() string {
+	return "ACME error: " + string(pt)
+}
+
+// Problem types defined by RFC 8555.
+const (
+	ErrAccountDoesNotExist     ProblemType = "urn:ietf:params:acme:error:accountDoesNotExist"
+	ErrAlreadyRevoked          ProblemType = "urn:ietf:params:acme:error:alreadyRevoked"
+	ErrBadCSR                  ProblemType = "urn:ietf:params:acme:error:badCSR"
+	ErrBadNonce                ProblemType = "urn:ietf:params:acme:error:badNonce"
+	ErrBadPublicKey            ProblemType = "urn:ietf:params:acme:error:badPublicKey"
+	ErrBadRevocationReason     ProblemType = "urn:ietf:params:acme:error:badRevocationReason"
+	ErrBadSignatureAlgorithm   ProblemType = "urn:ietf:params:acme:error:badSignatureAlgorithm"
+	ErrCAA                     ProblemType = "urn:ietf:params:acme:error:caa"
+	ErrCompound                ProblemType = "urn:ietf:params:acme:error:compound"
+	ErrConnection              ProblemType = "urn:ietf:params:acme:error:connection"
+	ErrDNS                     ProblemType = "urn:ietf:params:acme:error:dns"
+	ErrExternalAccountRequired ProblemType = "urn:ietf:params:acme:error:externalAccountRequired"
+	ErrIncorrectResponse       ProblemType = "urn:ietf:params:acme:error:incorrectResponse"
+	ErrInvalidContact          ProblemType = "urn:ietf:params:acme:error:invalidContact"
+	ErrMalformed               ProblemType = "urn:ietf:params:acme:error:malformed"
+	ErrOrderNotReady           ProblemType = "urn:ietf:params:acme:error:orderNotReady"
+	ErrRateLimited             ProblemType = "urn:ietf:params:acme:error:rateLimited"
+	ErrRejectedIdentifier      ProblemType = "urn:ietf:params:acme:error:rejectedIdentifier"
+	ErrServerInternal          ProblemType = "urn:ietf:params:acme:error:serverInternal"
+	ErrTLS                     ProblemType = "urn:ietf:params:acme:error:tls"
+	ErrUnauthorized            ProblemType = "urn:ietf:params:acme:error:unauthorized"
+	ErrUnsupportedContact      ProblemType = "urn:ietf:params:acme:error:unsupportedContact"
+	ErrUnsupportedIdentifier   ProblemType = "urn:ietf:params:acme:error:unsupportedIdentifier"
+	ErrUserActionRequired      ProblemType = "urn:ietf:params:acme:error:userActionRequired"
+
+	// RFC 9773. The certificate named in an order's "replaces" field has
+	// already been replaced.
+	ErrAlreadyReplaced ProblemType = "urn:ietf:params:acme:error:alreadyReplaced"
+)
+
+// Returns the name of a problem type within the ACME error namespace, e.g.
+// "badNonce", or "" if it is not in that namespace.
+func acmeErrorName(problemType string) string {
+	for _, prefix := range []string{"urn:ietf:params:acme:error:", "urn:acme:error:"} {
+		if strings.HasPrefix(problemType, prefix) {
+			return problemType[len(prefix):]
+		}
+	}
+
+	return ""
+}
+
+// Returns true iff the problem or any of its subproblems is of the type given
+// by target, which must be a ProblemType.
+func (p *Problem) Is(target error) bool {
+	pt, ok := target.(ProblemType)
+	if !ok {
+		return false
+	}
+
+	if p.Type == string(pt) || (acmeErrorName(p.Type) != "" && acmeErrorName(p.Type) == acmeErrorName(string(pt))) {
+		return true
+	}
+
+	for _, sp := range p.Subproblems {
+		if sp.Is(pt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Summarises the problem, including any subproblems.
+func (p *Problem) Error() string {
+	var b strings.Builder
+	if p.Identifier != nil {
+		fmt.Fprintf(&b, "%s: ", p.Identifier.Value)
+	}
+
+	b.WriteString(p.Type)
+	if p.Detail != "" {
+		fmt.Fprintf(&b, ": %s", p.Detail)
+	}
+
+	for _, sp := range p.Subproblems {
+		fmt.Fprintf(&b, "; %v", sp.Error())
+	}
+
+	return b.String()
+}
+
 // Error returned when an HTTP request results in a valid response, but which
 // has an unexpected failure status code. Used so that the response can still
 // be examined if desired.
@@ -27,6 +161,10 @@ type HTTPError struct {
 	// If the response had an application/problem+json response body, this is
 	// that JSON data.
 	ProblemBody string
+
+	// The parsed problem document, or nil if there was none or it could not
+	// be parsed.
+	Problem *Problem
 }
 
 // Summarises the response status, headers, and the JSON problem body if
@@ -35,16 +173,85 @@ func (he *HTTPError) Error() string {
 	return fmt.Sprintf("HTTP error: %v\n%v\n%v", he.Res.Status, he.Res.Header, he.ProblemBody)
 }
 
+// Returns the problem, if there is one, so that the error can be examined
+// using errors.Is and errors.As.
+func (he *HTTPError) Unwrap() error {
+	if he.Problem == nil {
+		return nil
+	}
+
+	return he.Problem
+}
+
+// Error returned when the server refuses a request because a rate limit has
+// been exceeded.
+type RateLimitError struct {
+	*HTTPError
+
+	// The time after which the server indicated the request may be retried,
+	// taken from the Retry-After header. Zero if the server did not say.
+	RetryAfter time.Time
+}
+
+func (rle *RateLimitError) Error() string {
+	msg := "rate limited by server"
+	if rle.Problem != nil && rle.Problem.Detail != "" {
+		msg += ": " + rle.Problem.Detail
+	}
+
+	if !rle.RetryAfter.IsZero() {
+		msg += fmt.Sprintf(" (retry after %v)", rle.RetryAfter)
+	}
+
+	return msg
+}
+
+// Returns the underlying HTTPError.
+func (rle *RateLimitError) Unwrap() error {
+	return rle.HTTPError
+}
+
 func newHTTPError(res *http.Response) error {
 	he := &HTTPError{
 		Res: res,
 	}
-	if res.Header.Get("Content-Type") == "application/problem+json" {
+	if contentType(res) == "application/problem+json" {
 		defer res.Body.Close()
 		b, err := ioutil.ReadAll(denet.LimitReader(res.Body, 1*1024*1024))
 		if err == nil {
 			he.ProblemBody = string(b)
+
+			p := &Problem{}
+			if json.Unmarshal(b, p) == nil {
+				he.Problem = p
+			}
 		}
 	}
+
+	if he.Problem != nil && he.Problem.Is(ErrRateLimited) {
+		rle := &RateLimitError{HTTPError: he}
+		rle.RetryAfter, _ = parseRetryAfter(res.Header)
+		return rle
+	}
+
 	return he
 }
+
+// Maximum number of times a request is retried if the server rejects its
+// nonce.
+const maxBadNonceRetries = 3
+
+// Makes a request by calling f, calling it again if the server rejects the
+// nonce used. Servers may reject nonces which are perfectly valid, for example
+// if they have been restarted, so RFC 8555 requires clients to retry with the
+// fresh nonce provided in the error response.
+func retryBadNonce(f func() (*http.Response, error)) (*http.Response, error) {
+	for i := 0; ; i++ {
+		res, err := f()
+		if i >= maxBadNonceRetries || !errors.Is(err, ErrBadNonce) {
+			return res, err
+		}
+
+		log.Debugf("server rejected nonce, retrying with a fresh nonce")
+	}
+}
@@ -0,0 +1,209 @@
+package acmeapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/hlandau/goutils/test"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func problemResponse(status int, retryAfter, body string) *http.Response {
+	res := &http.Response{
+		Status:     http.StatusText(status),
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+
+	res.Header.Set("Content-Type", "application/problem+json")
+	if retryAfter != "" {
+		res.Header.Set("Retry-After", retryAfter)
+	}
+
+	return res
+}
+
+func TestProblem(t *testing.T) {
+	err := newHTTPError(problemResponse(403, "", `{
+		"type": "urn:ietf:params:acme:error:rejectedIdentifier",
+		"detail": "Some identifiers were rejected",
+		"status": 403,
+		"subproblems": [
+			{
+				"type": "urn:ietf:params:acme:error:caa",
+				"detail": "CAA record forbids issuance",
+				"identifier": {"type": "dns", "value": "example.com"}
+			}
+		]
+	}`))
+
+	var he *HTTPError
+	if !errors.As(err, &he) || he.Problem == nil {
+		t.Fatalf("expected problem, got %#v", err)
+	}
+
+	p := he.Problem
+	if p.Type != "urn:ietf:params:acme:error:rejectedIdentifier" || p.Status != 403 || len(p.Subproblems) != 1 {
+		t.Fatalf("unexpected problem: %#v", p)
+	}
+
+	sp := p.Subproblems[0]
+	if sp.Type != "urn:ietf:params:acme:error:caa" || sp.Identifier == nil || sp.Identifier.Value != "example.com" {
+		t.Fatalf("unexpected subproblem: %#v", sp)
+	}
+
+	const expected = "urn:ietf:params:acme:error:rejectedIdentifier: Some identifiers were rejected; example.com: urn:ietf:params:acme:error:caa: CAA record forbids issuance"
+	if s := p.Error(); s != expected {
+		t.Fatalf("unexpected summary: %q", s)
+	}
+
+	// The error matches both the problem and subproblem types.
+	for _, pt := range []ProblemType{ErrRejectedIdentifier, ErrCAA} {
+		if !errors.Is(err, pt) {
+			t.Fatalf("error does not match %v", pt)
+		}
+	}
+
+	if errors.Is(err, ErrDNS) {
+		t.Fatalf("error unexpectedly matches %v", ErrDNS)
+	}
+
+	var ep *Problem
+	if !errors.As(err, &ep) || ep != p {
+		t.Fatalf("could not obtain problem from error")
+	}
+}
+
+func TestProblemIs(t *testing.T) {
+	tests := []struct {
+		Type   string
+		Target error
+		Is     bool
+	}{
+		{"urn:ietf:params:acme:error:badNonce", ErrBadNonce, true},
+		{"urn:acme:error:badNonce", ErrBadNonce, true},
+		{"urn:acme:error:badNonce", ErrMalformed, false},
+		{"urn:ietf:params:acme:error:externalAccountRequired", ErrExternalAccountRequired, true},
+		{"urn:ietf:params:acme:error:externalAccountRequired", ErrNoExternalAccountBinding, false},
+		{"about:blank", ErrMalformed, false},
+		{"urn:ietf:params:acme:error:malformed", errors.New("urn:ietf:params:acme:error:malformed"), false},
+	}
+
+	for _, tst := range tests {
+		p := &Problem{Type: tst.Type}
+		if errors.Is(p, tst.Target) != tst.Is {
+			t.Errorf("%q: expected Is(%v) to be %v", tst.Type, tst.Target, tst.Is)
+		}
+	}
+}
+
+func TestRateLimitError(t *testing.T) {
+	withClock(clk, func() {
+		err := newHTTPError(problemResponse(429, "120", `{
+			"type": "urn:ietf:params:acme:error:rateLimited",
+			"detail": "too many certificates already issued"
+		}`))
+
+		rle, ok := err.(*RateLimitError)
+		if !ok {
+			t.Fatalf("expected rate limit error, got %#v", err)
+		}
+
+		if !rle.RetryAfter.Equal(clk.Now().Add(120 * time.Second)) {
+			t.Fatalf("unexpected retry after time: %v", rle.RetryAfter)
+		}
+
+		if !errors.Is(err, ErrRateLimited) {
+			t.Fatalf("rate limit error does not match ErrRateLimited")
+		}
+	})
+
+	// Non-problem responses are not parsed.
+	res := problemResponse(500, "", "oops")
+	res.Header.Set("Content-Type", "text/plain")
+	err := newHTTPError(res)
+	if he, ok := err.(*HTTPError); !ok || he.Problem != nil {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+func TestBadNonceRetry(t *testing.T) {
+	mt := test.HTTPMockTransport{}
+	epk, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	cl := &Client{
+		HTTPClient: &http.Client{
+			Transport: &mt,
+		},
+		AccountKey:   epk,
+		DirectoryURL: "https://ca.test/dir",
+	}
+
+	nonceCount := 0
+	nextNonce := func() string {
+		nonceCount++
+		return fmt.Sprintf("nonce-%d", nonceCount)
+	}
+
+	mt.AddHandlerFunc("ca.test/dir", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(200)
+		rw.Write([]byte(`{
+      "newNonce": "https://ca.test/nonce",
+      "newAccount": "https://ca.test/account",
+      "newOrder": "https://ca.test/order"
+    }`))
+	})
+
+	mt.AddHandlerFunc("ca.test/nonce", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Replay-Nonce", nextNonce())
+		rw.WriteHeader(200)
+	})
+
+	// Rejects every nonce until rejections reaches zero.
+	rejections := 0
+	requests := 0
+	mt.AddHandlerFunc("ca.test/thing", func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.Header().Set("Replay-Nonce", nextNonce())
+		if rejections > 0 {
+			rejections--
+			rw.Header().Set("Content-Type", "application/problem+json")
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"type":"urn:ietf:params:acme:error:badNonce"}`))
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(200)
+		rw.Write([]byte(`{}`))
+	})
+
+	_, err := cl.SupportsOrders(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out struct{}
+	rejections = 2
+	_, err = cl.doReqRFC("https://ca.test/thing", nil, true, struct{}{}, &out, context.TODO())
+	if err != nil || requests != 3 {
+		t.Fatalf("request failed after %d attempts: %v", requests, err)
+	}
+
+	// Retries are limited.
+	requests = 0
+	rejections = 100
+	_, err = cl.doReqRFC("https://ca.test/thing", nil, true, struct{}{}, &out, context.TODO())
+	if !errors.Is(err, ErrBadNonce) || requests != maxBadNonceRetries+1 {
+		t.Fatalf("unexpected result after %d attempts: %v", requests, err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/hlandau/acme/acmeapi/acmeendpoints"
+	"github.com/hlandau/acme/acmeapi/acmeutils"
+	"github.com/hlandau/acme/interaction"
+	"github.com/hlandau/acme/storage"
+	"github.com/hlandau/acme/storageops"
+)
+
+// Finds the account with the given ID, or if accountID is empty, the account
+// for the default provider.
+func selectAccount(s storage.Store, accountID string) (*storage.Account, error) {
+	if accountID != "" {
+		a := s.AccountByID(accountID)
+		if a == nil {
+			return nil, fmt.Errorf("account not found: %q", accountID)
+		}
+
+		return a, nil
+	}
+
+	directoryURL := s.DefaultTarget().Request.Provider
+	if directoryURL == "" {
+		directoryURL = acmeendpoints.DefaultEndpoint.DirectoryURL
+	}
+
+	a := s.AccountByDirectoryURL(directoryURL)
+	if a == nil {
+		return nil, fmt.Errorf("no account for default provider %q", directoryURL)
+	}
+
+	return a, nil
+}
+
+// Locks the store for the duration of an account command, and reloads it, as
+// another process holding the lock may have changed it. This prevents a
+// concurrent reconcile from saving an account which was changed while it ran,
+// undoing the change.
+func lockStore(s storage.Store) {
+	err := s.Lock(*waitFlag)
+	log.Fatale(err, "lock")
+
+	err = s.Reload()
+	if err != nil {
+		s.Unlock()
+		log.Fatale(err, "reload")
+	}
+}
+
+func cmdAccountRollover() {
+	s, err := openStore()
+	log.Fatale(err, "storage")
+
+	// Hold the lock so that other processes do not mistake the rollover for
+	// one which was interrupted.
+	lockStore(s)
+	defer s.Unlock()
+
+	a, err := selectAccount(s, *accountRolloverIDFlag)
+	log.Fatale(err, "account")
+
+	var pk interface{}
+	if *accountRolloverKeyFlag != "" {
+		b, err := ioutil.ReadFile(*accountRolloverKeyFlag)
+		log.Fatale(err, "cannot read file")
+
+		pk, err = acmeutils.LoadPrivateKey(b)
+		log.Fatale(err, "cannot parse private key")
+	}
+
+	na, err := storageops.RolloverAccount(s, a, pk)
+	log.Fatale(err, "rollover")
+
+	fmt.Printf("%s\n", na.ID())
+}
+
+func cmdAccountUpdate() {
+	s, err := openStore()
+	log.Fatale(err, "storage")
+
+	lockStore(s)
+	defer s.Unlock()
+
+	a, err := selectAccount(s, *accountUpdateIDFlag)
+	log.Fatale(err, "account")
+
+	var contactURIs []string
+	for _, c := range *accountUpdateContactFlag {
+		u, err := url.Parse(c)
+		if err != nil || u.Scheme == "" {
+			log.Fatalf("invalid contact URI, must be e.g. mailto:hostmaster@example.com: %q", c)
+		}
+
+		contactURIs = append(contactURIs, c)
+	}
+
+	err = storageops.UpdateAccountContact(s, a, contactURIs)
+	log.Fatale(err, "update account")
+}
+
+func cmdAccountDeactivate() {
+	s, err := openStore()
+	log.Fatale(err, "storage")
+
+	lockStore(s)
+	defer s.Unlock()
+
+	a, err := selectAccount(s, *accountDeactivateIDFlag)
+	log.Fatale(err, "account")
+
+	body := fmt.Sprintf("Deactivating %v is permanent. The provider will refuse any further requests made using it. A new account will be created the next time one is needed.\n\nDo you want to deactivate the account?", a)
+	if *accountDeactivateLocalFlag {
+		body = fmt.Sprintf("%v will never be used again, but the provider will not be told. A new account will be created the next time one is needed.\n\nDo you want to stop using the account?", a)
+	}
+
+	r, err := interaction.Auto.Prompt(&interaction.Challenge{
+		Title:        "Deactivate account?",
+		Body:         body,
+		YesLabel:     "Deactivate",
+		NoLabel:      "Cancel",
+		ResponseType: interaction.RTYesNo,
+		UniqueID:     "acmetool-account-deactivate",
+	})
+	log.Fatale(err, "interaction")
+
+	if r.Cancelled {
+		return
+	}
+
+	if *accountDeactivateLocalFlag {
+		err = storageops.RetireAccount(s, a)
+	} else {
+		err = storageops.DeactivateAccount(s, a)
+	}
+	log.Fatale(err, "deactivate account")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hlandau/acme/storage"
+)
+
+func cmdFsck() {
+	problems, err := storage.CheckFDB(storage.FDBConfig{
+		Path:      *stateFlag,
+		MasterKey: masterKey,
+	}, *fsckRepairFlag)
+
+	remaining := 0
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", p.Path, p.Description)
+		switch {
+		case p.Repaired:
+			fmt.Printf("  repaired: %s\n", p.Repair)
+			continue
+		case p.Repair != "" && *fsckRepairFlag:
+			fmt.Printf("  failed to repair: %s\n", p.Repair)
+		case p.Repair != "":
+			fmt.Printf("  can be repaired with --repair: %s\n", p.Repair)
+		default:
+			fmt.Printf("  cannot be repaired automatically\n")
+		}
+
+		remaining++
+	}
+
+	log.Fatale(err, "fsck")
+
+	if len(problems) == 0 {
+		fmt.Println("No problems found.")
+	}
+
+	if remaining > 0 {
+		os.Exit(1)
+	}
+}
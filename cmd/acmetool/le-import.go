@@ -17,7 +17,7 @@ import (
 )
 
 func cmdImportLE() {
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
 	lePath := *importLEArg
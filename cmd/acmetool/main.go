@@ -3,11 +3,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/hlandau/acme/acmeapi"
 	"github.com/hlandau/acme/acmeapi/acmeutils"
@@ -48,7 +51,24 @@ var (
 
 	responseFileFlag = kingpin.Flag("response-file", "Read dialog responses from the given file (default: $ACME_STATE_DIR/conf/responses)").ExistingFile()
 
-	reconcileCmd = kingpin.Command("reconcile", reconcileHelp).Default()
+	waitFlag = kingpin.Flag("wait", "If another acmetool process is reconciling the state directory, wait for it to finish rather than failing").Bool()
+
+	jobsFlag = kingpin.Flag("jobs", "Maximum number of targets to request certificates for at once").Default("1").Int()
+
+	forceFlag = kingpin.Flag("force", "Request certificates for targets even if recent attempts failed, rather than waiting before trying again").Bool()
+
+	masterKeyFileFlag = kingpin.Flag("master-key-file", "Encrypt private keys in the state directory using the master key in this file (env: ACME_MASTER_KEY_FILE; or set ACME_MASTER_KEY to a passphrase)").
+				Envar("ACME_MASTER_KEY_FILE").
+				String()
+
+	storageFlag = kingpin.Flag("storage", "Where to keep state: \"dir\" for the state directory, or \"db\" for a database file within it (env: ACME_STORAGE)").
+			Default("dir").
+			Envar("ACME_STORAGE").
+			Enum("dir", "db")
+
+	reconcileCmd      = kingpin.Command("reconcile", reconcileHelp).Default()
+	reconcilePlanFlag = reconcileCmd.Flag("plan", "Show what would be done without changing anything").Bool()
+	reconcileJSONFlag = reconcileCmd.Flag("json", "With --plan, print the plan as JSON").Bool()
 
 	cullCmd          = kingpin.Command("cull", "Delete expired, unused certificates")
 	cullSimulateFlag = cullCmd.Flag("simulate", "Show which certificates would be deleted without deleting any").Short('n').Bool()
@@ -98,6 +118,31 @@ var (
 	revokeArg = revokeCmd.Arg("certificate-id-or-path", "Certificate ID to revoke").String()
 
 	accountThumbprintCmd = kingpin.Command("account-thumbprint", "Prints account thumbprints")
+
+	accountCmd = kingpin.Command("account", "Manage accounts")
+
+	materializeCmd = kingpin.Command("materialize", "Write the preferred certificates in the database to the state directory, for use by daemons (with --storage=db)")
+
+	migrateCmd   = kingpin.Command("migrate", "Copy state between the state directory and the database")
+	migrateToArg = migrateCmd.Arg("to", "Where to copy state to: \"db\" or \"dir\"").Required().Enum("db", "dir")
+
+	upgradeStateCmd        = kingpin.Command("upgrade-state", "Upgrade the state directory to the layout used by this version, backing up changed files under \"backup\" (this is also done automatically)")
+	upgradeStateDryRunFlag = upgradeStateCmd.Flag("dry-run", "Show what would be changed without changing anything").Bool()
+
+	fsckCmd        = kingpin.Command("fsck", "Check the state directory for inconsistencies")
+	fsckRepairFlag = fsckCmd.Flag("repair", "Repair the inconsistencies which can be repaired safely").Bool()
+
+	accountRolloverCmd     = accountCmd.Command("rollover", "Change the private key of an account")
+	accountRolloverIDFlag  = accountRolloverCmd.Flag("account", "Account ID (default: the account for the default provider)").String()
+	accountRolloverKeyFlag = accountRolloverCmd.Flag("key-file", "Path to PEM-encoded private key to use as the new account key (default: generate one)").ExistingFile()
+
+	accountUpdateCmd         = accountCmd.Command("update", "Update the contact details registered for an account")
+	accountUpdateIDFlag      = accountUpdateCmd.Flag("account", "Account ID (default: the account for the default provider)").String()
+	accountUpdateContactFlag = accountUpdateCmd.Flag("contact", "Contact URI, e.g. mailto:hostmaster@example.com (may be specified multiple times)").Required().Strings()
+
+	accountDeactivateCmd       = accountCmd.Command("deactivate", "Permanently deactivate an account")
+	accountDeactivateIDFlag    = accountDeactivateCmd.Flag("account", "Account ID (default: the account for the default provider)").String()
+	accountDeactivateLocalFlag = accountDeactivateCmd.Flag("local", "Only stop using the account, without contacting the provider (e.g. if the provider has shut down)").Bool()
 )
 
 const reconcileHelp = `Reconcile ACME state, idempotently requesting and renewing certificates to satisfy configured targets.
@@ -140,9 +185,16 @@ func main() {
 		log.Errore(err, "cannot load response file, continuing anyway")
 	}
 
+	masterKey, err = loadMasterKey()
+	log.Fatale(err, "master key")
+
 	switch cmd {
 	case "reconcile":
-		cmdReconcile()
+		if *reconcilePlanFlag {
+			cmdReconcilePlan()
+		} else {
+			cmdReconcile()
+		}
 	case "cull":
 		cmdCull()
 	case "status":
@@ -173,11 +225,25 @@ func main() {
 		cmdReconcile()
 	case "revoke":
 		cmdRevoke()
+	case "account rollover":
+		cmdAccountRollover()
+	case "account update":
+		cmdAccountUpdate()
+	case "account deactivate":
+		cmdAccountDeactivate()
+	case "materialize":
+		cmdMaterialize()
+	case "migrate":
+		cmdMigrate()
+	case "upgrade-state":
+		cmdUpgradeState()
+	case "fsck":
+		cmdFsck()
 	}
 }
 
 func cmdImportJWKAccount() {
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
 	f, err := os.Open(*importJWKPathArg)
@@ -196,7 +262,7 @@ func cmdImportJWKAccount() {
 }
 
 func cmdImportPEMAccount() {
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
 	f, err := os.Open(*importPEMPathArg)
@@ -214,23 +280,171 @@ func cmdImportPEMAccount() {
 }
 
 func cmdImportKey() {
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
 	err = importKey(s, *importKeyArg)
 	log.Fatale(err, "import key")
 }
 
+// The master key used to encrypt private keys, if any.
+var masterKey []byte
+
+// Loads the master key from the file specified, or from the ACME_MASTER_KEY
+// environment variable. The variable is then removed from the environment so
+// that it is not passed to hooks.
+func loadMasterKey() ([]byte, error) {
+	passphrase := os.Getenv("ACME_MASTER_KEY")
+	os.Unsetenv("ACME_MASTER_KEY")
+
+	if *masterKeyFileFlag != "" {
+		b, err := ioutil.ReadFile(*masterKeyFileFlag)
+		if err != nil {
+			return nil, err
+		}
+
+		b = bytes.TrimSpace(b)
+		if len(b) == 0 {
+			return nil, fmt.Errorf("master key file is empty: %s", *masterKeyFileFlag)
+		}
+
+		return b, nil
+	}
+
+	if passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	return nil, nil
+}
+
+// Opens the state directory, or the database within it.
+func openStore() (storage.Store, error) {
+	return openStoreOfKind(*storageFlag, false)
+}
+
+// Opens the state directory, or the database within it, without changing it.
+func openStoreReadOnly() (storage.Store, error) {
+	return openStoreOfKind(*storageFlag, true)
+}
+
+func openStoreOfKind(kind string, readOnly bool) (storage.Store, error) {
+	if kind == "db" {
+		return storage.NewBoltWithConfig(storage.BoltConfig{
+			Path:      *stateFlag,
+			MasterKey: masterKey,
+			Wait:      *waitFlag,
+			ReadOnly:  readOnly,
+		})
+	}
+
+	return storage.NewFDBWithConfig(storage.FDBConfig{
+		Path:      *stateFlag,
+		MasterKey: masterKey,
+		ReadOnly:  readOnly,
+	})
+}
+
+func reconcileConfig() storageops.ReconcileConfig {
+	return storageops.ReconcileConfig{
+		WaitForLock: *waitFlag,
+		Parallelism: *jobsFlag,
+		Force:       *forceFlag,
+	}
+}
+
 func cmdReconcile() {
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
-	err = storageops.Reconcile(s)
+	err = storageops.Reconcile(s, reconcileConfig())
 	log.Fatale(err, "reconcile")
 }
 
+func cmdReconcilePlan() {
+	s, err := openStoreReadOnly()
+	log.Fatale(err, "storage")
+
+	p, err := storageops.PlanReconcile(s, reconcileConfig())
+	log.Fatale(err, "plan")
+
+	if *reconcileJSONFlag {
+		b, err := json.MarshalIndent(p, "", "  ")
+		log.Fatale(err, "plan")
+		fmt.Printf("%s\n", b)
+		return
+	}
+
+	fmt.Print(planString(p))
+}
+
+func planString(p *storageops.Plan) string {
+	if p.Empty() {
+		return "Nothing to do.\n"
+	}
+
+	var buf bytes.Buffer
+	if len(p.Downloads) > 0 {
+		fmt.Fprintf(&buf, "Certificates to download:\n")
+		for _, id := range p.Downloads {
+			fmt.Fprintf(&buf, "  %s\n", id)
+		}
+	}
+
+	if len(p.Revocations) > 0 {
+		fmt.Fprintf(&buf, "Certificates to revoke:\n")
+		for _, id := range p.Revocations {
+			fmt.Fprintf(&buf, "  %s\n", id)
+		}
+	}
+
+	if len(p.NewAccounts) > 0 {
+		fmt.Fprintf(&buf, "Accounts to create:\n")
+		for _, u := range p.NewAccounts {
+			fmt.Fprintf(&buf, "  %s\n", u)
+		}
+	}
+
+	for _, tp := range p.Targets {
+		fmt.Fprintf(&buf, "Target %s:\n", tp.Target)
+		switch {
+		case tp.Certificate != "" && tp.RenewAt != nil:
+			fmt.Fprintf(&buf, "  renew %s (due %v)\n", tp.Certificate, tp.RenewAt.Local().Format(time.RFC3339))
+		case tp.Certificate != "":
+			fmt.Fprintf(&buf, "  renew %s\n", tp.Certificate)
+		default:
+			fmt.Fprintf(&buf, "  no certificate satisfies the target\n")
+		}
+
+		if tp.Skip != "" {
+			fmt.Fprintf(&buf, "  skipped: %s\n", tp.Skip)
+			continue
+		}
+
+		fmt.Fprintf(&buf, "  request certificate for: %s\n", strings.Join(tp.Names, ", "))
+		fmt.Fprintf(&buf, "  provider: %s\n", tp.Provider)
+		if len(tp.Authorizations) > 0 {
+			fmt.Fprintf(&buf, "  authorizations needed: %s\n", strings.Join(tp.Authorizations, ", "))
+		}
+	}
+
+	if len(p.Links) > 0 {
+		fmt.Fprintf(&buf, "Changes to live (given existing certificates):\n")
+		for _, lp := range p.Links {
+			prev := "(none)"
+			if lp.PreviousCertificate != "" {
+				prev = lp.PreviousCertificate
+			}
+
+			fmt.Fprintf(&buf, "  %s: %s -> %s\n", lp.Hostname, prev, lp.Certificate)
+		}
+	}
+
+	return buf.String()
+}
+
 func cmdCull() {
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
 	err = storageops.Cull(s, *cullSimulateFlag)
@@ -238,7 +452,7 @@ func cmdCull() {
 }
 
 func cmdStatus() {
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
 	info := StatusString(s)
@@ -262,6 +476,9 @@ func StatusString(s storage.Store) string {
 	fmt.Fprintf(&buf, "\nAvailable accounts:\n")
 	s.VisitAccounts(func(a *storage.Account) error {
 		fmt.Fprintf(&buf, "  %v\n", a)
+		if a.Retired {
+			fmt.Fprintf(&buf, "    retired\n")
+		}
 		thumbprint, _ := acmeutils.Base64Thumbprint(a.PrivateKey)
 		fmt.Fprintf(&buf, "    thumbprint: %s\n", thumbprint)
 		return nil
@@ -271,6 +488,17 @@ func StatusString(s storage.Store) string {
 	s.VisitTargets(func(t *storage.Target) error {
 		fmt.Fprintf(&buf, "%v\n", t)
 
+		if tf := s.TargetFailure(t.Filename); tf != nil {
+			fmt.Fprintf(&buf, "  failed attempts: %d\n", tf.Count)
+			for _, fa := range tf.History {
+				fmt.Fprintf(&buf, "    %v: %s\n", fa.Time.Local().Format(time.RFC3339), fa.Error)
+			}
+
+			if tf.InBackoff(storageops.InternalClock) {
+				fmt.Fprintf(&buf, "  next attempt: %v (use --force to try now)\n", tf.NextAttempt.Local().Format(time.RFC3339))
+			}
+		}
+
 		c, err := storageops.FindBestCertificateSatisfying(s, t)
 		if err != nil {
 			fmt.Fprintf(&buf, "  error: %v\n", err)
@@ -278,11 +506,22 @@ func StatusString(s storage.Store) string {
 		}
 
 		renewStr := ""
-		if storageops.CertificateNeedsRenewing(c) {
+		if storageops.CertificateNeedsRenewingForTarget(c, t) {
 			renewStr = " needs-renewing"
 		}
 
 		fmt.Fprintf(&buf, "  best: %v%s\n", c, renewStr)
+		if renewTime, err := storageops.CertificateRenewalTime(c, t); err == nil {
+			fmt.Fprintf(&buf, "    renew at: %v\n", renewTime.Local().Format(time.RFC3339))
+		}
+
+		if ri := c.RenewalInfo; ri != nil {
+			fmt.Fprintf(&buf, "    renewal window: %v to %v\n", ri.WindowStart.Local().Format(time.RFC3339), ri.WindowEnd.Local().Format(time.RFC3339))
+			if ri.ExplanationURL != "" {
+				fmt.Fprintf(&buf, "    explanation: %s\n", ri.ExplanationURL)
+			}
+		}
+
 		return nil
 	})
 
@@ -294,7 +533,7 @@ func StatusString(s storage.Store) string {
 }
 
 func cmdAccountThumbprint() {
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
 	s.VisitAccounts(func(a *storage.Account) error {
@@ -319,7 +558,7 @@ func cmdWant() {
 
 	// Determine whether there already exists a target satisfying all given
 	// hostnames or a superset thereof.
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
 	alreadyExists := false
@@ -355,7 +594,7 @@ func cmdWant() {
 }
 
 func cmdUnwant() {
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
 	for _, hn := range *unwantArg {
@@ -387,7 +626,7 @@ func cmdRunRedirector() {
 }
 
 func determineWebroot() string {
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
 	webrootPaths := s.DefaultTarget().Request.Challenge.WebrootPaths
@@ -482,12 +721,12 @@ func cmdRevoke() {
 }
 
 func revokeByCertificateID(certID string) {
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
 	err = storageops.RevokeByCertificateOrKeyID(s, certID)
 	log.Fatale(err, "revoke")
 
-	err = storageops.Reconcile(s)
+	err = storageops.Reconcile(s, reconcileConfig())
 	log.Fatale(err, "reconcile")
 }
@@ -59,6 +59,7 @@ func TestCLI(t *testing.T) {
 	*hooksFlag = filepath.Join(tmpDir, "hooks")
 
 	responder.InternalTLSSNIPort = 5001
+	responder.InternalTLSALPNPort = 5001
 	cmdQuickstart()
 
 	*wantArg = []string{"dom1.acmetool-test.devever.net", "dom2.acmetool-test.devever.net"}
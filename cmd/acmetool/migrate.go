@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hlandau/acme/hooks"
+	"github.com/hlandau/acme/storage"
+)
+
+func cmdMaterialize() {
+	if *storageFlag != "db" {
+		log.Fatal("materialize is only needed with --storage=db; the state directory is already usable by daemons")
+	}
+
+	s, err := openStore()
+	log.Fatale(err, "storage")
+	defer s.Close()
+
+	updated, err := storage.Materialize(s, storage.FDBConfig{
+		Path:      *stateFlag,
+		MasterKey: masterKey,
+	})
+	log.Fatale(err, "materialize")
+
+	ctx := &hooks.Context{
+		HooksDir: *hooksFlag,
+		StateDir: *stateFlag,
+	}
+	err = hooks.NotifyLiveUpdated(ctx, updated)
+	log.Errore(err, "notify")
+}
+
+func cmdMigrate() {
+	from := "dir"
+	if *migrateToArg == "dir" {
+		from = "db"
+	}
+
+	src, err := openStoreOfKind(from, false)
+	log.Fatale(err, "storage")
+	defer src.Close()
+
+	dst, err := openStoreOfKind(*migrateToArg, false)
+	log.Fatale(err, "storage")
+	defer dst.Close()
+
+	for _, s := range []storage.Store{src, dst} {
+		err = s.Lock(*waitFlag)
+		log.Fatale(err, "lock")
+		defer s.Unlock()
+	}
+
+	err = storage.Copy(dst, src)
+	log.Fatale(err, "migrate")
+
+	fmt.Printf("Copied state to %s. Pass --storage=%s (or set ACME_STORAGE=%s) from now on.\n",
+		*migrateToArg, *migrateToArg, *migrateToArg)
+}
+
+func cmdUpgradeState() {
+	changes, err := storage.PlanFDBMigration(*stateFlag)
+	log.Fatale(err, "upgrade-state")
+
+	if len(changes) == 0 {
+		fmt.Println("The state directory is up to date.")
+		return
+	}
+
+	if *upgradeStateDryRunFlag {
+		fmt.Println("Would make the following changes:")
+	} else {
+		// Opening the state directory upgrades it.
+		s, err := storage.NewFDBWithConfig(storage.FDBConfig{
+			Path:      *stateFlag,
+			MasterKey: masterKey,
+		})
+		log.Fatale(err, "upgrade-state")
+		s.Close()
+
+		fmt.Println("Made the following changes:")
+	}
+
+	for _, change := range changes {
+		fmt.Printf("  %s\n", change)
+	}
+}
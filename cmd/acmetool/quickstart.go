@@ -10,6 +10,7 @@ import (
 	"github.com/hlandau/acme/interaction"
 	"github.com/hlandau/acme/storage"
 	"github.com/hlandau/acme/storageops"
+	"golang.org/x/net/context"
 	"gopkg.in/hlandau/svcutils.v1/exepath"
 	"gopkg.in/hlandau/svcutils.v1/passwd"
 	"io/ioutil"
@@ -21,7 +22,7 @@ import (
 )
 
 func cmdQuickstart() {
-	s, err := storage.NewFDB(*stateFlag)
+	s, err := openStore()
 	log.Fatale(err, "storage")
 
 	serverURL := promptServerURL()
@@ -29,6 +30,17 @@ func cmdQuickstart() {
 	err = s.SaveTarget(s.DefaultTarget())
 	log.Fatale(err, "set provider URL")
 
+	// external account binding
+	eab := promptExternalAccountBinding(serverURL)
+	if eab != nil {
+		if s.DefaultTarget().Request.ExternalAccountBindings == nil {
+			s.DefaultTarget().Request.ExternalAccountBindings = map[string]*storage.ExternalAccountBinding{}
+		}
+		s.DefaultTarget().Request.ExternalAccountBindings[serverURL] = eab
+		err = s.SaveTarget(s.DefaultTarget())
+		log.Fatale(err, "set external account binding")
+	}
+
 	// key type
 	keyType := promptKeyType()
 	switch keyType {
@@ -714,6 +726,69 @@ HOOK: Programmatic challenge provisioning. Advanced users only. Please see docum
 	return r.Value
 }
 
+func promptExternalAccountBinding(serverURL string) *storage.ExternalAccountBinding {
+	cl := &acmeapi.Client{
+		DirectoryURL: serverURL,
+	}
+
+	required, err := cl.ExternalAccountRequired(context.TODO())
+	log.Fatale(err, "could not retrieve ACME server directory")
+	if !required {
+		return nil
+	}
+
+	for {
+		r, err := interaction.Auto.Prompt(&interaction.Challenge{
+			Title:        "External Account Binding Key ID",
+			Body:         `This ACME server requires accounts to be bound to an existing account with the CA. Please enter the "Key ID" (or "EAB KID") issued to you by the CA for this purpose.`,
+			ResponseType: interaction.RTLineString,
+			UniqueID:     "acmetool-quickstart-eab-key-id",
+		})
+		log.Fatale(err, "interaction")
+
+		if r.Cancelled {
+			os.Exit(1)
+			return nil
+		}
+
+		eab := &storage.ExternalAccountBinding{
+			KeyID: strings.TrimSpace(r.Value),
+		}
+
+		r, err = interaction.Auto.Prompt(&interaction.Challenge{
+			Title:        "External Account Binding HMAC Key",
+			Body:         `Please enter the "HMAC Key" (or "EAB HMAC Key") issued to you by the CA along with the Key ID.`,
+			ResponseType: interaction.RTLineString,
+			UniqueID:     "acmetool-quickstart-eab-hmac-key",
+		})
+		log.Fatale(err, "interaction")
+
+		if r.Cancelled {
+			os.Exit(1)
+			return nil
+		}
+
+		eab.HMACKey = strings.TrimSpace(r.Value)
+		err = eab.Validate()
+		if err == nil {
+			return eab
+		}
+
+		r, err = interaction.Auto.Prompt(&interaction.Challenge{
+			Title:        "Invalid External Account Binding",
+			Body:         fmt.Sprintf("The external account binding credentials were not valid: %v", err),
+			ResponseType: interaction.RTAcknowledge,
+			UniqueID:     "acmetool-quickstart-invalid-eab",
+		})
+		log.Fatale(err, "interaction")
+
+		if r.Cancelled || r.Noninteractive {
+			os.Exit(1)
+			return nil
+		}
+	}
+}
+
 func promptServerURL() string {
 	var options []interaction.Option
 	acmeendpoints.Visit(func(e *acmeendpoints.Endpoint) error {
@@ -21,6 +21,7 @@ type DB struct {
 	path                 string
 	extantDirs           map[string]struct{}
 	effectivePermissions []Permission
+	lockFile             *os.File // Non-nil while locked.
 }
 
 // FDB configuration.
@@ -28,6 +29,11 @@ type Config struct {
 	Path            string
 	Permissions     []Permission
 	PermissionsPath string // If not "", allow permissions to be overriden from this file.
+
+	// If true, the database is opened without changing it: tmp is not cleared,
+	// directories are not created and permissions are not conformed. Any
+	// attempt to change the database fails with ErrReadOnly.
+	ReadOnly bool
 }
 
 // Expresses the permission policy for a given path. The first match is used.
@@ -96,6 +102,15 @@ func Open(cfg Config) (*DB, error) {
 		extantDirs: map[string]struct{}{},
 	}
 
+	if cfg.ReadOnly {
+		db.path, err = filepath.EvalSymlinks(db.path)
+		if err != nil {
+			return nil, err
+		}
+
+		return db, nil
+	}
+
 	err = db.clearTmp()
 	if err != nil {
 		return nil, err
@@ -109,8 +124,12 @@ func Open(cfg Config) (*DB, error) {
 	return db, nil
 }
 
-// Closes the database.
+// Closes the database, releasing the lock if it is held.
 func (db *DB) Close() error {
+	if db.lockFile != nil {
+		return db.Unlock()
+	}
+
 	return nil
 }
 
@@ -409,6 +428,10 @@ func (db *DB) clearTmp() error {
 }
 
 func (db *DB) ensurePath(path string) error {
+	if db.cfg.ReadOnly {
+		return ErrReadOnly
+	}
+
 	_, ok := db.extantDirs[path]
 	if ok {
 		return nil
@@ -434,6 +457,16 @@ func (db *DB) ensurePath(path string) error {
 	return nil
 }
 
+// Forgets that the directory at path and any directories beneath it exist,
+// after they have been removed or moved.
+func (db *DB) forgetPath(path string) {
+	for p := range db.extantDirs {
+		if p == path || strings.HasPrefix(p, path+string(filepath.Separator)) {
+			delete(db.extantDirs, p)
+		}
+	}
+}
+
 // Database Access
 
 // Collection represents a collection of objects in an fdb database. More
@@ -523,9 +556,31 @@ func (c *Collection) OSPath(name string) string {
 // Atomically delete an existing object or link or subcollection in the given
 // collection with the given name. Returns nil if the object does not exist.
 func (c *Collection) Delete(name string) error {
+	if c.db.cfg.ReadOnly {
+		return ErrReadOnly
+	}
+
+	c.db.forgetPath(filepath.Join(c.name, name))
 	return os.RemoveAll(filepath.Join(c.db.path, c.name, name))
 }
 
+// Atomically rename an object or link or subcollection in the given collection
+// from oldName to newName. newName may not name an existing non-empty
+// subcollection.
+func (c *Collection) Rename(oldName, newName string) error {
+	newPath := filepath.Join(c.db.path, c.name, newName)
+	err := c.db.ensurePath(filepath.Dir(filepath.Join(c.name, newName)))
+	if err != nil {
+		return err
+	}
+
+	c.db.forgetPath(filepath.Join(c.name, oldName))
+	return os.Rename(filepath.Join(c.db.path, c.name, oldName), newPath)
+}
+
+// Returned when trying to change a database opened read-only.
+var ErrReadOnly = fmt.Errorf("database is opened read-only")
+
 // Returned when calling Open() on a symlink. (To open symlinks, use Openl.)
 var ErrIsLink = fmt.Errorf("cannot open symlink")
 
@@ -220,3 +220,126 @@ func TestFDB(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmefdbtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	db, err := Open(Config{
+		Path: dir,
+		Permissions: []Permission{
+			{Path: ".", FileMode: 0644, DirMode: 0755},
+			{Path: "tmp", FileMode: 0600, DirMode: 0700},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	c := db.Collection("alpha")
+	err = WriteBytes(c, "xyz1", []byte("42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Rename("xyz1", "sub/xyz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if Exists(c, "xyz1") || !Exists(c.Collection("sub"), "xyz2") {
+		t.Fatalf("expected xyz1 to have been renamed to sub/xyz2")
+	}
+
+	n, err := Uint(c.Collection("sub"), "xyz2", 31)
+	if err != nil || n != 42 {
+		t.Fatalf("unexpected contents after rename: %v %v", n, err)
+	}
+
+	// Collections can be renamed too.
+	err = c.Rename("sub", "sub2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !Exists(c.Collection("sub2"), "xyz2") {
+		t.Fatalf("expected sub to have been renamed to sub2")
+	}
+
+	err = c.Delete("sub2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if Exists(c.Collection("sub2"), "xyz2") {
+		t.Fatalf("expected sub2 to have been deleted")
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmefdbtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		Path: dir,
+		Permissions: []Permission{
+			{Path: ".", FileMode: 0644, DirMode: 0755},
+			{Path: "tmp", FileMode: 0600, DirMode: 0700},
+		},
+	}
+
+	db1, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db1.Close()
+
+	db2, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db2.Close()
+
+	err = db1.Lock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db2.Lock(false)
+	if err != ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	// A waiting lock is acquired once the holder unlocks.
+	locked := make(chan error)
+	go func() {
+		locked <- db2.Lock(true)
+	}()
+
+	err = db1.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-locked
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db1.Lock(false)
+	if err != ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package fdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Returned by Lock if the database is locked by another process and waiting
+// was not requested.
+var ErrLocked = errors.New("database is locked by another process")
+
+// The name of the lock file, relative to the database root.
+const lockFilename = "lock"
+
+// Acquires an exclusive advisory lock on the database, held until Unlock is
+// called or the process exits. Only one process can hold the lock at a time.
+// If wait is true, blocks until the lock is available; otherwise, returns
+// ErrLocked if another process holds it.
+//
+// The lock is advisory; it only excludes other processes which also call
+// Lock.
+func (db *DB) Lock(wait bool) error {
+	if db.cfg.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if db.lockFile != nil {
+		return errors.New("database is already locked")
+	}
+
+	f, err := os.OpenFile(filepath.Join(db.path, lockFilename), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return ErrLocked
+		}
+
+		return err
+	}
+
+	db.lockFile = f
+	return nil
+}
+
+// Releases a lock acquired by Lock.
+func (db *DB) Unlock() error {
+	if db.lockFile == nil {
+		return errors.New("database is not locked")
+	}
+
+	// Closing the file releases the lock.
+	err := db.lockFile.Close()
+	db.lockFile = nil
+	return err
+}
@@ -95,14 +95,28 @@ func ChallengeTLSSNIStop(ctx *Context, hostname, targetFileName, validationName1
 		"challenge-tls-sni-stop", hostname, targetFileName, validationName1, validationName2)
 }
 
-func ChallengeDNSStart(ctx *Context, hostname, targetFileName, body string) (installed bool, err error) {
+func ChallengeTLSALPNStart(ctx *Context, hostname, targetFileName string, pem string) (installed bool, err error) {
+	return runParts(ctx, []byte(pem),
+		"challenge-tls-alpn-start", hostname, targetFileName)
+}
+
+func ChallengeTLSALPNStop(ctx *Context, hostname, targetFileName string, pem string) (installed bool, err error) {
+	return runParts(ctx, []byte(pem),
+		"challenge-tls-alpn-stop", hostname, targetFileName)
+}
+
+// Invokes DNS challenge start hooks. recordName is the fully qualified name at
+// which the TXT record must be placed, without a trailing dot. This is
+// "_acme-challenge." followed by hostname unless the challenge has been
+// delegated via a CNAME.
+func ChallengeDNSStart(ctx *Context, hostname, targetFileName, body, recordName string) (installed bool, err error) {
 	return runParts(ctx, nil,
-		"challenge-dns-start", hostname, targetFileName, body)
+		"challenge-dns-start", hostname, targetFileName, body, recordName)
 }
 
-func ChallengeDNSStop(ctx *Context, hostname, targetFileName, body string) (uninstalled bool, err error) {
+func ChallengeDNSStop(ctx *Context, hostname, targetFileName, body, recordName string) (uninstalled bool, err error) {
 	return runParts(ctx, nil,
-		"challenge-dns-stop", hostname, targetFileName, body)
+		"challenge-dns-stop", hostname, targetFileName, body, recordName)
 }
 
 func mergeEnvMap(m map[string]string, e []string) {
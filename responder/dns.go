@@ -5,21 +5,32 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/hlandau/acme/acmeapi/acmeutils"
+	"github.com/miekg/dns"
 )
 
 type DNSChallengeInfo struct {
 	Body string
+
+	// The fully qualified name at which the TXT record must be placed. This is
+	// "_acme-challenge." followed by the hostname, unless the challenge has
+	// been delegated to another name via a CNAME.
+	RecordName string
 }
 
 type dnsResponder struct {
-	rcfg       Config
-	validation []byte
-	dnsString  string
+	rcfg                Config
+	validation          []byte
+	dnsString           string
+	recordName          string
+	zone                string           // Zone updated via RFC 2136, if any.
+	serverRecord        *dnsServerRecord // Record served by embedded server, if any.
+	requestDetectedChan chan struct{}
 }
 
 func newDNSResponder(rcfg Config) (Responder, error) {
 	s := &dnsResponder{
-		rcfg: rcfg,
+		rcfg:                rcfg,
+		requestDetectedChan: make(chan struct{}, 1),
 	}
 
 	var err error
@@ -36,26 +47,162 @@ func newDNSResponder(rcfg Config) (Responder, error) {
 	return s, nil
 }
 
-// Start is a no-op for the DNS method.
+// Returns the fully qualified name at which the challenge record must be
+// placed. Normally this is _acme-challenge.<hostname>, but if that is a CNAME
+// the record must be placed at the target, since that is where the ACME
+// server will end up looking.
+func (s *dnsResponder) resolveRecordName() string {
+	if s.rcfg.Hostname == "" {
+		return ""
+	}
+
+	if zone := s.delegationZone(); zone != "" {
+		return dns.Fqdn(s.rcfg.Hostname) + zone
+	}
+
+	name := "_acme-challenge." + dns.Fqdn(s.rcfg.Hostname)
+	target, err := followCNAMEs(name)
+	if err != nil {
+		log.Warne(err, "could not look up CNAME for ", name, ", assuming there is none")
+		return name
+	}
+
+	return target
+}
+
+// Returns the zone the challenge record is to be placed in, if known. When
+// serving the record ourselves, this defaults to the zone served.
+func (s *dnsResponder) delegationZone() string {
+	if zone := s.rcfg.ChallengeConfig.DNSDelegationZone; zone != "" {
+		return dns.Fqdn(zone)
+	}
+
+	if c := s.rcfg.ChallengeConfig.DNSServer; c != nil {
+		return c.zone()
+	}
+
+	return ""
+}
+
+// Start installs the challenge record and then waits until it is served by
+// all of the zone's authoritative nameservers, so that the ACME server does
+// not query for it too early.
 func (s *dnsResponder) Start() error {
+	s.recordName = s.resolveRecordName()
+
+	err := s.install()
+	if err != nil {
+		return err
+	}
+
+	err = s.waitForPropagation()
+	if err != nil {
+		log.Debuge(err, "dns-01 propagation check failed")
+		s.Stop()
+		return err
+	}
+
+	// Discard any notifications caused by the propagation check.
+L:
+	for {
+		select {
+		case <-s.requestDetectedChan:
+		default:
+			break L
+		}
+	}
+
+	return nil
+}
+
+func (s *dnsResponder) notify() {
+	select {
+	case s.requestDetectedChan <- struct{}{}:
+	default:
+	}
+}
+
+func (s *dnsResponder) challengeInfo() *DNSChallengeInfo {
+	return &DNSChallengeInfo{
+		Body:       s.dnsString,
+		RecordName: s.recordName,
+	}
+}
+
+func (s *dnsResponder) install() error {
+	if c := s.rcfg.ChallengeConfig.DNSServer; c != nil {
+		if s.rcfg.Hostname == "" {
+			return fmt.Errorf("hostname is required for dns-01 via embedded DNS server")
+		}
+
+		var err error
+		s.serverRecord, err = registerDNSRecord(c, s.recordName, s.dnsString, s.notify)
+		return err
+	}
+
+	if c := s.rcfg.ChallengeConfig.RFC2136; c != nil {
+		if s.rcfg.Hostname == "" {
+			return fmt.Errorf("hostname is required for dns-01 via RFC 2136")
+		}
+
+		var err error
+		s.zone, err = c.install(s.recordName, s.dnsString, s.delegationZone())
+		return err
+	}
+
 	// Try hooks.
 	if startFunc := s.rcfg.ChallengeConfig.StartHookFunc; startFunc != nil {
-		err := startFunc(&DNSChallengeInfo{
-			Body: s.dnsString,
-		})
-		return err
+		return startFunc(s.challengeInfo())
 	}
 
 	return fmt.Errorf("DNS challenge not supported")
 }
 
-// Stop is a no-op for the DNS method.
+func (s *dnsResponder) waitForPropagation() error {
+	timeout := s.rcfg.ChallengeConfig.DNSPropagationTimeout
+	if timeout < 0 || s.rcfg.Hostname == "" {
+		return nil
+	}
+
+	if timeout == 0 {
+		timeout = DefaultDNSPropagationTimeout
+	}
+
+	// When updating via RFC 2136, ask the primary about the zone, since it may
+	// not be visible to the system resolver, e.g. because of split-horizon DNS.
+	addr := ""
+	zone := s.delegationZone()
+	if c := s.rcfg.ChallengeConfig.RFC2136; c != nil && s.rcfg.ChallengeConfig.DNSServer == nil {
+		addr = c.serverAddr()
+		zone = s.zone
+	}
+
+	return waitForPropagation(addr, zone, s.recordName, s.dnsString, timeout)
+}
+
 func (s *dnsResponder) Stop() error {
+	if s.rcfg.ChallengeConfig.DNSServer != nil {
+		if s.serverRecord != nil {
+			s.serverRecord.unregister()
+			s.serverRecord = nil
+		}
+
+		return nil
+	}
+
+	if c := s.rcfg.ChallengeConfig.RFC2136; c != nil {
+		if s.zone != "" {
+			err := c.remove(s.zone, s.recordName, s.dnsString)
+			log.Warne(err, "failed to remove DNS challenge record (ignoring)")
+			s.zone = ""
+		}
+
+		return nil
+	}
+
 	// Try hooks.
 	if stopFunc := s.rcfg.ChallengeConfig.StopHookFunc; stopFunc != nil {
-		err := stopFunc(&DNSChallengeInfo{
-			Body: s.dnsString,
-		})
+		err := stopFunc(s.challengeInfo())
 		log.Warne(err, "failed to uninstall DNS challenge via hook (ignoring)")
 		return nil
 	}
@@ -64,7 +211,11 @@ func (s *dnsResponder) Stop() error {
 }
 
 func (s *dnsResponder) RequestDetectedChan() <-chan struct{} {
-	return nil
+	if s.rcfg.ChallengeConfig.DNSServer == nil {
+		return nil
+	}
+
+	return s.requestDetectedChan
 }
 
 func (s *dnsResponder) Validation() json.RawMessage {
@@ -0,0 +1,267 @@
+package responder
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testTSIGKeyName = "acme-key."
+	testTSIGSecret  = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0" // "secretsecretsecretsecret"
+)
+
+// A minimal authoritative server for example.com which accepts signed updates.
+type testDNSServer struct {
+	mu      sync.Mutex
+	records map[string][]string // TXT records by name
+	cnames  map[string]string
+	updates int
+}
+
+func (s *testDNSServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetReply(req)
+	m.Authoritative = true
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.Opcode == dns.OpcodeUpdate {
+		if req.IsTsig() == nil || w.TsigStatus() != nil {
+			m.Rcode = dns.RcodeNotAuth
+		} else {
+			s.applyUpdate(req)
+		}
+
+		if req.IsTsig() != nil {
+			m.SetTsig(testTSIGKeyName, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	q := req.Question[0]
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+		Ns:      "ns1.example.com.",
+		Mbox:    "hostmaster.example.com.",
+		Serial:  1,
+		Minttl:  60,
+		Refresh: 3600, Retry: 600, Expire: 86400,
+	}
+
+	switch {
+	case !dns.IsSubDomain("example.com.", q.Name):
+		m.Rcode = dns.RcodeRefused
+	case q.Qtype == dns.TypeSOA && q.Name == "example.com.":
+		m.Answer = append(m.Answer, soa)
+	case q.Qtype == dns.TypeNS && q.Name == "example.com.":
+		m.Answer = append(m.Answer, &dns.NS{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+			Ns:  "ns1.example.com.",
+		})
+		m.Extra = append(m.Extra, &dns.A{
+			Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+	case q.Qtype == dns.TypeCNAME && s.cnames[q.Name] != "":
+		m.Answer = append(m.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: s.cnames[q.Name],
+		})
+	case q.Qtype == dns.TypeTXT && len(s.records[q.Name]) > 0:
+		for _, v := range s.records[q.Name] {
+			m.Answer = append(m.Answer, challengeTXT(q.Name, v))
+		}
+	default:
+		m.Ns = append(m.Ns, soa)
+	}
+
+	w.WriteMsg(m)
+}
+
+func (s *testDNSServer) applyUpdate(req *dns.Msg) {
+	s.updates++
+	for _, rr := range req.Ns {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		name := txt.Hdr.Name
+		value := txt.Txt[0]
+		switch txt.Hdr.Class {
+		case dns.ClassINET:
+			s.records[name] = append(s.records[name], value)
+		case dns.ClassNONE:
+			var values []string
+			for _, v := range s.records[name] {
+				if v != value {
+					values = append(values, v)
+				}
+			}
+			s.records[name] = values
+		}
+	}
+}
+
+func (s *testDNSServer) txt(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[name]
+}
+
+// Starts a test DNS server on a random local port, and directs the
+// propagation check to it.
+func startTestDNSServer(t *testing.T) (*testDNSServer, string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &testDNSServer{records: map[string][]string{}, cnames: map[string]string{}}
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler:    ts,
+		TsigSecret: map[string]string{testTSIGKeyName: testTSIGSecret},
+		// The default rejects UPDATE messages.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go srv.ActivateAndServe()
+
+	addr := pc.LocalAddr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.ParseUint(port, 10, 16)
+
+	oldPort, oldResolver, oldInterval := InternalDNSPort, InternalDNSResolver, dnsPropagationInterval
+	InternalDNSPort, InternalDNSResolver, dnsPropagationInterval = uint16(portNum), addr, 50*time.Millisecond
+
+	return ts, addr, func() {
+		InternalDNSPort, InternalDNSResolver, dnsPropagationInterval = oldPort, oldResolver, oldInterval
+		srv.Shutdown()
+	}
+}
+
+func (s *testDNSServer) setTXT(name string, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[name] = values
+}
+
+func TestDNSPropagation(t *testing.T) {
+	ts, _, closeFunc := startTestDNSServer(t)
+	defer closeFunc()
+
+	const name = "_acme-challenge.www.example.com."
+
+	stopped := false
+	r := &dnsResponder{
+		rcfg: Config{
+			Hostname: "www.example.com",
+			ChallengeConfig: ChallengeConfig{
+				DNSPropagationTimeout: 2 * time.Second,
+				StartHookFunc: func(interface{}) error {
+					// Simulate a record which takes a while to appear.
+					go func() {
+						time.Sleep(200 * time.Millisecond)
+						ts.setTXT(name, "other", "value")
+					}()
+					return nil
+				},
+				StopHookFunc: func(interface{}) error {
+					stopped = true
+					ts.setTXT(name)
+					return nil
+				},
+			},
+		},
+		dnsString: "value",
+	}
+
+	err := r.Start()
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	if len(ts.txt(name)) != 2 {
+		t.Fatalf("start returned before record appeared")
+	}
+
+	if stopped {
+		t.Fatalf("stop hook called unexpectedly")
+	}
+
+	err = r.Stop()
+	if err != nil || !stopped {
+		t.Fatalf("stop: %v", err)
+	}
+
+	// If the record never appears, Start fails and uninstalls the challenge.
+	r.rcfg.ChallengeConfig.DNSPropagationTimeout = 200 * time.Millisecond
+	r.rcfg.ChallengeConfig.StartHookFunc = func(interface{}) error {
+		return nil
+	}
+	stopped = false
+
+	err = r.Start()
+	if err == nil {
+		t.Fatalf("start unexpectedly succeeded")
+	}
+
+	if !stopped {
+		t.Fatalf("stop hook not called after propagation check failed")
+	}
+}
+
+func TestDNSDelegation(t *testing.T) {
+	ts, _, closeFunc := startTestDNSServer(t)
+	defer closeFunc()
+
+	var recordNames []string
+	r := &dnsResponder{
+		rcfg: Config{
+			Hostname: "www.example.com",
+			ChallengeConfig: ChallengeConfig{
+				StartHookFunc: func(challengeInfo interface{}) error {
+					ci := challengeInfo.(*DNSChallengeInfo)
+					recordNames = append(recordNames, ci.RecordName)
+					ts.setTXT(ci.RecordName, ci.Body)
+					return nil
+				},
+				StopHookFunc: func(challengeInfo interface{}) error {
+					ts.setTXT(challengeInfo.(*DNSChallengeInfo).RecordName)
+					return nil
+				},
+			},
+		},
+		dnsString: "value",
+	}
+
+	// CNAMEs are followed to the final target.
+	ts.mu.Lock()
+	ts.cnames["_acme-challenge.www.example.com."] = "a.example.com."
+	ts.cnames["a.example.com."] = "b.acme.example.com."
+	ts.mu.Unlock()
+
+	err := r.Start()
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	r.Stop()
+
+	// The delegation zone overrides any CNAME.
+	r.rcfg.ChallengeConfig.DNSDelegationZone = "example.com"
+	err = r.Start()
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	r.Stop()
+
+	if len(recordNames) != 2 || recordNames[0] != "b.acme.example.com." || recordNames[1] != "www.example.com.example.com." {
+		t.Fatalf("unexpected record names: %v", recordNames)
+	}
+}
@@ -0,0 +1,289 @@
+package responder
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Settings for answering dns-01 challenges by acting as the authoritative
+// nameserver for a zone into which _acme-challenge names are delegated.
+type DNSServerConfig struct {
+	// The zone served, e.g. "acme.example.net". Required.
+	Zone string
+
+	// The hostname of this nameserver, as named in the NS records delegating
+	// Zone. Returned in SOA and NS responses. Defaults to Zone.
+	Nameserver string
+
+	// Addresses to listen on, for both UDP and TCP. Defaults to ":53".
+	ListenAddrs []string
+}
+
+func (c *DNSServerConfig) zone() string {
+	return strings.ToLower(dns.Fqdn(c.Zone))
+}
+
+func (c *DNSServerConfig) nameserver() string {
+	if c.Nameserver == "" {
+		return c.zone()
+	}
+
+	return strings.ToLower(dns.Fqdn(c.Nameserver))
+}
+
+func (c *DNSServerConfig) listenAddrs() []string {
+	if len(c.ListenAddrs) == 0 {
+		return []string{":53"}
+	}
+
+	return c.ListenAddrs
+}
+
+// A TXT record served by an embedded DNS server.
+type dnsServerRecord struct {
+	zone       string // Lowercase FQDN.
+	nameserver string // Lowercase FQDN.
+	name       string // Lowercase FQDN.
+	value      string
+	notify     func()
+	servers    []*dnsServer
+}
+
+// An embedded DNS server listening on a single address. Servers are shared
+// between responders, so that several challenges can be completed at once;
+// a server stops listening once no records are registered with it.
+type dnsServer struct {
+	addr    string
+	udp     *dns.Server
+	tcp     *dns.Server
+	records map[string][]*dnsServerRecord
+	count   int
+}
+
+var (
+	dnsServersMutex sync.Mutex
+	dnsServers      = map[string]*dnsServer{}
+)
+
+// Serves a TXT record with the given value at name on each of the listen
+// addresses in cfg, starting servers as necessary. notify is called whenever
+// the record is queried. name must be within the configured zone.
+func registerDNSRecord(cfg *DNSServerConfig, name, value string, notify func()) (*dnsServerRecord, error) {
+	rec := &dnsServerRecord{
+		zone:       cfg.zone(),
+		nameserver: cfg.nameserver(),
+		name:       strings.ToLower(dns.Fqdn(name)),
+		value:      value,
+		notify:     notify,
+	}
+
+	if !dns.IsSubDomain(rec.zone, rec.name) {
+		return nil, fmt.Errorf("challenge record name %q is not within zone %q", name, cfg.Zone)
+	}
+
+	dnsServersMutex.Lock()
+	for _, addr := range cfg.listenAddrs() {
+		srv := dnsServers[addr]
+		if srv == nil {
+			var err error
+			srv, err = startDNSServer(addr)
+			if err != nil {
+				stopped := rec.unregisterLocked()
+				dnsServersMutex.Unlock()
+				stopDNSServers(stopped)
+				return nil, err
+			}
+
+			dnsServers[addr] = srv
+		}
+
+		srv.records[rec.name] = append(srv.records[rec.name], rec)
+		srv.count++
+		rec.servers = append(rec.servers, srv)
+	}
+	dnsServersMutex.Unlock()
+
+	return rec, nil
+}
+
+// Stops serving the record, stopping any servers which are no longer needed.
+func (rec *dnsServerRecord) unregister() {
+	dnsServersMutex.Lock()
+	stopped := rec.unregisterLocked()
+	dnsServersMutex.Unlock()
+
+	stopDNSServers(stopped)
+}
+
+// Removes the record from the servers serving it. Returns the servers which
+// are no longer needed. These must be stopped without holding
+// dnsServersMutex, since stopping waits for queries in progress, which need
+// it.
+func (rec *dnsServerRecord) unregisterLocked() []*dnsServer {
+	var stopped []*dnsServer
+	for _, srv := range rec.servers {
+		recs := srv.records[rec.name]
+		for i, r := range recs {
+			if r == rec {
+				srv.records[rec.name] = append(recs[:i:i], recs[i+1:]...)
+				break
+			}
+		}
+		if len(srv.records[rec.name]) == 0 {
+			delete(srv.records, rec.name)
+		}
+
+		srv.count--
+		if srv.count == 0 {
+			delete(dnsServers, srv.addr)
+			stopped = append(stopped, srv)
+		}
+	}
+
+	rec.servers = nil
+	return stopped
+}
+
+func stopDNSServers(servers []*dnsServer) {
+	for _, srv := range servers {
+		srv.stop()
+	}
+}
+
+func startDNSServer(addr string) (*dnsServer, error) {
+	srv := &dnsServer{
+		addr:    addr,
+		records: map[string][]*dnsServerRecord{},
+	}
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	// Shutdown fails if called before the servers have started, so wait.
+	started := make(chan struct{}, 2)
+	notifyStarted := func() { started <- struct{}{} }
+	srv.udp = &dns.Server{PacketConn: pc, Handler: srv, NotifyStartedFunc: notifyStarted}
+	srv.tcp = &dns.Server{Listener: l, Handler: srv, NotifyStartedFunc: notifyStarted}
+	go srv.udp.ActivateAndServe()
+	go srv.tcp.ActivateAndServe()
+	<-started
+	<-started
+
+	log.Debugf("started DNS server on %s", addr)
+	return srv, nil
+}
+
+func (srv *dnsServer) stop() {
+	log.Debugf("stopping DNS server on %s", srv.addr)
+	srv.udp.Shutdown()
+	srv.tcp.Shutdown()
+}
+
+func (srv *dnsServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetReply(req)
+
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		m.Rcode = dns.RcodeNotImplemented
+		w.WriteMsg(m)
+		return
+	}
+
+	q := req.Question[0]
+
+	// ACME servers may randomize the case of names in queries, so match
+	// case-insensitively but answer using the name as asked.
+	name := strings.ToLower(q.Name)
+
+	var notifyFuncs []func()
+	dnsServersMutex.Lock()
+	zone, nameserver, exists := srv.lookupLocked(name)
+	if zone != "" && q.Qtype == dns.TypeTXT {
+		for _, rec := range srv.records[name] {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: []string{rec.value},
+			})
+			notifyFuncs = append(notifyFuncs, rec.notify)
+		}
+	}
+	dnsServersMutex.Unlock()
+
+	for _, f := range notifyFuncs {
+		f()
+	}
+
+	if zone == "" {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	m.Authoritative = true
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET},
+		Ns:      nameserver,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+	}
+
+	switch {
+	case len(m.Answer) > 0:
+	case name == zone && q.Qtype == dns.TypeSOA:
+		m.Answer = append(m.Answer, soa)
+	case name == zone && q.Qtype == dns.TypeNS:
+		m.Answer = append(m.Answer, &dns.NS{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET},
+			Ns:  nameserver,
+		})
+	default:
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+
+		m.Ns = append(m.Ns, soa)
+	}
+
+	w.WriteMsg(m)
+}
+
+// Returns the zone containing name and its nameserver, or empty strings if
+// name is not within any zone served. exists indicates whether the name
+// exists, i.e. whether it or any name beneath it has records.
+func (srv *dnsServer) lookupLocked(name string) (zone, nameserver string, exists bool) {
+	for recName, recs := range srv.records {
+		for _, rec := range recs {
+			if !dns.IsSubDomain(rec.zone, name) {
+				continue
+			}
+
+			if len(rec.zone) > len(zone) {
+				zone, nameserver = rec.zone, rec.nameserver
+			}
+
+			if dns.IsSubDomain(name, recName) {
+				exists = true
+			}
+		}
+	}
+
+	if name == zone {
+		exists = true
+	}
+
+	return
+}
@@ -0,0 +1,113 @@
+package responder
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSServer(t *testing.T) {
+	// Find a free port.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	newResponder := func(hostname, value string) *dnsResponder {
+		return &dnsResponder{
+			rcfg: Config{
+				Hostname: hostname,
+				ChallengeConfig: ChallengeConfig{
+					DNSPropagationTimeout: -1,
+					DNSServer: &DNSServerConfig{
+						Zone:        "acme.example.net",
+						Nameserver:  "ns.example.net",
+						ListenAddrs: []string{addr},
+					},
+				},
+			},
+			dnsString:           value,
+			requestDetectedChan: make(chan struct{}, 1),
+		}
+	}
+
+	r1 := newResponder("www.example.com", "value1")
+	r2 := newResponder("example.com", "value2")
+	for _, r := range []*dnsResponder{r1, r2} {
+		err = r.Start()
+		if err != nil {
+			t.Fatalf("start: %v", err)
+		}
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		r, err := dnsQuery(addr, name, qtype, false)
+		if err != nil {
+			t.Fatalf("query %q: %v", name, err)
+		}
+		return r
+	}
+
+	// Names are matched case-insensitively, as the CA may randomize case.
+	r := query("WWW.example.COM.acme.example.net", dns.TypeTXT)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.TXT).Txt[0] != "value1" || !r.Authoritative {
+		t.Fatalf("unexpected TXT response: %v", r)
+	}
+
+	select {
+	case <-r1.RequestDetectedChan():
+	case <-time.After(time.Second):
+		t.Fatalf("request not detected")
+	}
+
+	r = query("acme.example.net", dns.TypeSOA)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.SOA).Ns != "ns.example.net." {
+		t.Fatalf("unexpected SOA response: %v", r)
+	}
+
+	r = query("acme.example.net", dns.TypeNS)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.NS).Ns != "ns.example.net." {
+		t.Fatalf("unexpected NS response: %v", r)
+	}
+
+	r = query("other.acme.example.net", dns.TypeTXT)
+	if r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 {
+		t.Fatalf("unexpected response for nonexistent name: %v", r)
+	}
+
+	r = query("example.com.acme.example.net", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 || len(r.Ns) != 1 {
+		t.Fatalf("unexpected response for other type: %v", r)
+	}
+
+	_, err = dnsQuery(addr, "example.org", dns.TypeTXT, false)
+	if err == nil {
+		t.Fatalf("query outside zone unexpectedly succeeded")
+	}
+
+	// The server keeps running until the last record is removed.
+	r1.Stop()
+	r = query("example.com.acme.example.net", dns.TypeTXT)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.TXT).Txt[0] != "value2" {
+		t.Fatalf("unexpected TXT response: %v", r)
+	}
+
+	r2.Stop()
+	dnsServersMutex.Lock()
+	n := len(dnsServers)
+	dnsServersMutex.Unlock()
+	if n != 0 {
+		t.Fatalf("server not stopped")
+	}
+
+	// Records outside the zone are rejected.
+	r3 := newResponder("www.example.com", "value3")
+	r3.rcfg.ChallengeConfig.DNSDelegationZone = "example.org"
+	err = r3.Start()
+	if err == nil {
+		t.Fatalf("record outside zone unexpectedly accepted")
+	}
+}
@@ -0,0 +1,244 @@
+package responder
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+// Internal use only. This can be used to change the port on which
+// authoritative nameservers are queried for development purposes.
+var InternalDNSPort uint16 = 53
+
+// Internal use only. If set, this resolver address ("host:port") is used
+// instead of those listed in /etc/resolv.conf, for development purposes.
+var InternalDNSResolver string
+
+// How long to wait for a challenge record to appear on all authoritative
+// nameservers if not configured, and how often to check.
+const DefaultDNSPropagationTimeout = 2 * time.Minute
+
+var dnsPropagationInterval = 2 * time.Second
+
+// Returns the address of a recursive resolver.
+func systemResolver() (string, error) {
+	if InternalDNSResolver != "" {
+		return InternalDNSResolver, nil
+	}
+
+	cc, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+
+	if len(cc.Servers) == 0 {
+		return "", fmt.Errorf("no nameservers in /etc/resolv.conf")
+	}
+
+	return net.JoinHostPort(cc.Servers[0], cc.Port), nil
+}
+
+// Makes a query, retrying over TCP if the response is truncated. Recursion is
+// requested iff recurse is true.
+func dnsQuery(addr, name string, qtype uint16, recurse bool) (*dns.Msg, error) {
+	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = recurse
+
+	cl := &dns.Client{}
+	r, _, err := cl.Exchange(m, addr)
+	if err == nil && r.Truncated {
+		cl.Net = "tcp"
+		r, _, err = cl.Exchange(m, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("query for %q at %s failed: %s", name, addr, dns.RcodeToString[r.Rcode])
+	}
+
+	return r, nil
+}
+
+// Maximum length of a CNAME chain which will be followed.
+const maxCNAMEChain = 8
+
+// Follows any chain of CNAMEs starting at name using the system resolver,
+// returning the final target, or name itself if it is not a CNAME.
+func followCNAMEs(name string) (string, error) {
+	addr, err := systemResolver()
+	if err != nil {
+		return "", err
+	}
+
+	start := name
+	for i := 0; i < maxCNAMEChain; i++ {
+		r, err := dnsQuery(addr, name, dns.TypeCNAME, true)
+		if err != nil {
+			return "", err
+		}
+
+		target := ""
+		for _, rr := range r.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = cname.Target
+			}
+		}
+
+		if target == "" {
+			return name, nil
+		}
+
+		log.Debugf("%q is a CNAME for %q", name, target)
+		name = target
+	}
+
+	return "", fmt.Errorf("CNAME chain starting at %q is too long", start)
+}
+
+// Returns the zone containing fqdn. addr may be either an authoritative
+// server for the zone or a recursive resolver; either answers with the SOA of
+// the zone containing the name, in the answer or (for a nonexistent name)
+// authority section.
+func findZone(addr, fqdn string) (string, error) {
+	r, err := dnsQuery(addr, fqdn, dns.TypeSOA, true)
+	if err != nil {
+		return "", err
+	}
+
+	for _, rr := range append(r.Answer, r.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, fqdn) {
+			return soa.Hdr.Name, nil
+		}
+	}
+
+	return "", fmt.Errorf("could not determine zone for %q", fqdn)
+}
+
+// Returns the addresses of the authoritative nameservers for zone, as listed
+// in the zone's NS records. addr is the server to query for them.
+func authoritativeNameservers(addr, zone string) ([]string, error) {
+	r, err := dnsQuery(addr, zone, dns.TypeNS, true)
+	if err != nil {
+		return nil, err
+	}
+
+	port := fmt.Sprintf("%d", InternalDNSPort)
+
+	var nameservers []string
+	for _, rr := range r.Answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		// Prefer glue, since the nameserver names are often within the zone
+		// itself.
+		var ips []string
+		for _, x := range r.Extra {
+			switch g := x.(type) {
+			case *dns.A:
+				if strings.EqualFold(g.Hdr.Name, ns.Ns) {
+					ips = append(ips, g.A.String())
+				}
+			case *dns.AAAA:
+				if strings.EqualFold(g.Hdr.Name, ns.Ns) {
+					ips = append(ips, g.AAAA.String())
+				}
+			}
+		}
+
+		if len(ips) == 0 {
+			ips, err = net.LookupHost(ns.Ns)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, ip := range ips {
+			nameservers = append(nameservers, net.JoinHostPort(ip, port))
+		}
+	}
+
+	if len(nameservers) == 0 {
+		return nil, fmt.Errorf("no nameservers found for zone %q", zone)
+	}
+
+	return nameservers, nil
+}
+
+// Returns true iff the server at addr serves a TXT record with the given
+// value at fqdn.
+func hasTXT(addr, fqdn, value string) (bool, error) {
+	r, err := dnsQuery(addr, fqdn, dns.TypeTXT, false)
+	if err != nil {
+		return false, err
+	}
+
+	for _, rr := range r.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Waits until every nameserver serves a TXT record with the given value at
+// fqdn, or until timeout has elapsed.
+func waitForTXT(nameservers []string, fqdn, value string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, ns := range nameservers {
+		for {
+			ok, err := hasTXT(ns, fqdn, value)
+			if ok {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				if err == nil {
+					err = fmt.Errorf("record not present")
+				}
+
+				return fmt.Errorf("timed out waiting for %q to appear at %s: %v", fqdn, ns, err)
+			}
+
+			log.Debugf("waiting for %q to appear at %s", fqdn, ns)
+			time.Sleep(dnsPropagationInterval)
+		}
+	}
+
+	return nil
+}
+
+// Waits until all authoritative nameservers for zone serve a TXT record with
+// the given value at fqdn. If zone is empty, the zone containing fqdn is used.
+// addr is the server used to find the zone and its nameservers; if empty, the
+// system resolver is used.
+func waitForPropagation(addr, zone, fqdn, value string, timeout time.Duration) error {
+	var err error
+	if addr == "" {
+		addr, err = systemResolver()
+		if err != nil {
+			return err
+		}
+	}
+
+	if zone == "" {
+		zone, err = findZone(addr, fqdn)
+		if err != nil {
+			return err
+		}
+	}
+
+	nameservers, err := authoritativeNameservers(addr, zone)
+	if err != nil {
+		return err
+	}
+
+	return waitForTXT(nameservers, fqdn, value, timeout)
+}
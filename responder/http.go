@@ -31,10 +31,9 @@ type HTTPChallengeInfo struct {
 type httpResponder struct {
 	rcfg Config
 
-	serveMux            *http.ServeMux
 	response            []byte
 	requestDetectedChan chan struct{}
-	stopFuncs           []func()
+	listeners           []*httpListener
 	ka                  []byte
 	validation          []byte
 	filePath            string
@@ -45,14 +44,10 @@ type httpResponder struct {
 func newHTTP(rcfg Config) (Responder, error) {
 	s := &httpResponder{
 		rcfg:                rcfg,
-		serveMux:            http.NewServeMux(),
 		requestDetectedChan: make(chan struct{}, 1),
 		notifySupported:     true,
 	}
 
-	// Configure the HTTP server
-	s.serveMux.HandleFunc("/.well-known/acme-challenge/"+rcfg.Token, s.handle)
-
 	ka, err := acmeutils.KeyAuthorization(rcfg.AccountKey, rcfg.Token)
 	if err != nil {
 		return nil, err
@@ -116,9 +111,15 @@ func (s *httpResponder) selfTest() error {
 		return nil
 	}
 
+	host := s.rcfg.Hostname
+	if strings.IndexByte(host, ':') >= 0 {
+		// IPv6 address.
+		host = "[" + host + "]"
+	}
+
 	u := url.URL{
 		Scheme: "http",
-		Host:   s.rcfg.Hostname,
+		Host:   host,
 		Path:   "/.well-known/acme-challenge/" + s.rcfg.Token,
 	}
 
@@ -323,8 +324,15 @@ func (s *httpResponder) startActual() error {
 	// Determine and listen on sorted list of addresses.
 	addrs := determineListenAddrs(s.rcfg.ChallengeConfig.HTTPPorts)
 
+	httpChallengesMutex.Lock()
+	httpChallenges[s.rcfg.Token] = s
+	httpChallengesMutex.Unlock()
+
 	for _, a := range addrs {
-		s.startListener(a)
+		hl, err := acquireHTTPListener(a)
+		if err == nil {
+			s.listeners = append(s.listeners, hl)
+		}
 	}
 
 	// Even if none of the listeners managed to start, the webroot or redirector
@@ -343,19 +351,90 @@ func (s *httpResponder) startActual() error {
 	return nil
 }
 
-func (s *httpResponder) startListener(addr string) error {
+// HTTP listeners are shared between responders, so that several challenges
+// can be completed at once. A listener serves the challenges of all active
+// responders, and is stopped once no responder is using it.
+type httpListener struct {
+	addr     string
+	stopFunc func()
+	refs     int
+}
+
+var (
+	// Protects httpListeners. Held while starting and stopping listeners.
+	httpListenersMutex sync.Mutex
+	httpListeners      = map[string]*httpListener{}
+
+	// Protects httpChallenges. Never held for long, as it is needed by
+	// handlers.
+	httpChallengesMutex sync.Mutex
+	httpChallenges      = map[string]*httpResponder{} // by token
+)
+
+const httpChallengePathPrefix = "/.well-known/acme-challenge/"
+
+// Shared HTTP handler.
+func handleHTTPChallenge(rw http.ResponseWriter, req *http.Request) {
+	var s *httpResponder
+	if strings.HasPrefix(req.URL.Path, httpChallengePathPrefix) {
+		httpChallengesMutex.Lock()
+		s = httpChallenges[req.URL.Path[len(httpChallengePathPrefix):]]
+		httpChallengesMutex.Unlock()
+	}
+
+	if s == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	s.handle(rw, req)
+}
+
+// Starts using the listener on addr, starting it if necessary.
+func acquireHTTPListener(addr string) (*httpListener, error) {
+	httpListenersMutex.Lock()
+	defer httpListenersMutex.Unlock()
+
+	hl := httpListeners[addr]
+	if hl == nil {
+		var err error
+		hl, err = startHTTPListener(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		httpListeners[addr] = hl
+	}
+
+	hl.refs++
+	return hl, nil
+}
+
+// Stops using the listener, stopping it if it is no longer used.
+func (hl *httpListener) release() {
+	httpListenersMutex.Lock()
+	defer httpListenersMutex.Unlock()
+
+	hl.refs--
+	if hl.refs == 0 {
+		delete(httpListeners, hl.addr)
+		hl.stopFunc()
+	}
+}
+
+func startHTTPListener(addr string) (*httpListener, error) {
 	svr := &graceful.Server{
 		NoSignalHandling: true,
 		Server: &http.Server{
 			Addr:    addr,
-			Handler: s.serveMux,
+			Handler: http.HandlerFunc(handleHTTPChallenge),
 		},
 	}
 
 	l, err := net.Listen("tcp", svr.Addr)
 	if err != nil {
 		log.Debuge(err, "failed to listen on ", svr.Addr)
-		return err
+		return nil, err
 	}
 
 	log.Debugf("listening on %v", svr.Addr)
@@ -370,25 +449,24 @@ func (s *httpResponder) startListener(addr string) error {
 		<-svr.StopChan()
 	}
 
-	s.stopFuncs = append(s.stopFuncs, stopFunc)
-	return nil
+	return &httpListener{
+		addr:     addr,
+		stopFunc: stopFunc,
+	}, nil
 }
 
 // Stop handling HTTP requests.
 func (s *httpResponder) Stop() error {
-	var wg sync.WaitGroup
-	wg.Add(len(s.stopFuncs))
-
-	call := func(f func()) {
-		defer wg.Done()
-		f()
+	for _, hl := range s.listeners {
+		hl.release()
 	}
+	s.listeners = nil
 
-	for _, f := range s.stopFuncs {
-		go call(f)
+	httpChallengesMutex.Lock()
+	if httpChallenges[s.rcfg.Token] == s {
+		delete(httpChallenges, s.rcfg.Token)
 	}
-	wg.Wait()
-	s.stopFuncs = nil
+	httpChallengesMutex.Unlock()
 
 	// Try and remove challenges.
 	webrootRemoveChallenge(s.getWebroots(), s.rcfg.Token)
@@ -0,0 +1,97 @@
+package responder
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHTTPSharedListener(t *testing.T) {
+	// Find a free port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldWebrootPath := StandardWebrootPath
+	StandardWebrootPath = t.TempDir()
+	defer func() { StandardWebrootPath = oldWebrootPath }()
+
+	newResponder := func(token string) *httpResponder {
+		r, err := newHTTP(Config{
+			AccountKey: key,
+			Token:      token,
+			ChallengeConfig: ChallengeConfig{
+				HTTPPorts:      []string{addr},
+				HTTPNoSelfTest: true,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = r.Start()
+		if err != nil {
+			t.Fatalf("start: %v", err)
+		}
+
+		return r.(*httpResponder)
+	}
+
+	get := func(token string) (int, string) {
+		res, err := http.Get("http://" + addr + "/.well-known/acme-challenge/" + token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res.StatusCode, string(b)
+	}
+
+	r1 := newResponder("token1")
+	r2 := newResponder("token2")
+	for _, r := range []*httpResponder{r1, r2} {
+		code, body := get(r.rcfg.Token)
+		if code != 200 || body != string(r.ka) {
+			t.Fatalf("unexpected response for %q: %d %q", r.rcfg.Token, code, body)
+		}
+	}
+
+	if code, _ := get("token3"); code != 404 {
+		t.Fatalf("unexpected status for unknown token: %d", code)
+	}
+
+	// The listener keeps running until the last responder is stopped.
+	r1.Stop()
+	if code, _ := get("token1"); code != 404 {
+		t.Fatalf("unexpected status for stopped responder: %d", code)
+	}
+
+	if code, _ := get("token2"); code != 200 {
+		t.Fatalf("unexpected status for running responder: %d", code)
+	}
+
+	r2.Stop()
+	httpListenersMutex.Lock()
+	_, running := httpListeners[addr]
+	httpListenersMutex.Unlock()
+	if running {
+		t.Fatalf("listener not stopped")
+	}
+}
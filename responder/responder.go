@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/hlandau/xlog"
+	"time"
 )
 
 // Log site.
@@ -50,9 +51,9 @@ type Config struct {
 	AccountKey crypto.PrivateKey // The account private key.
 	Token      string            // The challenge token.
 
-	// "http-01", "proofOfPossession": The hostname being verified. May be used
-	// for pre-initiation self-testing. Optional. Required for
-	// proofOfPossession.
+	// "http-01", "tls-alpn-01", "proofOfPossession": The hostname being
+	// verified. May be used for pre-initiation self-testing. Optional. Required
+	// for tls-alpn-01 and proofOfPossession.
 	Hostname string
 
 	// "proofOfPossession": The certificates which are acceptable. Each entry is
@@ -85,6 +86,26 @@ type ChallengeConfig struct {
 	// If not specified, proofOfPossession challenges always fail.
 	PriorKeyFunc PriorKeyFunc
 
+	// "dns-01": If set, the DNS responder installs challenge records itself
+	// using RFC 2136 dynamic updates rather than invoking hooks. Optional.
+	RFC2136 *RFC2136Config
+
+	// "dns-01": How long to wait for the challenge record to be served by all
+	// of the zone's authoritative nameservers before giving up. If zero,
+	// DefaultDNSPropagationTimeout is used. If negative, do not wait.
+	DNSPropagationTimeout time.Duration
+
+	// "dns-01": If set, the challenge record for a hostname is placed at the
+	// hostname under this zone, e.g. "example.com.acme.example.net" for zone
+	// "acme.example.net", instead of following any CNAME at _acme-challenge.
+	DNSDelegationZone string
+
+	// "dns-01": If set, the DNS responder answers DNS queries for the
+	// challenge record itself, acting as the authoritative nameserver for a
+	// zone into which the challenge has been delegated. Takes precedence over
+	// RFC2136. Optional.
+	DNSServer *DNSServerConfig
+
 	StartHookFunc HookFunc
 	StopHookFunc  HookFunc
 }
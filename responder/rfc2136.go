@@ -0,0 +1,112 @@
+package responder
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+// Settings for installing dns-01 challenge records by sending RFC 2136
+// dynamic updates to a primary nameserver.
+type RFC2136Config struct {
+	Server        string // Primary nameserver, "host" or "host:port".
+	Zone          string // Zone to update. Optional; determined by querying Server.
+	TSIGKeyName   string // Name of the TSIG key. If empty, updates are not signed.
+	TSIGAlgorithm string // e.g. "hmac-sha256" (the default).
+	TSIGSecret    string // Base64-encoded TSIG secret.
+}
+
+// TTL of challenge records installed by RFC 2136 update.
+const rfc2136TTL = 60
+
+// Returns the address of the primary nameserver, adding the default port if
+// necessary.
+func (c *RFC2136Config) serverAddr() string {
+	if _, _, err := net.SplitHostPort(c.Server); err == nil {
+		return c.Server
+	}
+
+	return net.JoinHostPort(strings.Trim(c.Server, "[]"), "53")
+}
+
+// Returns the zone to be updated in order to change records at fqdn. If no
+// zone is configured, zoneHint is used if set; otherwise the zone is looked
+// up.
+func (c *RFC2136Config) zone(fqdn, zoneHint string) (string, error) {
+	switch {
+	case c.Zone != "":
+		return dns.Fqdn(c.Zone), nil
+	case zoneHint != "":
+		return zoneHint, nil
+	default:
+		return findZone(c.serverAddr(), fqdn)
+	}
+}
+
+// Sends an update message to the primary nameserver, signing it if a TSIG key
+// is configured.
+func (c *RFC2136Config) update(m *dns.Msg) error {
+	cl := &dns.Client{}
+	if c.TSIGKeyName != "" {
+		keyName := dns.Fqdn(strings.ToLower(c.TSIGKeyName))
+		algorithm := dns.HmacSHA256
+		if c.TSIGAlgorithm != "" {
+			algorithm = dns.Fqdn(strings.ToLower(c.TSIGAlgorithm))
+		}
+
+		cl.TsigSecret = map[string]string{keyName: c.TSIGSecret}
+		m.SetTsig(keyName, algorithm, 300, time.Now().Unix())
+	}
+
+	r, _, err := cl.Exchange(m, c.serverAddr())
+	if err != nil {
+		return err
+	}
+
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("DNS update for zone %q refused by %s: %s", m.Question[0].Name, c.Server, dns.RcodeToString[r.Rcode])
+	}
+
+	return nil
+}
+
+func challengeTXT(fqdn, value string) *dns.TXT {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   fqdn,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    rfc2136TTL,
+		},
+		Txt: []string{value},
+	}
+}
+
+// Adds a TXT record with the given value at fqdn. Returns the zone updated.
+func (c *RFC2136Config) install(fqdn, value, zoneHint string) (string, error) {
+	zone, err := c.zone(fqdn, zoneHint)
+	if err != nil {
+		return "", err
+	}
+
+	m := &dns.Msg{}
+	m.SetUpdate(zone)
+	m.Insert([]dns.RR{challengeTXT(fqdn, value)})
+	err = c.update(m)
+	if err != nil {
+		return "", err
+	}
+
+	return zone, nil
+}
+
+// Removes the TXT record with the given value at fqdn. Any other TXT records
+// at fqdn are left alone.
+func (c *RFC2136Config) remove(zone, fqdn, value string) error {
+	m := &dns.Msg{}
+	m.SetUpdate(zone)
+	m.Remove([]dns.RR{challengeTXT(fqdn, value)})
+	return c.update(m)
+}
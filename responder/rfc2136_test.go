@@ -0,0 +1,75 @@
+package responder
+
+import (
+	"testing"
+)
+
+func TestRFC2136(t *testing.T) {
+	ts, addr, closeFunc := startTestDNSServer(t)
+	defer closeFunc()
+
+	cfg := &RFC2136Config{
+		Server:      addr,
+		TSIGKeyName: "acme-key",
+		TSIGSecret:  testTSIGSecret,
+	}
+
+	r := &dnsResponder{
+		rcfg: Config{
+			Hostname:        "www.example.com",
+			ChallengeConfig: ChallengeConfig{RFC2136: cfg},
+		},
+		dnsString: "value",
+	}
+
+	err := r.Start()
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	if r.zone != "example.com." {
+		t.Fatalf("unexpected zone: %q", r.zone)
+	}
+
+	if v := ts.txt("_acme-challenge.www.example.com."); len(v) != 1 || v[0] != "value" {
+		t.Fatalf("record not installed: %v", v)
+	}
+
+	err = r.Stop()
+	if err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	if v := ts.txt("_acme-challenge.www.example.com."); len(v) != 0 {
+		t.Fatalf("record not removed: %v", v)
+	}
+
+	// The record is placed at the target of any CNAME.
+	ts.mu.Lock()
+	ts.cnames["_acme-challenge.www.example.com."] = "www.acme.example.com."
+	ts.mu.Unlock()
+
+	err = r.Start()
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	if v := ts.txt("www.acme.example.com."); len(v) != 1 || v[0] != "value" {
+		t.Fatalf("record not installed at CNAME target: %v", v)
+	}
+
+	r.Stop()
+
+	// Unsigned updates are refused.
+	cfg.TSIGKeyName = ""
+	err = r.Start()
+	if err == nil {
+		t.Fatalf("unsigned update unexpectedly succeeded")
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.updates != 4 {
+		t.Fatalf("unexpected number of updates: %d", ts.updates)
+	}
+}
@@ -0,0 +1,352 @@
+package responder
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/hlandau/acme/acmeapi/acmeutils"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ALPN protocol name on which TLS-ALPN challenges are served.
+const ACMETLSProtocol = "acme-tls/1"
+
+type TLSALPNChallengeInfo struct {
+	Hostname    string // hostname or IP address; must appear in certificate
+	Certificate []byte
+	Key         crypto.PrivateKey
+}
+
+type tlsalpnResponder struct {
+	requestDetectedChan chan struct{}
+	notifySupported     bool
+	rcfg                Config
+
+	tlsCert         *tls.Certificate
+	serverName      string // SNI used when validating.
+	listening       bool
+	validation      []byte
+	identifierValue []byte
+	cert            []byte
+	privateKey      crypto.PrivateKey
+}
+
+func newTLSALPNResponder(rcfg Config) (Responder, error) {
+	if rcfg.Hostname == "" {
+		return nil, fmt.Errorf("hostname is required for tls-alpn-01")
+	}
+
+	r := &tlsalpnResponder{
+		rcfg:                rcfg,
+		requestDetectedChan: make(chan struct{}, 1),
+		notifySupported:     true,
+		serverName:          strings.ToLower(rcfg.Hostname),
+	}
+
+	if ip := net.ParseIP(rcfg.Hostname); ip != nil {
+		r.serverName = reverseDNSName(ip)
+	}
+
+	// acmeIdentifier extension value.
+	var err error
+	r.identifierValue, err = acmeutils.TLSALPNIdentifierValue(rcfg.AccountKey, rcfg.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Certificate and private key.
+	r.cert, r.privateKey, err = acmeutils.CreateTLSALPNCertificate(rcfg.Hostname, r.identifierValue)
+	if err != nil {
+		return nil, err
+	}
+
+	r.tlsCert = &tls.Certificate{
+		Certificate: [][]byte{r.cert},
+		PrivateKey:  r.privateKey,
+	}
+
+	// Validation response.
+	r.validation, err = acmeutils.ChallengeResponseJSON(rcfg.AccountKey, rcfg.Token, "tls-alpn-01")
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Internal use only. This can be used to change the port the TLS-ALPN
+// responder listens on for development purposes.
+var InternalTLSALPNPort uint16 = 443
+
+func (r *tlsalpnResponder) Start() error {
+	listenErr := r.startListener()
+	log.Debuge(listenErr, "failed to start TLS-ALPN listener")
+
+	// Try hooks.
+	var hookErr error
+	if startFunc := r.rcfg.ChallengeConfig.StartHookFunc; startFunc != nil {
+		hookErr = startFunc(r.challengeInfo())
+		log.Debuge(hookErr, "failed to install TLS-ALPN challenge via hook")
+	}
+
+	if listenErr != nil && hookErr != nil {
+		return listenErr
+	}
+
+	err := r.selfTest()
+	if err != nil {
+		log.Debuge(err, "tls-alpn-01 self-test failed")
+		r.Stop()
+		return err
+	}
+
+	return nil
+}
+
+func (r *tlsalpnResponder) challengeInfo() *TLSALPNChallengeInfo {
+	return &TLSALPNChallengeInfo{
+		Hostname:    r.rcfg.Hostname,
+		Certificate: r.cert,
+		Key:         r.privateKey,
+	}
+}
+
+// How long a client connecting to the TLS-ALPN listener has to complete the
+// handshake.
+var tlsalpnHandshakeTimeout = 10 * time.Second
+
+// The TLS-ALPN listener is shared between responders, so that several
+// challenges can be completed at once. The certificate served is chosen by
+// SNI.
+var (
+	tlsalpnMutex      sync.Mutex
+	tlsalpnListener   net.Listener
+	tlsalpnStopped    chan struct{}
+	tlsalpnResponders = map[string]*tlsalpnResponder{} // by SNI name
+)
+
+func getTLSALPNResponder(serverName string) *tlsalpnResponder {
+	tlsalpnMutex.Lock()
+	defer tlsalpnMutex.Unlock()
+
+	return tlsalpnResponders[strings.ToLower(serverName)]
+}
+
+func tlsalpnGetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r := getTLSALPNResponder(hello.ServerName)
+	if r == nil {
+		return nil, fmt.Errorf("no TLS-ALPN challenge for %q", hello.ServerName)
+	}
+
+	r.notify()
+	return r.tlsCert, nil
+}
+
+func (r *tlsalpnResponder) startListener() error {
+	tlsalpnMutex.Lock()
+	defer tlsalpnMutex.Unlock()
+
+	if _, ok := tlsalpnResponders[r.serverName]; ok {
+		return fmt.Errorf("a TLS-ALPN challenge for %q is already in progress", r.rcfg.Hostname)
+	}
+
+	if tlsalpnListener == nil {
+		l, err := tls.Listen("tcp", fmt.Sprintf(":%d", InternalTLSALPNPort), &tls.Config{
+			GetCertificate: tlsalpnGetCertificate,
+			NextProtos:     []string{ACMETLSProtocol},
+		})
+		if err != nil {
+			return err
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			var wg sync.WaitGroup
+			defer close(stopped)
+			defer wg.Wait()
+			defer l.Close()
+
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					break
+				}
+
+				// Handshake concurrently, so that a client which is slow to
+				// complete the handshake does not hold up the others.
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer c.Close()
+
+					c.SetDeadline(time.Now().Add(tlsalpnHandshakeTimeout))
+					c.(*tls.Conn).Handshake() // Ignore error
+				}()
+			}
+		}()
+
+		tlsalpnListener = l
+		tlsalpnStopped = stopped
+	}
+
+	tlsalpnResponders[r.serverName] = r
+	r.listening = true
+	return nil
+}
+
+func (r *tlsalpnResponder) stopListener() {
+	tlsalpnMutex.Lock()
+	delete(tlsalpnResponders, r.serverName)
+	r.listening = false
+
+	var stopped chan struct{}
+	if len(tlsalpnResponders) == 0 {
+		tlsalpnListener.Close()
+		tlsalpnListener = nil
+		stopped = tlsalpnStopped
+	}
+	tlsalpnMutex.Unlock()
+
+	// Wait outside the lock, since handshakes in progress may need it.
+	if stopped != nil {
+		<-stopped
+	}
+}
+
+func (r *tlsalpnResponder) Stop() error {
+	if r.listening {
+		r.stopListener()
+	}
+
+	// Try hooks.
+	if stopFunc := r.rcfg.ChallengeConfig.StopHookFunc; stopFunc != nil {
+		err := stopFunc(r.challengeInfo())
+		log.Errore(err, "failed to uninstall TLS-ALPN challenge via hook")
+	}
+
+	return nil
+}
+
+// Returns the name specified via SNI when validating an IP address (RFC 8738),
+// e.g. "1.2.0.192.in-addr.arpa".
+func reverseDNSName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	const hexDigits = "0123456789abcdef"
+	b := make([]byte, 0, 4*len(ip)+len("ip6.arpa"))
+	for i := len(ip) - 1; i >= 0; i-- {
+		b = append(b, hexDigits[ip[i]&0xF], '.', hexDigits[ip[i]>>4], '.')
+	}
+
+	return string(append(b, "ip6.arpa"...))
+}
+
+func (r *tlsalpnResponder) selfTest() error {
+	ip := net.ParseIP(r.rcfg.Hostname)
+	conn, err := tls.Dial("tcp", net.JoinHostPort(r.rcfg.Hostname, fmt.Sprintf("%d", InternalTLSALPNPort)), &tls.Config{
+		ServerName:         r.serverName,
+		NextProtos:         []string{ACMETLSProtocol},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	err = conn.Handshake()
+	if err != nil {
+		return err
+	}
+
+	cs := conn.ConnectionState()
+	if cs.NegotiatedProtocol != ACMETLSProtocol {
+		return fmt.Errorf("when doing self-test, negotiated protocol %q, expected %q", cs.NegotiatedProtocol, ACMETLSProtocol)
+	}
+
+	certs := cs.PeerCertificates
+	if len(certs) != 1 {
+		return fmt.Errorf("when doing self-test, got %d certificates, expected 1", len(certs))
+	}
+
+	if ip != nil {
+		if !containsIP(ip, certs[0].IPAddresses) {
+			return fmt.Errorf("certificate does not contain expected IP address")
+		}
+	} else if !containsHostname(r.rcfg.Hostname, certs[0].DNSNames) {
+		return fmt.Errorf("certificate does not contain expected hostname")
+	}
+
+	found := false
+	for _, e := range certs[0].Extensions {
+		if e.Id.Equal(acmeutils.ACMEIdentifierOID) && e.Critical && bytes.Equal(e.Value, r.identifierValue) {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("certificate does not contain expected acmeIdentifier extension")
+	}
+
+	// If we detected a request, we support notifications, otherwise we don't.
+	select {
+	case <-r.requestDetectedChan:
+	default:
+		r.notifySupported = false
+	}
+
+	// Drain the notification channel in case we somehow made several requests.
+L:
+	for {
+		select {
+		case <-r.requestDetectedChan:
+		default:
+			break L
+		}
+	}
+
+	return nil
+}
+
+func containsIP(ip net.IP, ips []net.IP) bool {
+	for _, x := range ips {
+		if x.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *tlsalpnResponder) notify() {
+	select {
+	case r.requestDetectedChan <- struct{}{}:
+	default:
+	}
+}
+
+func (r *tlsalpnResponder) RequestDetectedChan() <-chan struct{} {
+	if !r.notifySupported {
+		return nil
+	}
+
+	return r.requestDetectedChan
+}
+
+func (r *tlsalpnResponder) Validation() json.RawMessage {
+	return json.RawMessage(r.validation)
+}
+
+func (r *tlsalpnResponder) ValidationSigningKey() crypto.PrivateKey {
+	return nil
+}
+
+func init() {
+	RegisterResponder("tls-alpn-01", newTLSALPNResponder)
+}
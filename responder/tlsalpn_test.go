@@ -0,0 +1,77 @@
+package responder
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTLSALPNStalledClient(t *testing.T) {
+	// Find a free port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	oldPort, oldTimeout := InternalTLSALPNPort, tlsalpnHandshakeTimeout
+	InternalTLSALPNPort, tlsalpnHandshakeTimeout = uint16(port), 2*time.Second
+	defer func() { InternalTLSALPNPort, tlsalpnHandshakeTimeout = oldPort, oldTimeout }()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := func(hostname string) Responder {
+		r, err := newTLSALPNResponder(Config{
+			AccountKey: key,
+			Token:      "token",
+			Hostname:   hostname,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = r.Start()
+		if err != nil {
+			t.Fatalf("start: %v", err)
+		}
+
+		return r
+	}
+
+	r1 := start("127.0.0.1")
+	defer r1.Stop()
+
+	// A client which never sends anything does not prevent the self-test of
+	// another responder sharing the listener from completing.
+	stalled, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	done := make(chan Responder)
+	go func() {
+		done <- start("localhost")
+	}()
+
+	select {
+	case r2 := <-done:
+		r2.Stop()
+	case <-time.After(tlsalpnHandshakeTimeout / 2):
+		t.Fatalf("self-test held up by stalled client")
+	}
+
+	// The stalled client is disconnected once the handshake times out.
+	stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = stalled.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || (ok && ne.Timeout()) {
+		t.Fatalf("stalled client not disconnected: %v", err)
+	}
+}
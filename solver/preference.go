@@ -80,11 +80,13 @@ func (p TypePreferencer) Copy() TypePreferencer {
 
 // PreferFast prefers fast types.
 var PreferFast = TypePreferencer{
-	"tls-sni-01": 1,
-	"http-01":    0,
+	"tls-alpn-01": 1,
+	"tls-sni-01":  1,
+	"http-01":     0,
 
-	// Disable DNS challenges for now. They're practically unusable and the Let's
-	// Encrypt live server doesn't support them at this time anyway.
+	// Try DNS challenges last. Unless the DNS responder can install records
+	// itself, they rely on hooks, which are slow and usually not configured.
+	// See PreferDNS.
 	"dns-01": -10,
 
 	// Avoid unless necessary. In future we might want to determine whether we
@@ -92,6 +94,26 @@ var PreferFast = TypePreferencer{
 	"proofOfPossession:": -40,
 }
 
+// PreferDNS is used when the DNS responder can install challenge records
+// itself. Since failing any one challenge invalidates an authorization, dns-01
+// must be tried first, or a name which can only be validated using DNS would
+// never get to try it.
+var PreferDNS = TypePreferencer{
+	"dns-01":      2,
+	"tls-alpn-01": 1,
+	"tls-sni-01":  1,
+	"http-01":     0,
+
+	"proofOfPossession:": -40,
+}
+
+// PreferIP is used for IP address identifiers, which can only be validated
+// using http-01 or tls-alpn-01 (RFC 8738).
+var PreferIP = TypePreferencer{
+	"tls-alpn-01": 1,
+	"http-01":     0,
+}
+
 // Determines the degree to which a challenge is preferred. Higher values are
 // more preferred. Any value <= NonviableThreshold will never be used.
 type Preferencer interface {
@@ -0,0 +1,38 @@
+package solver
+
+import (
+	"github.com/hlandau/acme/acmeapi"
+	"github.com/hlandau/acme/responder"
+	"testing"
+)
+
+func TestInitialPreference(t *testing.T) {
+	tests := []struct {
+		name     string
+		ccfg     responder.ChallengeConfig
+		ip       bool
+		expected string // type of the most preferred challenge
+	}{
+		{name: "default", expected: "tls-alpn-01"},
+		{name: "ip", ccfg: responder.ChallengeConfig{DNSDelegationZone: "acme.example.net"}, ip: true, expected: "tls-alpn-01"},
+		{name: "rfc2136", ccfg: responder.ChallengeConfig{RFC2136: &responder.RFC2136Config{}}, expected: "dns-01"},
+		{name: "dns-server", ccfg: responder.ChallengeConfig{DNSServer: &responder.DNSServerConfig{}}, expected: "dns-01"},
+		{name: "delegation-zone", ccfg: responder.ChallengeConfig{DNSDelegationZone: "acme.example.net"}, expected: "dns-01"},
+	}
+
+	for _, tt := range tests {
+		az := &acmeapi.Authorization{
+			Challenges: []*acmeapi.Challenge{
+				{Type: "http-01"},
+				{Type: "dns-01"},
+				{Type: "tls-alpn-01"},
+			},
+			Combinations: [][]int{{0}, {1}, {2}},
+		}
+
+		SortCombinations(az, initialPreference(tt.ccfg, tt.ip))
+		if len(az.Combinations) == 0 || az.Challenges[az.Combinations[0][0]].Type != tt.expected {
+			t.Errorf("%s: unexpected combinations: %v", tt.name, az.Combinations)
+		}
+	}
+}
@@ -12,13 +12,20 @@ import (
 // the client account if it does not already exist.
 //
 // The interactor is used to prompt for terms of service agreement, if
-// agreement has not already been obtained. An e. mail address is prompted for.
-func AssistedUpsertRegistration(cl *acmeapi.Client, interactor interaction.Interactor, ctx context.Context) error {
+// agreement has not already been obtained. An e. mail address is prompted for
+// unless contact URIs have already been specified.
+//
+// If reg is not nil, it is used as the basis for the registration; this allows
+// external account binding credentials to be specified. It is updated with
+// the resulting registration.
+func AssistedUpsertRegistration(cl *acmeapi.Client, reg *acmeapi.Registration, interactor interaction.Interactor, ctx context.Context) error {
 	interactor = defaultInteraction(interactor)
 
 	email := ""
 
-	reg := &acmeapi.Registration{}
+	if reg == nil {
+		reg = &acmeapi.Registration{}
+	}
 	agreementURIs := map[string]struct{}{}
 	for {
 		err := cl.AgreeRegistration(reg, agreementURIs, ctx)
@@ -41,7 +48,7 @@ Do you agree to the terms of service set out in the above document?`, e.URI),
 					return err
 				}
 				if !res.Cancelled {
-					if email == "" {
+					if email == "" && len(reg.ContactURIs) == 0 {
 						email, err = getEmail(interactor)
 						if err != nil {
 							return err
@@ -9,6 +9,7 @@ import (
 	denet "github.com/hlandau/goutils/net"
 	"github.com/hlandau/xlog"
 	"golang.org/x/net/context"
+	"net"
 	"time"
 )
 
@@ -36,7 +37,7 @@ func Authorize(c *acmeapi.Client, dnsName string, ccfg responder.ChallengeConfig
 		c:       c,
 		dnsName: dnsName,
 		ctx:     ctx,
-		pref:    PreferFast.Copy(),
+		pref:    initialPreference(ccfg, net.ParseIP(dnsName) != nil),
 		ccfg:    ccfg,
 	}
 
@@ -84,6 +85,62 @@ func (as *authState) authorize() (az *acmeapi.Authorization, fatal bool, err err
 	return nil, true, ErrFailedAllCombinations
 }
 
+// Attempts to complete an existing authorization, such as one belonging to an
+// order, using the given client. The authorization must already have been
+// loaded. Unlike Authorize, a replacement authorization cannot be created if
+// the authorization is invalidated, so in that case this fails immediately.
+// On success, the authorization is reloaded.
+func CompleteAuthorization(c *acmeapi.Client, az *acmeapi.Authorization, ccfg responder.ChallengeConfig, ctx context.Context) error {
+	if az.Status == acmeapi.StatusValid {
+		return nil
+	}
+
+	as := authState{
+		c:       c,
+		dnsName: az.Identifier.Value,
+		ctx:     ctx,
+		pref:    initialPreference(ccfg, az.Identifier.Type == "ip"),
+		ccfg:    ccfg,
+	}
+
+	if az.Wildcard {
+		// Only dns-01 can prove control of a wildcard name.
+		as.pref = TypePreferencer{"dns-01": 0}
+	}
+
+	SortCombinations(az, as.pref)
+
+	for _, com := range az.Combinations {
+		invalidated, err := as.attemptCombination(az, com)
+		if err != nil {
+			if invalidated {
+				return err
+			}
+
+			continue
+		}
+
+		return c.LoadAuthorization(az, ctx)
+	}
+
+	return ErrFailedAllCombinations
+}
+
+// Returns the challenge type preferences for an identifier which is an IP
+// address if ip is set, or a non-wildcard hostname otherwise. dns-01 is
+// preferred for hostnames if the DNS responder is configured to install
+// challenge records itself or to place them in a delegated zone.
+func initialPreference(ccfg responder.ChallengeConfig, ip bool) TypePreferencer {
+	switch {
+	case ip:
+		return PreferIP.Copy()
+	case ccfg.RFC2136 != nil || ccfg.DNSServer != nil || ccfg.DNSDelegationZone != "":
+		return PreferDNS.Copy()
+	default:
+		return PreferFast.Copy()
+	}
+}
+
 func (as *authState) haveAnyViableCombinations(az *acmeapi.Authorization) bool {
 	for _, com := range az.Combinations {
 		for _, i := range com {
@@ -182,6 +239,10 @@ func CompleteChallenge(c *acmeapi.Client, ch *acmeapi.Challenge, dnsName string,
 	}
 
 	if ch.Status != "valid" {
+		if ch.Error != nil {
+			return true, fmt.Errorf("challenge failed with status %#v: %w", ch.Status, ch.Error)
+		}
+
 		return true, fmt.Errorf("challenge failed with status %#v", ch.Status)
 	}
 
@@ -12,7 +12,7 @@ type Store interface {
 	Path() string  // ACME state directory path.
 
 	// These methods find an object by its identifier. Returns nil if the object
-	// is not found.
+	// is not found. AccountByDirectoryURL never returns a retired account.
 	AccountByID(accountID string) *Account
 	AccountByDirectoryURL(directoryURL string) *Account
 	CertificateByID(certificateID string) *Certificate
@@ -20,6 +20,10 @@ type Store interface {
 	TargetByFilename(filename string) *Target
 
 	DefaultTarget() *Target // Returns the default target.
+
+	// Returns the record of failed attempts to obtain a certificate for the
+	// target with the given filename, or nil if there is none.
+	TargetFailure(filename string) *TargetFailure
 	PreferredCertificateForHostname(hostname string) (*Certificate, error)
 	VisitPreferredCertificates(func(hostname string, c *Certificate) error) error
 
@@ -34,9 +38,21 @@ type Store interface {
 	SaveTarget(*Target) error           // Saves a target.
 	RemoveTarget(filename string) error // Remove a target from the database.
 
+	SaveTargetFailure(*TargetFailure) error    // Saves a target failure record.
+	RemoveTargetFailure(filename string) error // Removes any failure record for a target.
+
 	SaveCertificate(*Certificate) error // Saves certificate information.
 	SaveAccount(*Account) error         // Save account information.
 
+	// Moves an account to a new private key, and hence a new account ID.
+	// commit is called once the account has been staged under its new ID and
+	// should change the key with the server. The account is only moved if
+	// commit succeeds. If commit fails other than because the server rejected
+	// the change, the server may have changed the key anyway, so a persistent
+	// store keeps the staged account and installs it, retiring the old
+	// account, when it is next opened. Returns the account under its new ID.
+	RekeyAccount(a *Account, newKey crypto.PrivateKey, commit func() error) (*Account, error)
+
 	// Erase a whole certificate directory including URL, certificates, etc.
 	RemoveCertificate(certificateID string) error
 	// Erase a private key directory.
@@ -49,6 +65,16 @@ type Store interface {
 	SetPreferredCertificateForHostname(hostname string, c *Certificate) error
 
 	WriteMiscellaneousConfFile(filename string, data []byte) error
+
+	// Acquires an exclusive lock on the state directory, preventing other
+	// processes which also lock it from modifying it until Unlock or Close is
+	// called. If wait is true, waits for the lock; otherwise, returns ErrLocked
+	// if it is held by another process.
+	Lock(wait bool) error
+	Unlock() error
 }
 
 var StopVisiting = errors.New("[stop visiting]")
+
+// Returned by Store.Lock if the state directory is locked by another process.
+var ErrLocked = errors.New("state directory is in use by another process")
@@ -2,50 +2,8 @@ package storage
 
 import (
 	"crypto/elliptic"
-	"github.com/hlandau/acme/fdb"
-	"strings"
 )
 
-// Legacy Configuration
-
-func (s *fdbStore) loadWebrootPaths() {
-	if len(s.defaultTarget.Request.Challenge.WebrootPaths) != 0 {
-		// Path list in default target file takes precedence.
-		return
-	}
-
-	webrootPath, _ := fdb.String(s.db.Collection("conf").Open("webroot-path")) // ignore errors
-	webrootPath = strings.TrimSpace(webrootPath)
-	webrootPaths := strings.Split(webrootPath, "\n")
-	for i := range webrootPaths {
-		webrootPaths[i] = strings.TrimSpace(webrootPaths[i])
-	}
-
-	if len(webrootPaths) == 1 && webrootPaths[0] == "" {
-		webrootPaths = nil
-	}
-
-	s.defaultTarget.Request.Challenge.WebrootPaths = webrootPaths
-}
-
-func (s *fdbStore) loadRSAKeySize() {
-	if s.defaultTarget.Request.Key.RSASize != 0 {
-		// setting in default target file takes precedence
-		return
-	}
-
-	n, err := fdb.Uint(s.db.Collection("conf"), "rsa-key-size", 31)
-	if err != nil {
-		return
-	}
-
-	s.defaultTarget.Request.Key.RSASize = int(n)
-
-	if nn := clampRSAKeySize(int(n)); nn != int(n) {
-		log.Warnf("An RSA key size of %d is not supported; must have %d <= size <= %d; clamping at %d", n, minRSASize, maxRSASize, nn)
-	}
-}
-
 // Key Parameters
 
 const (
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Copies the contents of one store to another, for migrating between store
+// implementations. Objects already in dst are kept unless src has an object
+// with the same identifier, which replaces them. dst is reloaded.
+//
+// Targets are saved with any settings inherited from the default target made
+// explicit, as happens when a target is modified.
+func Copy(dst, src Store) error {
+	err := src.VisitKeys(func(k *Key) error {
+		_, err := dst.ImportKey(k.PrivateKey)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = src.VisitAccounts(func(a *Account) error {
+		_, err := dst.ImportAccount(a.DirectoryURL, a.PrivateKey)
+		if err != nil {
+			return err
+		}
+
+		na := *a
+		return dst.SaveAccount(&na)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = src.VisitCertificates(func(c *Certificate) error {
+		nc, err := dst.ImportCertificate(c.URL)
+		if err != nil {
+			return err
+		}
+
+		nc.RevocationDesired = c.RevocationDesired
+		nc.Revoked = c.Revoked
+		nc.Certificates = c.Certificates
+		nc.Cached = c.Cached
+		nc.RenewalInfo = c.RenewalInfo
+		return dst.SaveCertificate(nc)
+	})
+	if err != nil {
+		return err
+	}
+
+	dt := dst.DefaultTarget()
+	*dt = *src.DefaultTarget()
+	err = dst.SaveTarget(dt)
+	if err != nil {
+		return err
+	}
+
+	err = src.VisitTargets(func(t *Target) error {
+		nt := *t
+		err := dst.SaveTarget(&nt)
+		if err != nil {
+			return err
+		}
+
+		if tf := src.TargetFailure(t.Filename); tf != nil {
+			return dst.SaveTargetFailure(tf)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Reload so that certificates are associated with their keys.
+	err = dst.Reload()
+	if err != nil {
+		return err
+	}
+
+	err = src.VisitPreferredCertificates(func(hostname string, c *Certificate) error {
+		nc := dst.CertificateByID(c.ID())
+		if nc == nil {
+			return fmt.Errorf("certificate not copied: %v", c)
+		}
+
+		return dst.SetPreferredCertificateForHostname(hostname, nc)
+	})
+	if err != nil {
+		return err
+	}
+
+	return dst.Reload()
+}
+
+// Writes the preferred certificate for each hostname, with its private key,
+// to a state directory, so that daemons can find it at
+// "live/(hostname)/{cert,chain,fullchain,privkey}" in the usual way. This is
+// only needed for stores which are not state directories. Returns the
+// hostnames whose preferred certificate changed, in order.
+//
+// Certificates which are no longer preferred for any hostname are left in
+// place until culled.
+func Materialize(s Store, cfg FDBConfig) ([]string, error) {
+	d, err := NewFDBWithConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	err = d.Lock(true)
+	if err != nil {
+		return nil, err
+	}
+
+	preferred := map[string]string{} // key: hostname, value: certificate ID
+	err = s.VisitPreferredCertificates(func(hostname string, c *Certificate) error {
+		if !c.Cached || c.Key == nil {
+			log.Warnf("cannot materialize %v for %s, as its certificate or private key is not available", c, hostname)
+			return nil
+		}
+
+		_, err := d.ImportKey(c.Key.PrivateKey)
+		if err != nil {
+			return err
+		}
+
+		dc, err := d.ImportCertificate(c.URL)
+		if err != nil {
+			return err
+		}
+
+		if !dc.Cached {
+			dc.Certificates = c.Certificates
+			dc.Cached = true
+			err = d.SaveCertificate(dc)
+			if err != nil {
+				return err
+			}
+		}
+
+		preferred[hostname] = c.ID()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Reload so that certificates are linked to their keys.
+	err = d.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	var updated []string
+	for hostname, certID := range preferred {
+		if prev, err := d.PreferredCertificateForHostname(hostname); err == nil && prev.ID() == certID {
+			continue
+		}
+
+		err = d.SetPreferredCertificateForHostname(hostname, d.CertificateByID(certID))
+		if err != nil {
+			return nil, err
+		}
+
+		updated = append(updated, hostname)
+	}
+
+	sort.Strings(updated)
+	return updated, nil
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"github.com/hlandau/acme/acmeapi/acmeutils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyAndMaterialize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, err := NewMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pk := testPrivateKey(t)
+	_, err = src.ImportKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := src.ImportAccount("https://ca.test/directory", testPrivateKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Authorizations = map[string]*Authorization{
+		"example.com": {
+			Name:    "example.com",
+			URL:     "https://ca.test/authz/1",
+			Expires: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+		},
+	}
+
+	c, err := src.ImportCertificate("https://ca.test/cert/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der := testCertificate(t, pk, "example.com")
+	c.Certificates = [][]byte{der}
+	err = src.SaveTarget(&Target{
+		Filename: "example.com",
+		Satisfy:  TargetSatisfy{Names: []string{"example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = src.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = src.SetPreferredCertificateForHostname("example.com", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Copy to a database and back to a state directory.
+	db, err := NewBolt(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Copy(db, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fdbDir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(fdbDir)
+
+	d, err := NewFDB(fdbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Copy(d, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []Store{db, d} {
+		az := s.AccountByID(a.ID()).Authorizations["example.com"]
+		if az == nil || az.URL != "https://ca.test/authz/1" || !az.Expires.Equal(a.Authorizations["example.com"].Expires) {
+			t.Fatalf("authorization not copied: %#v", az)
+		}
+
+		if s.TargetByFilename("example.com") == nil {
+			t.Fatalf("target not copied")
+		}
+
+		pc, err := s.PreferredCertificateForHostname("example.com")
+		if err != nil || pc.ID() != c.ID() || pc.Key == nil {
+			t.Fatalf("preferred certificate not copied: %v %v", pc, err)
+		}
+	}
+	d.Close()
+
+	// Materialize the database into its state directory.
+	updated, err := Materialize(db, FDBConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updated) != 1 || updated[0] != "example.com" {
+		t.Fatalf("unexpected updated hostnames: %v", updated)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "live", "example.com", "privkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := acmeutils.LoadPrivateKey(b); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "live", "example.com", "fullchain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := acmeutils.LoadCertificates(b)
+	if err != nil || len(certs) != 1 || string(certs[0]) != string(der) {
+		t.Fatalf("unexpected materialized certificate: %v", err)
+	}
+
+	// The database is not loosened by the state directory's permissions.
+	fi, err := os.Stat(filepath.Join(dir, BoltFilename))
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("database has wrong permissions: %v", err)
+	}
+
+	// Nothing changes if materialized again.
+	updated, err = Materialize(db, FDBConfig{Path: dir})
+	if err != nil || len(updated) != 0 {
+		t.Fatalf("unexpected updated hostnames: %v %v", updated, err)
+	}
+
+	db.Close()
+}
@@ -0,0 +1,532 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"github.com/hlandau/acme/acmeapi"
+	"github.com/hlandau/acme/acmeapi/acmeutils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Integrity Checking
+
+// Kinds of problem found by CheckFDB.
+const (
+	// A file left in "tmp" by an interrupted write.
+	ProblemTmp = "tmp"
+
+	// A symlink whose target does not exist.
+	ProblemDanglingLink = "dangling-link"
+
+	// An entry in "live" which does not link to a downloaded certificate.
+	ProblemLive = "live"
+
+	// A certificate whose URL is missing, invalid or does not match its ID.
+	ProblemCertificateURL = "certificate-url"
+
+	// A certificate whose "cert", "chain" and "fullchain" files are missing,
+	// unreadable or disagree with one another.
+	ProblemChain = "chain"
+
+	// A certificate whose "privkey" link does not point to its private key.
+	ProblemPrivateKeyLink = "privkey-link"
+
+	// An authorization whose expiry time is missing or cannot be parsed.
+	ProblemAuthorization = "authorization"
+)
+
+// A problem found in a state directory by CheckFDB.
+type FDBProblem struct {
+	// The kind of problem. One of the Problem constants.
+	Kind string
+
+	// The path of the affected file or directory, relative to the state
+	// directory.
+	Path string
+
+	// Describes the problem.
+	Description string
+
+	// Describes how the problem can be repaired, or "" if it cannot be
+	// repaired safely.
+	Repair string
+
+	// True if the problem was repaired.
+	Repaired bool
+
+	repair func(s *fdbStore) error
+}
+
+func (p *FDBProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Description)
+}
+
+// Checks the state directory for inconsistencies. If repair is true, the
+// problems which can be repaired safely are repaired while holding the lock
+// on the state directory, and the state directory is then loaded to make sure
+// it is usable.
+//
+// The state directory is examined before it is opened, since opening it
+// removes dangling links and the contents of "tmp", and would otherwise hide
+// those problems. If repair is false, nothing is changed.
+func CheckFDB(cfg FDBConfig, repair bool) ([]*FDBProblem, error) {
+	if cfg.Path == "" {
+		cfg.Path = RecommendedPath
+	}
+
+	_, err := checkFDBSchemaVersion(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &fdbChecker{path: cfg.Path}
+	err = c.check()
+	if err != nil {
+		return nil, err
+	}
+
+	if !repair {
+		return c.problems, nil
+	}
+
+	s, err := openFDB(cfg)
+	if err != nil {
+		return c.problems, err
+	}
+	defer s.Close()
+
+	err = s.Lock(true)
+	if err != nil {
+		return c.problems, err
+	}
+	defer s.Unlock()
+
+	var merr MultiError
+	for _, p := range c.problems {
+		if p.repair == nil {
+			continue
+		}
+
+		err := p.repair(s)
+		if err != nil {
+			merr = append(merr, fmt.Errorf("cannot repair %v: %v", p, err))
+			continue
+		}
+
+		p.Repaired = true
+	}
+
+	err = s.Reload()
+	if err != nil {
+		merr = append(merr, err)
+	}
+
+	if len(merr) > 0 {
+		return c.problems, merr
+	}
+
+	return c.problems, nil
+}
+
+// Examines a state directory without opening it, recording problems.
+type fdbChecker struct {
+	path     string
+	problems []*FDBProblem
+}
+
+func (c *fdbChecker) check() error {
+	for _, f := range []func() error{
+		c.checkTmp,
+		c.checkLinks,
+		c.checkLive,
+		c.checkCerts,
+		c.checkAuthorizations,
+	} {
+		err := f()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *fdbChecker) add(kind, relpath, description, repair string, f func(s *fdbStore) error) {
+	c.problems = append(c.problems, &FDBProblem{
+		Kind:        kind,
+		Path:        relpath,
+		Description: description,
+		Repair:      repair,
+		repair:      f,
+	})
+}
+
+// Lists the entries in the directory at reldir, which is relative to the
+// state directory. Hidden entries are omitted unless all is true.
+func (c *fdbChecker) list(reldir string, all bool) ([]string, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(c.path, reldir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range fis {
+		if all || !strings.HasPrefix(fi.Name(), ".") {
+			names = append(names, fi.Name())
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Reads the file at relpath, which is relative to the state directory,
+// following symlinks. Returns nil if the file does not exist.
+func (c *fdbChecker) readFile(relpath string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(c.path, relpath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return b, err
+}
+
+// Returns true iff the file at relpath exists, following symlinks.
+func (c *fdbChecker) exists(relpath string) bool {
+	_, err := os.Stat(filepath.Join(c.path, relpath))
+	return err == nil
+}
+
+// Returns the target of the symlink at relpath, relative to the state
+// directory.
+func (c *fdbChecker) readLink(relpath string) (string, error) {
+	l, err := os.Readlink(filepath.Join(c.path, relpath))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(filepath.Dir(relpath), l), nil
+}
+
+func (c *fdbChecker) checkTmp() error {
+	names, err := c.list("tmp", true)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		name := name
+		c.add(ProblemTmp, filepath.Join("tmp", name), "left over from an interrupted write", "remove it",
+			func(s *fdbStore) error {
+				// Opening the state directory has usually done this already.
+				return s.db.Collection("tmp").Delete(name)
+			})
+	}
+
+	return nil
+}
+
+// Finds dangling symlinks anywhere in the state directory, except the
+// "privkey" links of certificates, which checkCerts examines.
+func (c *fdbChecker) checkLinks() error {
+	return filepath.Walk(c.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relpath, err := filepath.Rel(c.path, path)
+		if err != nil {
+			return err
+		}
+
+		if relpath == "tmp" && info.IsDir() {
+			return filepath.SkipDir
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		if m, _ := filepath.Match("certs/*/privkey", relpath); m {
+			return nil
+		}
+
+		if c.exists(relpath) {
+			return nil
+		}
+
+		target, _ := os.Readlink(path)
+		c.add(ProblemDanglingLink, relpath, fmt.Sprintf("links to %q, which does not exist", target), "remove it",
+			func(s *fdbStore) error {
+				return s.db.Collection(filepath.Dir(relpath)).Delete(filepath.Base(relpath))
+			})
+		return nil
+	})
+}
+
+func (c *fdbChecker) checkLive() error {
+	hostnames, err := c.list("live", false)
+	if err != nil {
+		return err
+	}
+
+	for _, hostname := range hostnames {
+		relpath := filepath.Join("live", hostname)
+		fi, err := os.Lstat(filepath.Join(c.path, relpath))
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			c.add(ProblemLive, relpath, "is not a link to a certificate", "", nil)
+			continue
+		}
+
+		target, err := c.readLink(relpath)
+		if err != nil {
+			return err
+		}
+
+		if filepath.Dir(target) != "certs" {
+			c.add(ProblemLive, relpath, fmt.Sprintf("links to %q, which is not a certificate", target), "", nil)
+			continue
+		}
+
+		if c.exists(target) && !c.exists(filepath.Join(target, "fullchain")) {
+			c.add(ProblemLive, relpath, fmt.Sprintf("links to certificate %s, which has not been downloaded", filepath.Base(target)), "", nil)
+		}
+	}
+
+	return nil
+}
+
+func (c *fdbChecker) checkCerts() error {
+	certIDs, err := c.list("certs", false)
+	if err != nil {
+		return err
+	}
+
+	for _, certID := range certIDs {
+		err := c.checkCert(certID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *fdbChecker) checkCert(certID string) error {
+	certPath := filepath.Join("certs", certID)
+
+	u, err := c.readFile(filepath.Join(certPath, "url"))
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSpace(string(u))
+	switch {
+	case u == nil:
+		c.add(ProblemCertificateURL, certPath, "has no URL, so it cannot be downloaded or revoked", "", nil)
+	case !acmeapi.ValidURL(url):
+		c.add(ProblemCertificateURL, certPath, fmt.Sprintf("has an invalid URL %q", url), "", nil)
+	case determineCertificateID(url) != certID:
+		c.add(ProblemCertificateURL, certPath, fmt.Sprintf("has a URL %q which does not match its ID", url), "", nil)
+	}
+
+	files := map[string][][]byte{}
+	var missing, unreadable []string
+	for _, fn := range []string{"cert", "chain", "fullchain"} {
+		b, err := c.readFile(filepath.Join(certPath, fn))
+		if err != nil {
+			return err
+		}
+
+		if b == nil {
+			missing = append(missing, fn)
+			continue
+		}
+
+		if fn == "chain" && len(bytes.TrimSpace(b)) == 0 {
+			// Certificates issued directly by a root have an empty chain.
+			files[fn] = [][]byte{}
+			continue
+		}
+
+		certs, err := acmeutils.LoadCertificates(b)
+		if err != nil || (fn == "cert" && len(certs) != 1) {
+			unreadable = append(unreadable, fn)
+			continue
+		}
+
+		files[fn] = certs
+	}
+
+	if len(missing) == 3 {
+		// Not yet downloaded.
+		return nil
+	}
+
+	// Find the chain which the files should contain, preferring "cert" and
+	// "chain", since daemons are more often configured to use them.
+	var certificates [][]byte
+	var source string
+	if cert, chain := files["cert"], files["chain"]; cert != nil && chain != nil {
+		certificates = append(append([][]byte{}, cert...), chain...)
+		source = "cert and chain"
+	} else if fullchain := files["fullchain"]; fullchain != nil {
+		certificates = fullchain
+		source = "fullchain"
+	} else if cert != nil {
+		certificates = cert
+		source = "cert"
+	} else {
+		c.add(ProblemChain, certPath, "has no readable certificate", "", nil)
+		return nil
+	}
+
+	var disagree []string
+	for fn, want := range map[string][][]byte{
+		"cert":      certificates[:1],
+		"chain":     certificates[1:],
+		"fullchain": certificates,
+	} {
+		if got, ok := files[fn]; ok && !equalCertificates(got, want) {
+			disagree = append(disagree, fn)
+		}
+	}
+
+	if len(missing) > 0 || len(unreadable) > 0 || len(disagree) > 0 {
+		sort.Strings(disagree)
+		var parts []string
+		if len(missing) > 0 {
+			parts = append(parts, strings.Join(missing, ", ")+" missing")
+		}
+		if len(unreadable) > 0 {
+			parts = append(parts, strings.Join(unreadable, ", ")+" unreadable")
+		}
+		if len(disagree) > 0 {
+			parts = append(parts, strings.Join(disagree, ", ")+" disagreeing with "+source)
+		}
+
+		c.add(ProblemChain, certPath, "has "+strings.Join(parts, "; "),
+			"regenerate cert, chain and fullchain from "+source,
+			func(s *fdbStore) error {
+				return saveCertificateFiles(s.db.Collection(certPath), certificates)
+			})
+	}
+
+	xcrt, err := x509.ParseCertificate(certificates[0])
+	if err != nil {
+		c.add(ProblemChain, certPath, fmt.Sprintf("has a certificate which cannot be parsed: %v", err), "", nil)
+		return nil
+	}
+
+	c.checkPrivateKeyLink(certPath, determineKeyIDFromCert(xcrt))
+	return nil
+}
+
+func (c *fdbChecker) checkPrivateKeyLink(certPath, keyID string) {
+	relpath := filepath.Join(certPath, "privkey")
+
+	var description string
+	fi, err := os.Lstat(filepath.Join(c.path, relpath))
+	if err != nil {
+		description = "is missing"
+	} else if fi.Mode()&os.ModeSymlink == 0 {
+		description = "is not a link to a private key"
+	} else if target, err := c.readLink(relpath); err != nil {
+		description = fmt.Sprintf("cannot be read: %v", err)
+	} else if target != filepath.Join("keys", keyID, "privkey") && target != filepath.Join("export", keyID, "privkey") {
+		description = fmt.Sprintf("links to %q rather than to key %s", target, keyID)
+	} else if !c.exists(relpath) {
+		description = fmt.Sprintf("links to %q, which does not exist", target)
+	} else {
+		return
+	}
+
+	keyPath := filepath.Join("keys", keyID)
+	if !c.exists(filepath.Join(keyPath, "privkey")) {
+		c.add(ProblemPrivateKeyLink, relpath, description+fmt.Sprintf("; key %s is not in the state directory", keyID), "", nil)
+		return
+	}
+
+	c.add(ProblemPrivateKeyLink, relpath, description, "link it to key "+keyID,
+		func(s *fdbStore) error {
+			pk, err := s.loadPrivateKey(s.db.Collection(keyPath))
+			if err != nil {
+				return err
+			}
+
+			return s.linkCertificateKey(s.db.Collection(certPath), &Key{ID: keyID, PrivateKey: pk})
+		})
+}
+
+func (c *fdbChecker) checkAuthorizations() error {
+	serverNames, err := c.list("accounts", false)
+	if err != nil {
+		return err
+	}
+
+	for _, serverName := range serverNames {
+		accountNames, err := c.list(filepath.Join("accounts", serverName), false)
+		if err != nil {
+			return err
+		}
+
+		for _, accountName := range accountNames {
+			authsPath := filepath.Join("accounts", serverName, accountName, "authorizations")
+			authNames, err := c.list(authsPath, false)
+			if err != nil {
+				return err
+			}
+
+			for _, authName := range authNames {
+				authName := authName
+				b, err := c.readFile(filepath.Join(authsPath, authName, "expiry"))
+				if err != nil {
+					return err
+				}
+
+				var description string
+				if b == nil {
+					description = "has no expiry time"
+				} else if _, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b))); err != nil {
+					description = fmt.Sprintf("has an invalid expiry time: %v", err)
+				} else {
+					continue
+				}
+
+				c.add(ProblemAuthorization, filepath.Join(authsPath, authName), description,
+					"remove it, so that the authorization is obtained again when needed",
+					func(s *fdbStore) error {
+						return s.db.Collection(authsPath).Delete(authName)
+					})
+			}
+		}
+	}
+
+	return nil
+}
+
+func equalCertificates(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
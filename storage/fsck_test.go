@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestCheckFDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pk := testPrivateKey(t)
+	_, err = s.ImportKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := s.ImportAccount("https://ca.test/directory", testPrivateKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.ImportCertificate("https://ca.test/cert/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Certificates = [][]byte{testCertificate(t, pk, "example.com")}
+	err = s.SaveCertificate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.SetPreferredCertificateForHostname("example.com", s.CertificateByID(c.ID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	problems, err := CheckFDB(FDBConfig{Path: dir}, false)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("unexpected problems in consistent state directory: %v %v", problems, err)
+	}
+
+	// Break things.
+	certPath := filepath.Join("certs", c.ID())
+	authPath := filepath.Join("accounts", a.ID(), "authorizations", "example.com")
+	writeStateFiles(t, dir, map[string]string{
+		"tmp/leftover":                       "",
+		filepath.Join(certPath, "fullchain"): "garbage",
+		filepath.Join(authPath, "expiry"):    "garbage",
+		filepath.Join("certs", "bogus", "x"): "",
+	})
+
+	err = os.Remove(filepath.Join(dir, certPath, "privkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Symlink("../certs/missing", filepath.Join(dir, "live", "example.net"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		ProblemAuthorization + " " + authPath,
+		ProblemCertificateURL + " certs/bogus",
+		ProblemChain + " " + certPath,
+		ProblemDanglingLink + " live/example.net",
+		ProblemPrivateKeyLink + " " + filepath.Join(certPath, "privkey"),
+		ProblemTmp + " tmp/leftover",
+	}
+
+	checkProblems := func(problems []*FDBProblem, repaired bool) {
+		var kinds []string
+		for _, p := range problems {
+			kinds = append(kinds, p.Kind+" "+p.Path)
+			if p.Repaired != (repaired && p.Repair != "") {
+				t.Fatalf("unexpected repair state: %#v", p)
+			}
+		}
+
+		sort.Strings(kinds)
+		if len(kinds) != len(expected) {
+			t.Fatalf("unexpected problems: %q", kinds)
+		}
+
+		for i := range kinds {
+			if kinds[i] != expected[i] {
+				t.Fatalf("unexpected problems: %q", kinds)
+			}
+		}
+	}
+
+	// Checking changes nothing.
+	problems, err = CheckFDB(FDBConfig{Path: dir}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkProblems(problems, false)
+
+	if _, err := os.Stat(filepath.Join(dir, "tmp", "leftover")); err != nil {
+		t.Fatalf("checking changed the state directory: %v", err)
+	}
+
+	// Repair.
+	problems, err = CheckFDB(FDBConfig{Path: dir}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkProblems(problems, true)
+
+	s, err = NewFDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c = s.CertificateByID(c.ID())
+	if c == nil || !c.Cached || c.Key == nil {
+		t.Fatalf("certificate not repaired: %#v", c)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, authPath)); !os.IsNotExist(err) {
+		t.Fatalf("invalid authorization not removed: %v", err)
+	}
+
+	// Only the problem which cannot be repaired remains.
+	problems, err = CheckFDB(FDBConfig{Path: dir}, false)
+	if err != nil || len(problems) != 1 || problems[0].Kind != ProblemCertificateURL {
+		t.Fatalf("unexpected problems after repair: %v %v", problems, err)
+	}
+}
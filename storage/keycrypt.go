@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/hlandau/acme/acmeapi/acmeutils"
+	"golang.org/x/crypto/scrypt"
+	"sync"
+)
+
+// PEM block type of private keys encrypted using a master key.
+const encryptedKeyPEMType = "ACMETOOL ENCRYPTED PRIVATE KEY"
+
+// scrypt parameters used to derive encryption keys from the master key.
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptSaltLen = 16
+)
+
+// Returned when loading an encrypted private key if no master key is
+// configured.
+var ErrMasterKeyRequired = errors.New("private key is encrypted, but no master key was provided")
+
+// Encrypts and decrypts private keys using a key derived from a master key.
+// Each encrypted key records the salt used to derive its encryption key from
+// the master key. Keys are encrypted using the salt of the first key
+// decrypted, so that all keys in a store share a salt and the (deliberately
+// slow) derivation is only done once. A salt is chosen at random if a key is
+// encrypted before any has been decrypted.
+type keyCrypter struct {
+	masterKey []byte
+
+	mutex   sync.Mutex
+	salt    []byte
+	derived map[string]cipher.AEAD // key: salt
+}
+
+func newKeyCrypter(masterKey []byte) (*keyCrypter, error) {
+	if len(masterKey) == 0 {
+		return nil, fmt.Errorf("master key must not be empty")
+	}
+
+	return &keyCrypter{
+		masterKey: masterKey,
+		derived:   map[string]cipher.AEAD{},
+	}, nil
+}
+
+// Returns the salt with which to encrypt keys, choosing one if necessary.
+func (kc *keyCrypter) encryptionSalt() ([]byte, error) {
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+
+	if kc.salt == nil {
+		salt := make([]byte, scryptSaltLen)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+
+		kc.salt = salt
+	}
+
+	return kc.salt, nil
+}
+
+// Uses the salt of a successfully decrypted key to encrypt keys, if none has
+// been chosen yet.
+func (kc *keyCrypter) adoptSalt(salt []byte) {
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+
+	if kc.salt == nil {
+		kc.salt = salt
+	}
+}
+
+func (kc *keyCrypter) aead(salt []byte) (cipher.AEAD, error) {
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+
+	if aead, ok := kc.derived[string(salt)]; ok {
+		return aead, nil
+	}
+
+	key, err := scrypt.Key(kc.masterKey, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	kc.derived[string(salt)] = aead
+	return aead, nil
+}
+
+// Encrypts a PEM-encoded private key, returning the encrypted key in PEM form.
+func (kc *keyCrypter) encrypt(plaintext []byte) ([]byte, error) {
+	salt, err := kc.encryptionSalt()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := kc.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: encryptedKeyPEMType,
+		Headers: map[string]string{
+			"KDF":    "scrypt",
+			"Cipher": "AES-256-GCM",
+			"Salt":   base64.RawURLEncoding.EncodeToString(salt),
+		},
+		Bytes: aead.Seal(nonce, nonce, plaintext, []byte(encryptedKeyPEMType)),
+	}), nil
+}
+
+// Decrypts a private key encrypted by encrypt, returning the PEM-encoded
+// private key.
+func (kc *keyCrypter) decrypt(b []byte) ([]byte, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != encryptedKeyPEMType {
+		return nil, fmt.Errorf("not an encrypted private key")
+	}
+
+	if block.Headers["KDF"] != "scrypt" || block.Headers["Cipher"] != "AES-256-GCM" {
+		return nil, fmt.Errorf("unsupported private key encryption: %s, %s", block.Headers["KDF"], block.Headers["Cipher"])
+	}
+
+	salt, err := base64.RawURLEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("encrypted private key has invalid salt")
+	}
+
+	aead, err := kc.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(block.Bytes) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted private key is truncated")
+	}
+
+	nonce, ciphertext := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(encryptedKeyPEMType))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt private key (wrong master key?)")
+	}
+
+	kc.adoptSalt(salt)
+	return plaintext, nil
+}
+
+// Returns true iff b is a private key encrypted by a keyCrypter.
+func isEncryptedKey(b []byte) bool {
+	return bytes.Contains(b, []byte("-----BEGIN "+encryptedKeyPEMType+"-----"))
+}
+
+// Encodes a private key in PEM form, encrypting it unless kc is nil.
+func (kc *keyCrypter) encodePrivateKey(privateKey crypto.PrivateKey) ([]byte, error) {
+	var buf bytes.Buffer
+	err := acmeutils.SavePrivateKey(&buf, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if kc == nil {
+		return buf.Bytes(), nil
+	}
+
+	return kc.encrypt(buf.Bytes())
+}
+
+// Decodes a PEM-encoded private key, decrypting it if it is encrypted, in
+// which case kc must not be nil. Returns whether the key was encrypted.
+func (kc *keyCrypter) decodePrivateKey(b []byte) (privateKey crypto.PrivateKey, encrypted bool, err error) {
+	encrypted = isEncryptedKey(b)
+	if encrypted {
+		if kc == nil {
+			return nil, true, ErrMasterKeyRequired
+		}
+
+		b, err = kc.decrypt(b)
+		if err != nil {
+			return nil, true, err
+		}
+	}
+
+	privateKey, err = acmeutils.LoadPrivateKey(b)
+	return privateKey, encrypted, err
+}
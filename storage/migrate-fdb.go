@@ -0,0 +1,484 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hlandau/acme/fdb"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema Versioning
+
+// The file recording the schema version of a state directory, relative to the
+// state directory. A state directory without this file has schema version 0.
+const schemaVersionFilename = "state/schema-version"
+
+// Returned (wrapped) when opening a state directory which was written by a
+// newer version of acmetool, with a newer schema version than this version
+// understands.
+var ErrSchemaTooNew = errors.New("state directory was written by a newer version of acmetool; upgrade acmetool to use it")
+
+// Returned when opening a state directory read-only which needs migrating to
+// the current schema version first.
+var ErrSchemaTooOld = errors.New("state directory needs upgrading; run \"acmetool upgrade-state\" to upgrade it")
+
+// A change to the layout of state directories.
+type fdbMigration struct {
+	// Brief description of what the migration does.
+	description string
+
+	// Makes the change, reading and writing files via m.
+	migrate func(m *fdbMigrator) error
+}
+
+// Migrations in the order they are applied. Migration i brings a state
+// directory from schema version i to schema version i+1. Migrations must never
+// be removed or reordered; append new ones to the end.
+var fdbMigrations = []fdbMigration{
+	{"move legacy settings into target files", migrateLegacySettings},
+}
+
+// The schema version of state directories written by this version.
+func currentFDBSchemaVersion() int {
+	return len(fdbMigrations)
+}
+
+// Reads the schema version of the state directory at path.
+func readFDBSchemaVersion(path string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(path, schemaVersionFilename))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version in %q: %v", schemaVersionFilename, err)
+	}
+
+	return int(v), nil
+}
+
+// Reads the schema version of the state directory at path, returning
+// ErrSchemaTooNew if this version cannot use it.
+func checkFDBSchemaVersion(path string) (int, error) {
+	v, err := readFDBSchemaVersion(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if v > currentFDBSchemaVersion() {
+		return 0, fmt.Errorf("%w (schema version %d, but at most %d is supported)", ErrSchemaTooNew, v, currentFDBSchemaVersion())
+	}
+
+	return v, nil
+}
+
+// Brings the state directory at path up to the current schema version. If db
+// is nil, nothing is changed and the changes which would be made are
+// returned. Otherwise, db must be the opened state directory, and the changes
+// made are returned.
+func migrateFDB(path string, db *fdb.DB) ([]string, error) {
+	from, err := checkFDBSchemaVersion(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &fdbMigrator{
+		path:     path,
+		db:       db,
+		backupTo: fmt.Sprintf("backup/schema-%d-%s", from, time.Now().UTC().Format("20060102T150405Z")),
+		files:    map[string][]byte{},
+		backedUp: map[string]struct{}{},
+	}
+
+	for v := from; v < currentFDBSchemaVersion(); v++ {
+		mg := &fdbMigrations[v]
+		log.Debugf("migrating state directory to schema version %d: %s", v+1, mg.description)
+
+		n := len(m.changes)
+		err := mg.migrate(m)
+		if db != nil {
+			for _, change := range m.changes[n:] {
+				log.Noticef("migrating state directory: %s", change)
+			}
+		}
+		if err != nil {
+			return m.changes, fmt.Errorf("migrating state directory to schema version %d (%s): %v", v+1, mg.description, err)
+		}
+
+		// Record progress after each migration, so that if a later migration
+		// fails, earlier ones are not repeated.
+		err = m.writeFile(schemaVersionFilename, []byte(fmt.Sprintf("%d\n", v+1)),
+			fmt.Sprintf("set schema version to %d", v+1))
+		if err != nil {
+			return m.changes, err
+		}
+	}
+
+	return m.changes, nil
+}
+
+// Migrates the opened state directory, holding its lock so that concurrent
+// invocations do not both migrate it.
+func migrateFDBLocked(path string, db *fdb.DB) error {
+	err := db.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer db.Unlock()
+
+	_, err = migrateFDB(path, db)
+	return err
+}
+
+// Returns the changes which would be made to bring the state directory at
+// path up to the current schema version, without making them.
+func PlanFDBMigration(path string) ([]string, error) {
+	if path == "" {
+		path = RecommendedPath
+	}
+
+	return migrateFDB(path, nil)
+}
+
+// Applies changes to a state directory during migration. Files are read from
+// the state directory directly, so that nothing is changed in dry-run mode.
+// Before a file is first changed, its original contents are copied into a
+// backup directory under "backup".
+type fdbMigrator struct {
+	path     string
+	db       *fdb.DB // nil in dry-run mode
+	backupTo string
+
+	// Descriptions of changes made (or which would be made).
+	changes []string
+
+	// Files written in dry-run mode, so that later migrations see them. A nil
+	// value means the file was removed.
+	files map[string][]byte
+
+	// Files already backed up.
+	backedUp map[string]struct{}
+}
+
+// Reads the file at relpath, which is relative to the state directory.
+// Returns nil if the file does not exist.
+func (m *fdbMigrator) readFile(relpath string) ([]byte, error) {
+	if b, ok := m.files[relpath]; ok {
+		return b, nil
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(m.path, relpath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return b, err
+}
+
+// Lists the files in the directory at reldir, which is relative to the state
+// directory. Hidden files are omitted.
+func (m *fdbMigrator) list(reldir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(m.path, reldir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range fis {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+
+		names = append(names, fi.Name())
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Writes the file at relpath, describing the change as given.
+func (m *fdbMigrator) writeFile(relpath string, b []byte, change string) error {
+	m.changes = append(m.changes, change)
+	if m.db == nil {
+		m.files[relpath] = b
+		return nil
+	}
+
+	err := m.backup(relpath)
+	if err != nil {
+		return err
+	}
+
+	return fdb.WriteBytes(m.db.Collection(filepath.Dir(relpath)), filepath.Base(relpath), b)
+}
+
+// Removes the file at relpath, describing the change as given.
+func (m *fdbMigrator) removeFile(relpath string, change string) error {
+	m.changes = append(m.changes, change)
+	if m.db == nil {
+		m.files[relpath] = nil
+		return nil
+	}
+
+	err := m.backup(relpath)
+	if err != nil {
+		return err
+	}
+
+	return m.db.Collection(filepath.Dir(relpath)).Delete(filepath.Base(relpath))
+}
+
+// Copies the file at relpath into the backup directory, if it exists and has
+// not already been backed up.
+func (m *fdbMigrator) backup(relpath string) error {
+	if _, ok := m.backedUp[relpath]; ok {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(m.path, relpath))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = fdb.WriteBytes(m.db.Collection(filepath.Join(m.backupTo, filepath.Dir(relpath))), filepath.Base(relpath), b)
+	if err != nil {
+		return err
+	}
+
+	m.backedUp[relpath] = struct{}{}
+	return nil
+}
+
+// Migration 1
+
+// Moves settings which older versions accepted in legacy locations to the
+// locations which are now documented:
+//
+//   - "names" and "provider" at the top level of a target file move to
+//     "satisfy.names" and "request.provider", unless those are already set,
+//     in which case they were ignored and are removed;
+//
+//   - "conf/webroot-path" and "conf/rsa-key-size" move to
+//     "request.challenge.webroot-paths" and "request.key.rsa-size" in the
+//     default target, unless those are already set.
+func migrateLegacySettings(m *fdbMigrator) error {
+	filenames, err := m.list("desired")
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range filenames {
+		relpath := filepath.Join("desired", fn)
+		doc, err := m.readYAML(relpath)
+		if err != nil {
+			// Loading such a target fails anyway, so leave it for the user to fix.
+			// Any legacy fields it has are rejected when it is next loaded.
+			log.Warnf("not migrating %q, as it cannot be parsed: %v", relpath, err)
+			continue
+		}
+
+		changed := moveLegacyTargetFields(&doc)
+		if changed {
+			err = m.writeYAML(relpath, doc, fmt.Sprintf("move legacy names and provider settings in %q", relpath))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	const targetPath = "conf/target"
+	doc, err := m.readYAML(targetPath)
+	if err != nil {
+		return fmt.Errorf("cannot parse %q: %v", targetPath, err)
+	}
+
+	changed := moveLegacyTargetFields(&doc)
+
+	webrootPaths, err := m.readFile("conf/webroot-path")
+	if err != nil {
+		return err
+	}
+
+	if webrootPaths != nil {
+		var paths []string
+		for _, p := range strings.Split(string(webrootPaths), "\n") {
+			if p = strings.TrimSpace(p); p != "" {
+				paths = append(paths, p)
+			}
+		}
+
+		if _, ok := mapSliceGetPath(doc, "request", "challenge", "webroot-paths"); !ok && len(paths) > 0 {
+			doc = mapSliceSetPath(doc, paths, "request", "challenge", "webroot-paths")
+			changed = true
+		}
+	}
+
+	rsaKeySize, err := m.readFile("conf/rsa-key-size")
+	if err != nil {
+		return err
+	}
+
+	if rsaKeySize != nil {
+		n, err := strconv.ParseUint(strings.TrimSpace(string(rsaKeySize)), 10, 31)
+		if err != nil {
+			log.Warnf("ignoring invalid RSA key size in %q: %v", "conf/rsa-key-size", err)
+		} else if _, ok := mapSliceGetPath(doc, "request", "key", "rsa-size"); !ok {
+			if nn := clampRSAKeySize(int(n)); nn != int(n) {
+				log.Warnf("An RSA key size of %d is not supported; must have %d <= size <= %d; clamping at %d", n, minRSASize, maxRSASize, nn)
+			}
+
+			doc = mapSliceSetPath(doc, int(n), "request", "key", "rsa-size")
+			changed = true
+		}
+	}
+
+	if changed {
+		err = m.writeYAML(targetPath, doc, fmt.Sprintf("move legacy settings into %q", targetPath))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, fn := range []string{"conf/webroot-path", "conf/rsa-key-size"} {
+		b, err := m.readFile(fn)
+		if err != nil {
+			return err
+		}
+
+		if b != nil {
+			err = m.removeFile(fn, fmt.Sprintf("remove %q", fn))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Moves the top-level "names" and "provider" fields of a target document, as
+// described above. Returns true if the document was changed.
+func moveLegacyTargetFields(doc *yaml.MapSlice) bool {
+	changed := false
+	for _, f := range []struct {
+		legacy string
+		path   []string
+	}{
+		{"names", []string{"satisfy", "names"}},
+		{"provider", []string{"request", "provider"}},
+	} {
+		v, ok := mapSliceGet(*doc, f.legacy)
+		if !ok {
+			continue
+		}
+
+		*doc = mapSliceDelete(*doc, f.legacy)
+		if _, ok := mapSliceGetPath(*doc, f.path...); !ok {
+			*doc = mapSliceSetPath(*doc, v, f.path...)
+		}
+
+		changed = true
+	}
+
+	return changed
+}
+
+// Reads the YAML document at relpath. A missing or empty file yields an empty
+// document.
+func (m *fdbMigrator) readYAML(relpath string) (yaml.MapSlice, error) {
+	b, err := m.readFile(relpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.MapSlice
+	err = yaml.Unmarshal(b, &doc)
+	return doc, err
+}
+
+func (m *fdbMigrator) writeYAML(relpath string, doc yaml.MapSlice, change string) error {
+	b, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	return m.writeFile(relpath, b, change)
+}
+
+// YAML Utilities
+
+func mapSliceGet(ms yaml.MapSlice, key string) (interface{}, bool) {
+	for _, item := range ms {
+		if k, ok := item.Key.(string); ok && k == key {
+			return item.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+func mapSliceDelete(ms yaml.MapSlice, key string) yaml.MapSlice {
+	var nms yaml.MapSlice
+	for _, item := range ms {
+		if k, ok := item.Key.(string); ok && k == key {
+			continue
+		}
+
+		nms = append(nms, item)
+	}
+
+	return nms
+}
+
+// Gets the value at the given path of keys. Values which are null are treated
+// as absent.
+func mapSliceGetPath(ms yaml.MapSlice, path ...string) (interface{}, bool) {
+	v, ok := mapSliceGet(ms, path[0])
+	if !ok || v == nil {
+		return nil, false
+	}
+
+	if len(path) == 1 {
+		return v, true
+	}
+
+	sub, ok := v.(yaml.MapSlice)
+	if !ok {
+		return nil, false
+	}
+
+	return mapSliceGetPath(sub, path[1:]...)
+}
+
+// Sets the value at the given path of keys, creating maps as necessary.
+// Existing values which are not maps are replaced.
+func mapSliceSetPath(ms yaml.MapSlice, value interface{}, path ...string) yaml.MapSlice {
+	if len(path) > 1 {
+		sub, _ := mapSliceGet(ms, path[0])
+		subms, _ := sub.(yaml.MapSlice)
+		value = mapSliceSetPath(subms, value, path[1:]...)
+	}
+
+	for i := range ms {
+		if k, ok := ms[i].Key.(string); ok && k == path[0] {
+			ms[i].Value = value
+			return ms
+		}
+	}
+
+	return append(ms, yaml.MapItem{Key: path[0], Value: value})
+}
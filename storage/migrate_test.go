@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var legacyStateFiles = map[string]string{
+	"desired/a.example.com": "names:\n  - a.example.com\n  - www.a.example.com\nprovider: https://ca.test/a\n",
+	"desired/b.example.com": "satisfy:\n  names:\n    - b.example.com\nnames:\n  - ignored.example.com\n",
+	"desired/c.example.com": "satisfy:\n  names:\n    - c.example.com\n",
+	"conf/target":           "request:\n  provider: https://ca.test/directory\n",
+	"conf/webroot-path":     "/var/www/1\n\n/var/www/2\n",
+	"conf/rsa-key-size":     "4096\n",
+}
+
+func writeStateFiles(t *testing.T, dir string, files map[string]string) {
+	for fn, contents := range files {
+		p := filepath.Join(dir, fn)
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(p, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFDBMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeStateFiles(t, dir, legacyStateFiles)
+
+	// Planning changes nothing.
+	changes, err := PlanFDBMigration(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 6 {
+		t.Fatalf("unexpected planned changes: %q", changes)
+	}
+
+	for fn, contents := range legacyStateFiles {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fn))
+		if err != nil || string(b) != contents {
+			t.Fatalf("file changed by planning: %s: %v", fn, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, schemaVersionFilename)); !os.IsNotExist(err) {
+		t.Fatalf("schema version written by planning: %v", err)
+	}
+
+	// Opening migrates.
+	s, err := NewFDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	dt := s.DefaultTarget()
+	if len(dt.Request.Challenge.WebrootPaths) != 2 || dt.Request.Challenge.WebrootPaths[1] != "/var/www/2" || dt.Request.Key.RSASize != 4096 {
+		t.Fatalf("legacy settings not migrated: %#v", dt.Request)
+	}
+
+	tgt := s.TargetByFilename("a.example.com")
+	if tgt == nil || len(tgt.Satisfy.Names) != 2 || tgt.Request.Provider != "https://ca.test/a" {
+		t.Fatalf("legacy target not migrated: %#v", tgt)
+	}
+
+	tgt = s.TargetByFilename("b.example.com")
+	if tgt == nil || len(tgt.Satisfy.Names) != 1 || tgt.Satisfy.Names[0] != "b.example.com" {
+		t.Fatalf("legacy target not migrated: %#v", tgt)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "desired", "a.example.com"))
+	if err != nil || !strings.Contains(string(b), "satisfy:") || strings.Contains(string(b), "\nprovider:") {
+		t.Fatalf("unexpected migrated target file: %q %v", b, err)
+	}
+
+	for _, fn := range []string{"conf/webroot-path", "conf/rsa-key-size"} {
+		if _, err := os.Stat(filepath.Join(dir, fn)); !os.IsNotExist(err) {
+			t.Fatalf("legacy file not removed: %s: %v", fn, err)
+		}
+	}
+
+	// Changed and removed files are backed up; unchanged files are not.
+	backups, err := filepath.Glob(filepath.Join(dir, "backup", "schema-0-*"))
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("unexpected backups: %v %v", backups, err)
+	}
+
+	for fn, contents := range legacyStateFiles {
+		b, err := ioutil.ReadFile(filepath.Join(backups[0], fn))
+		if fn == "desired/c.example.com" {
+			if !os.IsNotExist(err) {
+				t.Fatalf("unchanged file backed up: %v", err)
+			}
+			continue
+		}
+
+		if err != nil || string(b) != contents {
+			t.Fatalf("file not backed up: %s: %v", fn, err)
+		}
+	}
+
+	v, err := readFDBSchemaVersion(dir)
+	if err != nil || v != currentFDBSchemaVersion() {
+		t.Fatalf("unexpected schema version: %d %v", v, err)
+	}
+
+	// Nothing more to do.
+	changes, err = PlanFDBMigration(dir)
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("unexpected planned changes: %q %v", changes, err)
+	}
+}
+
+func TestFDBSchemaTooNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeStateFiles(t, dir, map[string]string{
+		schemaVersionFilename: "1000\n",
+		"conf/webroot-path":   "/var/www\n",
+	})
+
+	_, err = NewFDB(dir)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("unexpected error opening newer state directory: %v", err)
+	}
+
+	_, err = PlanFDBMigration(dir)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("unexpected error planning migration of newer state directory: %v", err)
+	}
+
+	// Nothing was touched.
+	if _, err := os.Stat(filepath.Join(dir, "conf", "webroot-path")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "tmp")); !os.IsNotExist(err) {
+		t.Fatalf("newer state directory was opened: %v", err)
+	}
+}
+
+func TestFDBMigrationUnparseableTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeStateFiles(t, dir, map[string]string{
+		"desired/a.example.com": "names: [a.example.com\nprovider: https://ca.test/a\n",
+	})
+
+	s, err := NewFDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.TargetByFilename("a.example.com") != nil {
+		t.Fatalf("unparseable target loaded")
+	}
+
+	// Once the syntax is fixed, the legacy fields, which were not migrated,
+	// are rejected rather than ignored.
+	writeStateFiles(t, dir, map[string]string{
+		"desired/a.example.com": "names: [a.example.com, www.a.example.com]\nprovider: https://ca.test/a\n",
+	})
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tgt := s.TargetByFilename("a.example.com"); tgt != nil {
+		t.Fatalf("target with legacy fields loaded: %#v", tgt)
+	}
+}
@@ -0,0 +1,1016 @@
+package storage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"github.com/hlandau/acme/acmeapi"
+	"github.com/hlandau/acme/acmeapi/acmeutils"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Database-backed ACME client store. {{{1
+
+// A store which keeps everything in a single database file, so that every
+// change is made atomically. Daemons cannot use the database directly; see
+// Materialize.
+type boltStore struct {
+	db *bolt.DB
+
+	path          string
+	certs         map[string]*Certificate   // key: certificate ID
+	accounts      map[string]*Account       // key: account ID
+	keys          map[string]*Key           // key: key ID
+	targets       map[string]*Target        // key: target filename
+	preferred     map[string]*Certificate   // key: hostname
+	failures      map[string]*TargetFailure // key: target filename
+	defaultTarget *Target                   // from conf
+
+	// Encrypts private keys, if a master key is used.
+	crypter *keyCrypter
+
+	locked bool
+}
+
+// Buckets. Each maps an identifier to a YAML document, except for keysBucket,
+// which maps key IDs to PEM-encoded private keys, and liveBucket, which maps
+// hostnames to certificate IDs. desiredBucket and confBucket contain files
+// in the same form as the "desired" and "conf" directories of a state
+// directory.
+var (
+	accountsBucket = []byte("accounts")
+	keysBucket     = []byte("keys")
+	certsBucket    = []byte("certs")
+	desiredBucket  = []byte("desired")
+	confBucket     = []byte("conf")
+	liveBucket     = []byte("live")
+	failuresBucket = []byte("failures")
+)
+
+var boltBuckets = [][]byte{
+	accountsBucket, keysBucket, certsBucket, desiredBucket, confBucket, liveBucket, failuresBucket,
+}
+
+// Serialized form of an account.
+type boltAccount struct {
+	DirectoryURL           string                  `yaml:"directory-url"`
+	PrivateKey             string                  `yaml:"private-key"`
+	Retired                bool                    `yaml:"retired,omitempty"`
+	Authorizations         []boltAuthorization     `yaml:"authorizations,omitempty"`
+	Orders                 map[string]string       `yaml:"orders,omitempty"` // key: target filename, value: order URL
+	ExternalAccountBinding *ExternalAccountBinding `yaml:"external-account-binding,omitempty"`
+
+	// Set, to the ID of the account being rekeyed, on an account saved with
+	// its new key before the server is asked to change the key. Such an
+	// account is also retired until rekeying finishes. See recoverRekeys.
+	RekeyOf string `yaml:"rekey-of,omitempty"`
+}
+
+type boltAuthorization struct {
+	Name    string    `yaml:"name"`
+	URL     string    `yaml:"url,omitempty"`
+	Expires time.Time `yaml:"expires"`
+}
+
+// Serialized form of a certificate.
+type boltCertificate struct {
+	URL               string       `yaml:"url"`
+	RevocationDesired bool         `yaml:"revoke,omitempty"`
+	Revoked           bool         `yaml:"revoked,omitempty"`
+	Fullchain         string       `yaml:"fullchain,omitempty"` // PEM
+	RenewalInfo       *RenewalInfo `yaml:"renewal-info,omitempty"`
+}
+
+// The path of the database file within the state directory.
+const BoltFilename = "db/acmetool.db"
+
+// Settings for opening a database-backed store.
+type BoltConfig struct {
+	// The path to the state directory. The database is kept in the file
+	// BoltFilename within it. Hooks are passed this path, and it is the
+	// default place to materialize certificates for daemons. Defaults to
+	// RecommendedPath.
+	Path string
+
+	// Private keys are encrypted using this master key, if set. See
+	// FDBConfig.
+	MasterKey []byte
+
+	// The database file can only be open in one process at a time. If another
+	// process has it open, wait for it to be closed rather than returning
+	// ErrLocked.
+	Wait bool
+
+	// If set, the database is opened for inspection only and is not changed.
+	// Unencrypted keys are not encrypted and saving anything fails. A read-only
+	// database can be open in several processes at once.
+	ReadOnly bool
+}
+
+// Create a new database-backed store in the given state directory.
+func NewBolt(path string) (Store, error) {
+	return NewBoltWithConfig(BoltConfig{Path: path})
+}
+
+// Create a new database-backed store using the given settings.
+func NewBoltWithConfig(cfg BoltConfig) (Store, error) {
+	path := cfg.Path
+	if path == "" {
+		path = RecommendedPath
+	}
+
+	filename := filepath.Join(path, BoltFilename)
+	if !cfg.ReadOnly {
+		err := os.MkdirAll(filepath.Dir(filename), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	opts := &bolt.Options{Timeout: time.Second, ReadOnly: cfg.ReadOnly}
+	if cfg.Wait {
+		opts.Timeout = 0
+	}
+
+	db, err := bolt.Open(filename, 0600, opts)
+	if err == bolt.ErrTimeout {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := &boltStore{
+		db:   db,
+		path: path,
+	}
+
+	if len(cfg.MasterKey) > 0 {
+		s.crypter, err = newKeyCrypter(cfg.MasterKey)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if cfg.ReadOnly {
+		err = db.View(func(tx *bolt.Tx) error {
+			for _, name := range boltBuckets {
+				if tx.Bucket(name) == nil {
+					return fmt.Errorf("database has no %q bucket; it must be opened for writing once to create it", name)
+				}
+			}
+
+			return nil
+		})
+	} else {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, name := range boltBuckets {
+				_, err := tx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err == nil {
+			err = s.recoverRekeys()
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = s.Reload()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close the store.
+func (s *boltStore) Close() error {
+	s.locked = false
+	return s.db.Close()
+}
+
+// The database file is locked for as long as it is open, so this only
+// prevents the store being locked twice.
+func (s *boltStore) Lock(wait bool) error {
+	if s.locked {
+		return fmt.Errorf("database is already locked")
+	}
+
+	s.locked = true
+	return nil
+}
+
+func (s *boltStore) Unlock() error {
+	if !s.locked {
+		return fmt.Errorf("database is not locked")
+	}
+
+	s.locked = false
+	return nil
+}
+
+// State directory path.
+func (s *boltStore) Path() string {
+	return s.path
+}
+
+func (s *boltStore) WriteMiscellaneousConfFile(filename string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(confBucket).Put([]byte(filename), data)
+	})
+}
+
+// Trivial accessors. {{{1
+
+func (s *boltStore) AccountByID(accountID string) *Account {
+	return s.accounts[accountID]
+}
+
+func (s *boltStore) AccountByDirectoryURL(directoryURL string) *Account {
+	for _, a := range s.accounts {
+		if !a.Retired && a.MatchesURL(directoryURL) {
+			return a
+		}
+	}
+
+	return nil
+}
+
+func (s *boltStore) VisitAccounts(f func(a *Account) error) error {
+	for _, a := range s.accounts {
+		err := f(a)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *boltStore) CertificateByID(certificateID string) *Certificate {
+	return s.certs[certificateID]
+}
+
+func (s *boltStore) VisitCertificates(f func(c *Certificate) error) error {
+	for _, c := range s.certs {
+		err := f(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *boltStore) KeyByID(keyID string) *Key {
+	return s.keys[keyID]
+}
+
+func (s *boltStore) VisitKeys(f func(k *Key) error) error {
+	for _, k := range s.keys {
+		err := f(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *boltStore) TargetByFilename(filename string) *Target {
+	return s.targets[filename]
+}
+
+func (s *boltStore) VisitTargets(f func(t *Target) error) error {
+	for _, t := range s.targets {
+		err := f(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Return the default target. Persist changes to the default target by calling SaveTarget.
+func (s *boltStore) DefaultTarget() *Target {
+	return s.defaultTarget
+}
+
+func (s *boltStore) TargetFailure(filename string) *TargetFailure {
+	return s.failures[filename]
+}
+
+func (s *boltStore) VisitPreferredCertificates(f func(hostname string, c *Certificate) error) error {
+	for hostname, c := range s.preferred {
+		err := f(hostname, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *boltStore) PreferredCertificateForHostname(hostname string) (*Certificate, error) {
+	c := s.preferred[hostname]
+	if c == nil {
+		return nil, fmt.Errorf("not found: %q", hostname)
+	}
+
+	return c, nil
+}
+
+func (s *boltStore) SetPreferredCertificateForHostname(hostname string, c *Certificate) error {
+	if s.certs[c.ID()] == nil {
+		return fmt.Errorf("certificate does not exist: %s", c.ID())
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(liveBucket).Put([]byte(hostname), []byte(c.ID()))
+	})
+	if err != nil {
+		return err
+	}
+
+	s.preferred[hostname] = c
+	return nil
+}
+
+// Loading. {{{1
+
+// Reload from the database.
+func (s *boltStore) Reload() error {
+	var unencrypted []*Account
+	var unencryptedKeys []*Key
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if !isNeutered {
+			hasTouchedSensitiveData = true
+
+			var err error
+			unencrypted, err = s.loadAccounts(tx)
+			if err != nil {
+				return err
+			}
+
+			unencryptedKeys, err = s.loadKeys(tx)
+			if err != nil {
+				return err
+			}
+
+			err = s.loadCerts(tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := s.loadTargets(tx)
+		if err != nil {
+			return err
+		}
+
+		err = s.loadTargetFailures(tx)
+		if err != nil {
+			return err
+		}
+
+		if !isNeutered {
+			return s.loadPreferred(tx)
+		}
+
+		return nil
+	})
+	if err != nil || s.crypter == nil || s.db.IsReadOnly() || (len(unencrypted) == 0 && len(unencryptedKeys) == 0) {
+		return err
+	}
+
+	log.Debugf("encrypting %d private keys", len(unencrypted)+len(unencryptedKeys))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, a := range unencrypted {
+			err := s.putAccount(tx, a)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, k := range unencryptedKeys {
+			err := s.putKey(tx, k.ID, k.PrivateKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Returns the accounts whose keys are not encrypted.
+func (s *boltStore) loadAccounts(tx *bolt.Tx) (unencrypted []*Account, err error) {
+	s.accounts = map[string]*Account{}
+
+	err = tx.Bucket(accountsBucket).ForEach(func(k, v []byte) error {
+		accountID := string(k)
+
+		var ba boltAccount
+		err := yaml.Unmarshal(v, &ba)
+		if err != nil {
+			return fmt.Errorf("failed to load account %s: %w", accountID, err)
+		}
+
+		pk, encrypted, err := s.crypter.decodePrivateKey([]byte(ba.PrivateKey))
+		if err != nil {
+			return fmt.Errorf("failed to load account %s: %w", accountID, err)
+		}
+
+		a := &Account{
+			PrivateKey:             pk,
+			DirectoryURL:           ba.DirectoryURL,
+			Authorizations:         map[string]*Authorization{},
+			Orders:                 map[string]*Order{},
+			ExternalAccountBinding: ba.ExternalAccountBinding,
+			Retired:                ba.Retired,
+		}
+
+		if a.ID() != accountID {
+			return fmt.Errorf("account ID mismatch: %#v != %#v", a.ID(), accountID)
+		}
+
+		for _, az := range ba.Authorizations {
+			if !acmeapi.ValidURL(az.URL) {
+				az.URL = ""
+			}
+
+			a.Authorizations[az.Name] = &Authorization{
+				Name:    az.Name,
+				URL:     az.URL,
+				Expires: az.Expires,
+			}
+		}
+
+		for targetFilename, orderURL := range ba.Orders {
+			if !acmeapi.ValidURL(orderURL) {
+				log.Errorf("invalid order URL for target %s, ignoring: %q", targetFilename, orderURL)
+				continue
+			}
+
+			a.Orders[targetFilename] = &Order{
+				TargetFilename: targetFilename,
+				URL:            orderURL,
+			}
+		}
+
+		s.accounts[accountID] = a
+		if !encrypted {
+			unencrypted = append(unencrypted, a)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// Returns the keys which are not encrypted.
+func (s *boltStore) loadKeys(tx *bolt.Tx) (unencrypted []*Key, err error) {
+	s.keys = map[string]*Key{}
+
+	err = tx.Bucket(keysBucket).ForEach(func(k, v []byte) error {
+		keyID := string(k)
+
+		pk, encrypted, err := s.crypter.decodePrivateKey(v)
+		if err != nil {
+			return fmt.Errorf("failed to load key %s: %w", keyID, err)
+		}
+
+		actualKeyID, err := determineKeyIDFromKey(pk)
+		if err != nil {
+			return err
+		}
+
+		if actualKeyID != keyID {
+			return fmt.Errorf("key ID mismatch: %#v != %#v", keyID, actualKeyID)
+		}
+
+		key := &Key{
+			ID:         keyID,
+			PrivateKey: pk,
+		}
+
+		s.keys[keyID] = key
+		if !encrypted {
+			unencrypted = append(unencrypted, key)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+func (s *boltStore) loadCerts(tx *bolt.Tx) error {
+	s.certs = map[string]*Certificate{}
+
+	return tx.Bucket(certsBucket).ForEach(func(k, v []byte) error {
+		certID := string(k)
+
+		var bc boltCertificate
+		err := yaml.Unmarshal(v, &bc)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %s: %v", certID, err)
+		}
+
+		if !acmeapi.ValidURL(bc.URL) {
+			return fmt.Errorf("certificate has invalid URI")
+		}
+
+		actualCertID := determineCertificateID(bc.URL)
+		if certID != actualCertID {
+			return fmt.Errorf("cert ID mismatch: %#v != %#v", certID, actualCertID)
+		}
+
+		crt := &Certificate{
+			URL:               bc.URL,
+			RevocationDesired: bc.RevocationDesired,
+			Revoked:           bc.Revoked,
+			RenewalInfo:       bc.RenewalInfo,
+		}
+
+		if bc.Fullchain != "" {
+			certs, err := acmeutils.LoadCertificates([]byte(bc.Fullchain))
+			if err != nil {
+				return err
+			}
+
+			xcrt, err := x509.ParseCertificate(certs[0])
+			if err != nil {
+				return err
+			}
+
+			crt.Key = s.keys[determineKeyIDFromCert(xcrt)]
+			crt.Certificates = certs
+			crt.Cached = true
+		}
+
+		s.certs[certID] = crt
+		return nil
+	})
+}
+
+func (s *boltStore) loadTargets(tx *bolt.Tx) error {
+	s.defaultTarget = &Target{}
+	if b := tx.Bucket(confBucket).Get([]byte("target")); b != nil {
+		dtgt, err := parseTarget("target", b, nil)
+		if err == nil {
+			dtgt.genericise()
+			s.defaultTarget = dtgt
+		} else {
+			log.Errore(err, "error loading default target file")
+		}
+	}
+
+	s.targets = map[string]*Target{}
+	return tx.Bucket(desiredBucket).ForEach(func(k, v []byte) error {
+		tgt, err := parseTarget(string(k), v, s.defaultTarget)
+		log.Errore(err, "failed to load target ", string(k))
+		if err == nil {
+			s.targets[tgt.Filename] = tgt
+		}
+
+		// Ignore errors, best effort.
+		return nil
+	})
+}
+
+func (s *boltStore) loadTargetFailures(tx *bolt.Tx) error {
+	s.failures = map[string]*TargetFailure{}
+
+	return tx.Bucket(failuresBucket).ForEach(func(k, v []byte) error {
+		tf := &TargetFailure{}
+		err := yaml.Unmarshal(v, tf)
+		if err != nil {
+			log.Errore(err, "failed to load target failure record, ignoring: ", string(k))
+			return nil
+		}
+
+		tf.TargetFilename = string(k)
+		s.failures[tf.TargetFilename] = tf
+		return nil
+	})
+}
+
+func (s *boltStore) loadPreferred(tx *bolt.Tx) error {
+	s.preferred = map[string]*Certificate{}
+
+	return tx.Bucket(liveBucket).ForEach(func(k, v []byte) error {
+		cert := s.certs[string(v)]
+		if cert == nil {
+			return fmt.Errorf("unknown certificate: %q", v)
+		}
+
+		s.preferred[string(k)] = cert
+		return nil
+	})
+}
+
+// Saving. {{{1
+
+// Serializes the target to the database. Call after changing any settings.
+func (s *boltStore) SaveTarget(t *Target) error {
+	b, err := marshalTarget(t, t == s.defaultTarget)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if t == s.defaultTarget {
+			return tx.Bucket(confBucket).Put([]byte("target"), b)
+		}
+
+		return tx.Bucket(desiredBucket).Put([]byte(t.Filename), b)
+	})
+}
+
+func (s *boltStore) RemoveTarget(filename string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(desiredBucket).Delete([]byte(filename))
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(failuresBucket).Delete([]byte(filename))
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(s.failures, filename)
+	return nil
+}
+
+func (s *boltStore) SaveTargetFailure(tf *TargetFailure) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return putYAML(tx, failuresBucket, tf.TargetFilename, tf)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.failures[tf.TargetFilename] = tf
+	return nil
+}
+
+func (s *boltStore) RemoveTargetFailure(filename string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(failuresBucket).Delete([]byte(filename))
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(s.failures, filename)
+	return nil
+}
+
+func (s *boltStore) SaveCertificate(cert *Certificate) error {
+	bc := &boltCertificate{
+		URL:               cert.URL,
+		RevocationDesired: cert.RevocationDesired,
+		Revoked:           cert.Revoked,
+		RenewalInfo:       cert.RenewalInfo,
+	}
+
+	if len(cert.Certificates) > 0 {
+		var buf bytes.Buffer
+		for _, c := range cert.Certificates {
+			err := acmeutils.SaveCertificates(&buf, c)
+			if err != nil {
+				return err
+			}
+		}
+
+		bc.Fullchain = buf.String()
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// As with a state directory, certificate data once obtained is kept.
+		if bc.Fullchain == "" {
+			var old boltCertificate
+			if b := tx.Bucket(certsBucket).Get([]byte(cert.ID())); b != nil && yaml.Unmarshal(b, &old) == nil {
+				bc.Fullchain = old.Fullchain
+			}
+		}
+
+		return putYAML(tx, certsBucket, cert.ID(), bc)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.certs[cert.ID()] = cert
+	return nil
+}
+
+func (s *boltStore) SaveAccount(a *Account) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.putAccount(tx, a)
+	})
+}
+
+func (s *boltStore) putAccount(tx *bolt.Tx, a *Account) error {
+	ba, err := s.encodeAccount(a)
+	if err != nil {
+		return err
+	}
+
+	return putYAML(tx, accountsBucket, a.ID(), ba)
+}
+
+func (s *boltStore) encodeAccount(a *Account) (*boltAccount, error) {
+	pk, err := s.crypter.encodePrivateKey(a.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ba := &boltAccount{
+		DirectoryURL:           a.DirectoryURL,
+		PrivateKey:             string(pk),
+		Retired:                a.Retired,
+		ExternalAccountBinding: a.ExternalAccountBinding,
+	}
+
+	for _, az := range a.Authorizations {
+		ba.Authorizations = append(ba.Authorizations, boltAuthorization{
+			Name:    az.Name,
+			URL:     az.URL,
+			Expires: az.Expires,
+		})
+	}
+
+	if len(a.Orders) > 0 {
+		ba.Orders = map[string]string{}
+		for _, order := range a.Orders {
+			ba.Orders[order.TargetFilename] = order.URL
+		}
+	}
+
+	return ba, nil
+}
+
+func (s *boltStore) putKey(tx *bolt.Tx, keyID string, privateKey crypto.PrivateKey) error {
+	b, err := s.crypter.encodePrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(keysBucket).Put([]byte(keyID), b)
+}
+
+func putYAML(tx *bolt.Tx, bucket []byte, key string, v interface{}) error {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucket).Put([]byte(key), b)
+}
+
+// Replaces the private key of an account. The account is saved under its new
+// ID, retired and marked as being rekeyed, before commit is called to change
+// the key on the server. If the server rejects the change, it is removed
+// again. If commit fails otherwise, it is not known whether the server changed
+// the key, so it is kept for recoverRekeys to install. Otherwise the new
+// account replaces the old one.
+func (s *boltStore) RekeyAccount(a *Account, newKey crypto.PrivateKey, commit func() error) (*Account, error) {
+	newAccountID, err := determineAccountID(a.DirectoryURL, newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.accounts[newAccountID]; ok {
+		return nil, fmt.Errorf("account already exists: %s", newAccountID)
+	}
+
+	na := *a
+	na.PrivateKey = newKey
+
+	staged, err := s.encodeAccount(&na)
+	if err != nil {
+		return nil, err
+	}
+
+	staged.Retired = true
+	staged.RekeyOf = a.ID()
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return putYAML(tx, accountsBucket, newAccountID, staged)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = commit()
+	if serverRejected(err) {
+		s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(accountsBucket).Delete([]byte(newAccountID))
+		})
+		return nil, err
+	} else if err != nil {
+		log.Warnf("failed to change key of account %s, but the server may have changed it; the new key will be installed when the database is next opened: %v",
+			a.ID(), err)
+		return nil, err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		err := s.putAccount(tx, &na)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(accountsBucket).Delete([]byte(a.ID()))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	delete(s.accounts, a.ID())
+	s.accounts[newAccountID] = &na
+	return &na, nil
+}
+
+// Finishes rekeying interrupted by the process dying or by an error changing
+// the key with the server. It is not known whether the server changed the key,
+// so the new key is installed and the old account is retired rather than
+// removed, so that neither key is lost.
+func (s *boltStore) recoverRekeys() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(accountsBucket)
+
+		staged := map[string]*boltAccount{}
+		err := b.ForEach(func(k, v []byte) error {
+			var ba boltAccount
+			err := yaml.Unmarshal(v, &ba)
+			if err != nil {
+				return fmt.Errorf("failed to load account %s: %w", k, err)
+			}
+
+			if ba.RekeyOf != "" {
+				staged[string(k)] = &ba
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for newAccountID, ba := range staged {
+			log.Warnf("rekeying of account %s was interrupted, so it is not known whether the server accepted the new key; installing the new key as account %s and retiring the old account",
+				ba.RekeyOf, newAccountID)
+
+			if v := b.Get([]byte(ba.RekeyOf)); v != nil {
+				var oba boltAccount
+				err := yaml.Unmarshal(v, &oba)
+				if err != nil {
+					return fmt.Errorf("failed to load account %s: %w", ba.RekeyOf, err)
+				}
+
+				oba.Retired = true
+				err = putYAML(tx, accountsBucket, ba.RekeyOf, &oba)
+				if err != nil {
+					return err
+				}
+			}
+
+			ba.Retired = false
+			ba.RekeyOf = ""
+			err := putYAML(tx, accountsBucket, newAccountID, ba)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Removal. {{{1
+
+func (s *boltStore) RemoveCertificate(certificateID string) error {
+	_, ok := s.certs[certificateID]
+	if !ok {
+		return fmt.Errorf("certificate does not exist: %s", certificateID)
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(certsBucket).Delete([]byte(certificateID))
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(s.certs, certificateID)
+	return nil
+}
+
+func (s *boltStore) RemoveKey(keyID string) error {
+	_, ok := s.keys[keyID]
+	if !ok {
+		return fmt.Errorf("key does not exist: %s", keyID)
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).Delete([]byte(keyID))
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(s.keys, keyID)
+	return nil
+}
+
+// Importing. {{{1
+
+func (s *boltStore) ImportKey(privateKey crypto.PrivateKey) (*Key, error) {
+	keyID, err := determineKeyIDFromKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	k, ok := s.keys[keyID]
+	if ok {
+		return k, nil
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return s.putKey(tx, keyID, privateKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	k = &Key{
+		PrivateKey: privateKey,
+		ID:         keyID,
+	}
+
+	s.keys[keyID] = k
+	return k, nil
+}
+
+func (s *boltStore) ImportCertificate(url string) (*Certificate, error) {
+	certID := determineCertificateID(url)
+	c, ok := s.certs[certID]
+	if ok {
+		return c, nil
+	}
+
+	c = &Certificate{
+		URL: url,
+	}
+
+	err := s.SaveCertificate(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (s *boltStore) ImportAccount(directoryURL string, privateKey crypto.PrivateKey) (*Account, error) {
+	accountID, err := determineAccountID(directoryURL, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	a, ok := s.accounts[accountID]
+	if ok {
+		return a, nil
+	}
+
+	a = &Account{
+		PrivateKey:   privateKey,
+		DirectoryURL: directoryURL,
+	}
+
+	err = s.SaveAccount(a)
+	if err != nil {
+		return nil, err
+	}
+
+	s.accounts[accountID] = a
+	return a, nil
+}
@@ -12,8 +12,8 @@ import (
 	"github.com/hlandau/xlog"
 	"gopkg.in/yaml.v2"
 	"io"
-	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -25,12 +25,29 @@ type fdbStore struct {
 	db *fdb.DB
 
 	path          string
-	certs         map[string]*Certificate // key: certificate ID
-	accounts      map[string]*Account     // key: account ID
-	keys          map[string]*Key         // key: key ID
-	targets       map[string]*Target      // key: target filename
-	preferred     map[string]*Certificate // key: hostname
-	defaultTarget *Target                 // from conf
+	certs         map[string]*Certificate   // key: certificate ID
+	accounts      map[string]*Account       // key: account ID
+	keys          map[string]*Key           // key: key ID
+	targets       map[string]*Target        // key: target filename
+	preferred     map[string]*Certificate   // key: hostname
+	failures      map[string]*TargetFailure // key: target filename
+	defaultTarget *Target                   // from conf
+
+	// Encrypts private keys, if a master key is used.
+	crypter *keyCrypter
+
+	// Private keys found unencrypted while loading, to be encrypted once
+	// loading is complete.
+	unencryptedKeys []unencryptedKey
+
+	// If set, loading changes nothing. See FDBConfig.ReadOnly.
+	readOnly bool
+}
+
+// A private key stored unencrypted in the "privkey" file of a collection.
+type unencryptedKey struct {
+	c  *fdb.Collection
+	pk crypto.PrivateKey
 }
 
 func (s *fdbStore) WriteMiscellaneousConfFile(filename string, data []byte) error {
@@ -45,7 +62,7 @@ func (s *fdbStore) AccountByID(accountID string) *Account {
 
 func (s *fdbStore) AccountByDirectoryURL(directoryURL string) *Account {
 	for _, a := range s.accounts {
-		if a.MatchesURL(directoryURL) {
+		if !a.Retired && a.MatchesURL(directoryURL) {
 			return a
 		}
 	}
@@ -99,6 +116,10 @@ func (s *fdbStore) DefaultTarget() *Target {
 	return s.defaultTarget
 }
 
+func (s *fdbStore) TargetFailure(filename string) *TargetFailure {
+	return s.failures[filename]
+}
+
 func (s *fdbStore) KeyByID(keyID string) *Key {
 	return s.keys[keyID]
 }
@@ -191,12 +212,16 @@ func init() {
 var storePermissions = []fdb.Permission{
 	{Path: ".", DirMode: 0755, FileMode: 0644},
 	{Path: "accounts", DirMode: 0700, FileMode: 0600},
-	{Path: "desired", DirMode: 0755, FileMode: 0644},
+	{Path: "desired", DirMode: 0700, FileMode: 0600}, // may contain TSIG secrets
 	{Path: "live", DirMode: 0755, FileMode: 0644},
 	{Path: "certs", DirMode: 0755, FileMode: 0644},
 	{Path: "certs/*/haproxy", DirMode: 0700, FileMode: 0600}, // hack for HAProxy
 	{Path: "keys", DirMode: 0700, FileMode: 0600},
-	{Path: "conf", DirMode: 0755, FileMode: 0644},
+	{Path: "export", DirMode: 0700, FileMode: 0600},
+	{Path: "db", DirMode: 0700, FileMode: 0600},
+	{Path: "backup", DirMode: 0700, FileMode: 0600},
+	{Path: "conf", DirMode: 0700, FileMode: 0600}, // may contain EAB HMAC keys
+	{Path: "state", DirMode: 0755, FileMode: 0644},
 	{Path: "tmp", DirMode: 0700, FileMode: 0600},
 }
 
@@ -204,27 +229,108 @@ var storePermissions = []fdb.Permission{
 
 // Create a new client store using the given path.
 func NewFDB(path string) (Store, error) {
+	return NewFDBWithConfig(FDBConfig{Path: path})
+}
+
+// Settings for opening a state directory.
+type FDBConfig struct {
+	// The path to the state directory. Defaults to RecommendedPath.
+	Path string
+
+	// If set, private keys are stored encrypted using a key derived from this
+	// master key, which may be a passphrase or the contents of a key file.
+	// Unencrypted keys are encrypted when loaded. Since daemons using
+	// certificates need their private keys, the keys of certificates are
+	// also written unencrypted under "export", and the "privkey" links of
+	// certificates point there instead.
+	MasterKey []byte
+
+	// If set, the state directory is opened for inspection only and is not
+	// changed: it is not migrated, interrupted account rekeys are not
+	// recovered and unencrypted keys are not encrypted. Saving anything
+	// fails. A state directory which needs migrating cannot be opened
+	// read-only.
+	ReadOnly bool
+}
+
+// Create a new client store using the given settings.
+func NewFDBWithConfig(cfg FDBConfig) (Store, error) {
+	s, err := openFDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Opens the state directory, migrating it if necessary, without loading it.
+func openFDB(cfg FDBConfig) (*fdbStore, error) {
+	path := cfg.Path
 	if path == "" {
 		path = RecommendedPath
 	}
 
+	// This is checked before opening, as opening conforms permissions, which
+	// a newer version may have changed.
+	version, err := checkFDBSchemaVersion(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ReadOnly && version < currentFDBSchemaVersion() {
+		changes, err := migrateFDB(path, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(changes) > 0 {
+			return nil, ErrSchemaTooOld
+		}
+	}
+
 	db, err := fdb.Open(fdb.Config{
 		Path:            path,
 		Permissions:     storePermissions,
 		PermissionsPath: "conf/perm",
+		ReadOnly:        cfg.ReadOnly,
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	if version < currentFDBSchemaVersion() && !cfg.ReadOnly {
+		err = migrateFDBLocked(path, db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
 	s := &fdbStore{
-		db:   db,
-		path: path,
+		db:       db,
+		path:     path,
+		readOnly: cfg.ReadOnly,
 	}
 
-	err = s.Reload()
-	if err != nil {
-		return nil, err
+	if len(cfg.MasterKey) > 0 {
+		s.crypter, err = newKeyCrypter(cfg.MasterKey)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if !s.readOnly {
+		err = s.recoverRekeys()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
 
 	return s, nil
@@ -232,7 +338,22 @@ func NewFDB(path string) (Store, error) {
 
 // Close the store.
 func (s *fdbStore) Close() error {
-	return nil
+	return s.db.Close()
+}
+
+// Lock the state directory.
+func (s *fdbStore) Lock(wait bool) error {
+	err := s.db.Lock(wait)
+	if err == fdb.ErrLocked {
+		return ErrLocked
+	}
+
+	return err
+}
+
+// Unlock the state directory.
+func (s *fdbStore) Unlock() error {
+	return s.db.Unlock()
 }
 
 // State directory path.
@@ -244,6 +365,7 @@ func (s *fdbStore) Path() string {
 func (s *fdbStore) Reload() error {
 	if !isNeutered {
 		hasTouchedSensitiveData = true
+		s.unencryptedKeys = nil
 
 		err := s.loadAccounts()
 		if err != nil {
@@ -259,6 +381,12 @@ func (s *fdbStore) Reload() error {
 		if err != nil {
 			return err
 		}
+
+		// Only once certificates no longer link to unencrypted keys.
+		err = s.encryptUnencryptedKeys()
+		if err != nil {
+			return err
+		}
 	}
 
 	err := s.loadTargets()
@@ -266,6 +394,11 @@ func (s *fdbStore) Reload() error {
 		return err
 	}
 
+	err = s.loadTargetFailures()
+	if err != nil {
+		return err
+	}
+
 	if !isNeutered {
 		err = s.loadPreferred()
 		if err != nil {
@@ -311,25 +444,11 @@ func (s *fdbStore) loadAccounts() error {
 }
 
 func (s *fdbStore) validateAccount(serverName, accountName string, c *fdb.Collection) error {
-	f, err := c.Open("privkey")
-	if err != nil {
-		return err
-	}
-
-	defer f.Close()
-
-	b, err := ioutil.ReadAll(f)
-	if err != nil {
-		return err
-	}
-
-	pk, err := acmeutils.LoadPrivateKey(b)
+	pk, err := s.loadPrivateKey(c)
 	if err != nil {
 		return err
 	}
 
-	f.Close()
-
 	directoryURL, err := decodeAccountURLPart(serverName)
 	if err != nil {
 		return err
@@ -339,6 +458,8 @@ func (s *fdbStore) validateAccount(serverName, accountName string, c *fdb.Collec
 		PrivateKey:     pk,
 		DirectoryURL:   directoryURL,
 		Authorizations: map[string]*Authorization{},
+		Orders:         map[string]*Order{},
+		Retired:        fdb.Exists(c, "retired"),
 	}
 
 	accountID := account.ID()
@@ -354,6 +475,44 @@ func (s *fdbStore) validateAccount(serverName, accountName string, c *fdb.Collec
 		return err
 	}
 
+	err = s.validateOrders(account, c)
+	if err != nil {
+		return err
+	}
+
+	err = s.validateExternalAccountBinding(account, c)
+	log.Errore(err, "failed to load external account binding, ignoring: ", accountID)
+
+	return nil
+}
+
+func (s *fdbStore) validateExternalAccountBinding(account *Account, c *fdb.Collection) error {
+	ec := c.Collection("external-account-binding")
+	if !fdb.Exists(ec, "key-id") {
+		return nil
+	}
+
+	keyID, err := fdb.String(ec.Open("key-id"))
+	if err != nil {
+		return err
+	}
+
+	hmacKey, err := fdb.String(ec.Open("hmac-key"))
+	if err != nil {
+		return err
+	}
+
+	eab := &ExternalAccountBinding{
+		KeyID:   strings.TrimSpace(keyID),
+		HMACKey: strings.TrimSpace(hmacKey),
+	}
+
+	err = eab.Validate()
+	if err != nil {
+		return err
+	}
+
+	account.ExternalAccountBinding = eab
 	return nil
 }
 
@@ -400,6 +559,31 @@ func (s *fdbStore) validateAuthorization(account *Account, authName string, c *f
 	return nil
 }
 
+func (s *fdbStore) validateOrders(account *Account, c *fdb.Collection) error {
+	oc := c.Collection("orders")
+
+	targetFilenames, err := oc.List()
+	if err != nil {
+		return err
+	}
+
+	for _, targetFilename := range targetFilenames {
+		orderURL, err := fdb.String(oc.Collection(targetFilename).Open("url"))
+		orderURL = strings.TrimSpace(orderURL)
+		if err != nil || !acmeapi.ValidURL(orderURL) {
+			log.Errore(err, "failed to load order, ignoring: ", targetFilename)
+			continue
+		}
+
+		account.Orders[targetFilename] = &Order{
+			TargetFilename: targetFilename,
+			URL:            orderURL,
+		}
+	}
+
+	return nil
+}
+
 func (s *fdbStore) loadKeys() error {
 	s.keys = map[string]*Key{}
 
@@ -425,19 +609,7 @@ func (s *fdbStore) loadKeys() error {
 }
 
 func (s *fdbStore) validateKey(keyID string, kc *fdb.Collection) error {
-	f, err := kc.Open("privkey")
-	if err != nil {
-		return err
-	}
-
-	defer f.Close()
-
-	b, err := ioutil.ReadAll(f)
-	if err != nil {
-		return err
-	}
-
-	pk, err := acmeutils.LoadPrivateKey(b)
+	pk, err := s.loadPrivateKey(kc)
 	if err != nil {
 		return err
 	}
@@ -525,8 +697,8 @@ func (s *fdbStore) validateCert(certID string, c *fdb.Collection) error {
 		keyID := determineKeyIDFromCert(xcrt)
 		crt.Key = s.keys[keyID]
 
-		if crt.Key != nil {
-			err := c.WriteLink("privkey", fdb.Link{Target: "keys/" + keyID + "/privkey"})
+		if crt.Key != nil && !s.readOnly {
+			err := s.linkCertificateKey(c, crt.Key)
 			if err != nil {
 				return err
 			}
@@ -536,6 +708,18 @@ func (s *fdbStore) validateCert(certID string, c *fdb.Collection) error {
 		crt.Cached = true
 	}
 
+	b, err := fdb.Bytes(c.Open("renewal-info"))
+	if err == nil {
+		ri := &RenewalInfo{}
+		err = yaml.Unmarshal(b, ri)
+		if err == nil {
+			crt.RenewalInfo = ri
+		} else {
+			// This is only a cache of information obtained from the issuer.
+			log.Errore(err, "failed to load renewal information for certificate, ignoring: ", certID)
+		}
+	}
+
 	s.certs[certID] = crt
 
 	return nil
@@ -558,11 +742,6 @@ func (s *fdbStore) loadTargets() error {
 		s.defaultTarget = &Target{}
 	}
 
-	// Legacy support. We have to do this here so that these defaults get copied
-	// across to the targets.
-	s.loadWebrootPaths()
-	s.loadRSAKeySize()
-
 	// targets
 	c := s.db.Collection("desired")
 
@@ -580,6 +759,36 @@ func (s *fdbStore) loadTargets() error {
 	return nil
 }
 
+func (s *fdbStore) loadTargetFailures() error {
+	s.failures = map[string]*TargetFailure{}
+
+	c := s.db.Collection("state/targets")
+
+	filenames, err := c.List()
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range filenames {
+		b, err := fdb.Bytes(c.Open(filename))
+		if err != nil {
+			return err
+		}
+
+		tf := &TargetFailure{}
+		err = yaml.Unmarshal(b, tf)
+		if err != nil {
+			log.Errore(err, "failed to load target failure record, ignoring: ", filename)
+			continue
+		}
+
+		tf.TargetFilename = filename
+		s.failures[filename] = tf
+	}
+
+	return nil
+}
+
 func (s *fdbStore) validateTarget(desiredKey string, c *fdb.Collection) error {
 	tgt, err := s.validateTargetInner(desiredKey, c, false)
 	if err != nil {
@@ -596,87 +805,62 @@ func (s *fdbStore) validateTargetInner(desiredKey string, c *fdb.Collection, loa
 		return nil, err
 	}
 
-	var tgt *Target
 	if loadingDefault {
-		tgt = &Target{}
-	} else {
-		tgt = s.defaultTarget.CopyGeneric()
-	}
-
-	tgt.Filename = desiredKey
-
-	err = yaml.Unmarshal(b, tgt)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(tgt.Satisfy.Names) == 0 {
-		if len(tgt.LegacyNames) > 0 {
-			tgt.Satisfy.Names = tgt.LegacyNames
-		} else {
-			tgt.Satisfy.Names = []string{desiredKey}
-		}
-	}
-
-	if tgt.Request.Provider == "" {
-		tgt.Request.Provider = tgt.LegacyProvider
-	}
-
-	err = normalizeNames(tgt.Satisfy.Names)
-	if err != nil {
-		return nil, fmt.Errorf("invalid target: %s: %v", desiredKey, err)
-	}
-
-	if len(tgt.Request.Names) == 0 {
-		tgt.Request.Names = tgt.Satisfy.Names
-		tgt.Request.implicitNames = true
+		return parseTarget(desiredKey, b, nil)
 	}
 
-	// tgt.Request.Account is not set; it is for use by other code.
-
-	return tgt, nil
+	return parseTarget(desiredKey, b, s.defaultTarget)
 }
 
 // Saving {{{1
 
 // Serializes the target to disk. Call after changing any settings.
 func (s *fdbStore) SaveTarget(t *Target) error {
-	// Some basic validation.
-	err := t.Validate()
+	b, err := marshalTarget(t, t == s.defaultTarget)
 	if err != nil {
 		return err
 	}
 
-	if t != s.defaultTarget {
-		t.ensureFilename()
+	// Save.
+	if t == s.defaultTarget {
+		return fdb.WriteBytes(s.db.Collection("conf"), "target", b)
 	}
 
-	tcopy := *t
+	return fdb.WriteBytes(s.db.Collection("desired"), t.Filename, b)
+}
 
-	if t == s.defaultTarget {
-		tcopy.genericise()
+func (s *fdbStore) RemoveTarget(filename string) error {
+	err := s.db.Collection("desired").Delete(filename)
+	if err != nil {
+		return err
 	}
 
-	// don't serialize default request names list
-	if tcopy.Request.implicitNames {
-		tcopy.Request.Names = nil
-	}
+	return s.RemoveTargetFailure(filename)
+}
 
-	b, err := yaml.Marshal(&tcopy)
+func (s *fdbStore) SaveTargetFailure(tf *TargetFailure) error {
+	b, err := yaml.Marshal(tf)
 	if err != nil {
 		return err
 	}
 
-	// Save.
-	if t == s.defaultTarget {
-		return fdb.WriteBytes(s.db.Collection("conf"), "target", b)
+	err = fdb.WriteBytes(s.db.Collection("state/targets"), tf.TargetFilename, b)
+	if err != nil {
+		return err
 	}
 
-	return fdb.WriteBytes(s.db.Collection("desired"), t.Filename, b)
+	s.failures[tf.TargetFilename] = tf
+	return nil
 }
 
-func (s *fdbStore) RemoveTarget(filename string) error {
-	return s.db.Collection("desired").Delete(filename)
+func (s *fdbStore) RemoveTargetFailure(filename string) error {
+	err := s.db.Collection("state/targets").Delete(filename)
+	if err != nil {
+		return err
+	}
+
+	delete(s.failures, filename)
+	return nil
 }
 
 func (s *fdbStore) SaveCertificate(cert *Certificate) error {
@@ -696,10 +880,28 @@ func (s *fdbStore) SaveCertificate(cert *Certificate) error {
 		}
 	}
 
+	if cert.RenewalInfo != nil {
+		b, err := yaml.Marshal(cert.RenewalInfo)
+		if err != nil {
+			return err
+		}
+
+		err = fdb.WriteBytes(c, "renewal-info", b)
+		if err != nil {
+			return err
+		}
+	}
+
 	if len(cert.Certificates) == 0 {
 		return nil
 	}
 
+	return saveCertificateFiles(c, cert.Certificates)
+}
+
+// Writes the "cert", "chain" and "fullchain" files of a certificate, given its
+// DER-encoded certificate chain, leaf first.
+func saveCertificateFiles(c *fdb.Collection, certificates [][]byte) error {
 	fcert, err := c.Create("cert")
 	if err != nil {
 		return err
@@ -718,12 +920,12 @@ func (s *fdbStore) SaveCertificate(cert *Certificate) error {
 	}
 	defer ffullchain.CloseAbort()
 
-	err = acmeutils.SaveCertificates(io.MultiWriter(fcert, ffullchain), cert.Certificates[0])
+	err = acmeutils.SaveCertificates(io.MultiWriter(fcert, ffullchain), certificates[0])
 	if err != nil {
 		return err
 	}
 
-	for _, ec := range cert.Certificates[1:] {
+	for _, ec := range certificates[1:] {
 		err = acmeutils.SaveCertificates(io.MultiWriter(fchain, ffullchain), ec)
 		if err != nil {
 			return err
@@ -738,20 +940,15 @@ func (s *fdbStore) SaveCertificate(cert *Certificate) error {
 }
 
 func (s *fdbStore) SaveAccount(a *Account) error {
-	coll := s.db.Collection("accounts/" + a.ID())
-	w, err := coll.Create("privkey")
-	if err != nil {
-		return err
-	}
-	defer w.CloseAbort()
+	return s.saveAccountTo(s.db.Collection("accounts/"+a.ID()), a)
+}
 
-	err = acmeutils.SavePrivateKey(w, a.PrivateKey)
+func (s *fdbStore) saveAccountTo(coll *fdb.Collection, a *Account) error {
+	err := s.saveKey(coll, a.PrivateKey)
 	if err != nil {
 		return err
 	}
 
-	w.Close()
-
 	for _, auth := range a.Authorizations {
 		c := coll.Collection("authorizations/" + auth.Name)
 
@@ -766,6 +963,217 @@ func (s *fdbStore) SaveAccount(a *Account) error {
 		}
 	}
 
+	if a.ExternalAccountBinding != nil {
+		ec := coll.Collection("external-account-binding")
+
+		err := fdb.WriteBytes(ec, "key-id", []byte(a.ExternalAccountBinding.KeyID))
+		if err != nil {
+			return err
+		}
+
+		err = fdb.WriteBytes(ec, "hmac-key", []byte(a.ExternalAccountBinding.HMACKey))
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.Retired {
+		err := fdb.CreateEmpty(coll, "retired")
+		if err != nil {
+			return err
+		}
+	} else {
+		err := coll.Delete("retired")
+		if err != nil {
+			return err
+		}
+	}
+
+	oc := coll.Collection("orders")
+	for _, order := range a.Orders {
+		err := fdb.WriteBytes(oc.Collection(order.TargetFilename), "url", []byte(order.URL))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Orders which are no longer in progress are removed.
+	targetFilenames, err := oc.List()
+	if err != nil {
+		return err
+	}
+
+	for _, targetFilename := range targetFilenames {
+		if _, ok := a.Orders[targetFilename]; !ok {
+			err := oc.Delete(targetFilename)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Replaces the private key of an account. Since the account ID is derived from
+// the key, the account directory is written under its new ID in a hidden
+// staging directory first. commit is then called to change the key on the
+// server; if the server rejects the change, the staging directory is
+// discarded and the account is left untouched. If commit fails otherwise, it
+// is not known whether the server changed the key, so the staging directory
+// is kept for recoverRekeys to install. Otherwise the old account is retired,
+// the staging directory is renamed into place and the old account directory
+// is removed.
+func (s *fdbStore) RekeyAccount(a *Account, newKey crypto.PrivateKey, commit func() error) (*Account, error) {
+	serverPart, err := accountURLPart(a.DirectoryURL)
+	if err != nil {
+		return nil, err
+	}
+
+	newKeyID, err := determineKeyIDFromKey(newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	newAccountID := serverPart + "/" + newKeyID
+	if _, ok := s.accounts[newAccountID]; ok {
+		return nil, fmt.Errorf("account already exists: %s", newAccountID)
+	}
+
+	na := *a
+	na.PrivateKey = newKey
+	oldAccountID := a.ID()
+
+	sc := s.db.Collection("accounts/" + serverPart)
+	stagingName := rekeyStagingPrefix + newKeyID
+	err = sc.Delete(stagingName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.saveAccountTo(sc.Collection(stagingName), &na)
+	if err != nil {
+		sc.Delete(stagingName)
+		return nil, err
+	}
+
+	// From here on, the server may accept only the new key, so the staged key
+	// must not be lost if the process dies. See recoverRekeys.
+	err = fdb.WriteBytes(sc.Collection(stagingName), rekeyCommittingFilename, []byte(oldAccountID+"\n"))
+	if err != nil {
+		sc.Delete(stagingName)
+		return nil, err
+	}
+
+	err = commit()
+	if serverRejected(err) {
+		sc.Delete(stagingName)
+		return nil, err
+	} else if err != nil {
+		log.Warnf("failed to change key of account %s, but the server may have changed it; the new key will be installed when the state directory is next opened: %v",
+			oldAccountID, err)
+		return nil, err
+	}
+
+	// Until the old account directory is removed, two accounts exist for the
+	// server. Retire the old one first so that it is never used again.
+	err = fdb.CreateEmpty(s.db.Collection("accounts/"+oldAccountID), "retired")
+	if err != nil {
+		return nil, err
+	}
+
+	err = sc.Rename(stagingName, newKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sc.Collection(newKeyID).Delete(rekeyCommittingFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(s.accounts, oldAccountID)
+	s.accounts[newAccountID] = &na
+
+	err = s.db.Collection("accounts").Delete(oldAccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &na, nil
+}
+
+// Name prefix of the hidden collections, within the collection for a
+// server, in which new account keys are staged while rekeying.
+const rekeyStagingPrefix = ".rekey-"
+
+// Written into a staging collection before the server is asked to change the
+// account key. Contains the ID of the account being rekeyed.
+const rekeyCommittingFilename = "committing"
+
+// Finishes or abandons rekeying interrupted by the process dying. If it died
+// before the server was asked to change the key, the staged key is discarded.
+// Otherwise, it is not known whether the server changed the key, so the
+// staged key is installed as a new account and the old account is retired
+// rather than removed, so that neither key is lost.
+//
+// Nothing is done if another process holds the lock, as it may be rekeying.
+func (s *fdbStore) recoverRekeys() error {
+	staged, err := filepath.Glob(filepath.Join(s.path, "accounts", "*", rekeyStagingPrefix+"*"))
+	if err != nil || len(staged) == 0 {
+		return err
+	}
+
+	err = s.db.Lock(false)
+	if err == fdb.ErrLocked {
+		log.Debugf("not recovering interrupted account rekeying, as the state directory is locked")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer s.db.Unlock()
+
+	for _, p := range staged {
+		serverPart, stagingName := filepath.Base(filepath.Dir(p)), filepath.Base(p)
+		sc := s.db.Collection("accounts/" + serverPart)
+
+		oldAccountID, err := fdb.String(sc.Collection(stagingName).Open(rekeyCommittingFilename))
+		if os.IsNotExist(err) {
+			log.Noticef("discarding account key staged by interrupted rekeying: %s", p)
+			err = sc.Delete(stagingName)
+			if err != nil {
+				return err
+			}
+
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		oldAccountID = strings.TrimSpace(oldAccountID)
+		newKeyID := strings.TrimPrefix(stagingName, rekeyStagingPrefix)
+		log.Warnf("rekeying of account %s was interrupted, so it is not known whether the server accepted the new key; installing the new key as account %s/%s and retiring the old account",
+			oldAccountID, serverPart, newKeyID)
+
+		err = sc.Rename(stagingName, newKeyID)
+		if err != nil {
+			return err
+		}
+
+		err = sc.Collection(newKeyID).Delete(rekeyCommittingFilename)
+		if err != nil {
+			return err
+		}
+
+		oc := s.db.Collection("accounts/" + oldAccountID)
+		if fdb.Exists(oc, "privkey") {
+			err = fdb.CreateEmpty(oc, "retired")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -797,6 +1205,11 @@ func (s *fdbStore) RemoveKey(keyID string) error {
 		return err
 	}
 
+	err = s.db.Collection("export").Delete(keyID)
+	if err != nil {
+		return err
+	}
+
 	delete(s.keys, keyID)
 	return nil
 }
@@ -881,8 +1294,24 @@ func (s *fdbStore) ImportAccount(directoryURL string, privateKey crypto.PrivateK
 	return a, nil
 }
 
-// Saves a key as a file named "privkey" inside the given collection.
+// Saves a key as a file named "privkey" inside the given collection,
+// encrypting it if a master key is used.
 func (s *fdbStore) saveKey(c *fdb.Collection, privateKey crypto.PrivateKey) error {
+	if s.crypter == nil {
+		return s.savePlaintextKey(c, privateKey)
+	}
+
+	b, err := s.crypter.encodePrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	return fdb.WriteBytes(c, "privkey", b)
+}
+
+// Saves a key unencrypted as a file named "privkey" inside the given
+// collection.
+func (s *fdbStore) savePlaintextKey(c *fdb.Collection, privateKey crypto.PrivateKey) error {
 	f, err := c.Create("privkey")
 	if err != nil {
 		return err
@@ -897,6 +1326,60 @@ func (s *fdbStore) saveKey(c *fdb.Collection, privateKey crypto.PrivateKey) erro
 	return f.Close()
 }
 
+// Loads the key in the file named "privkey" inside the given collection,
+// decrypting it if necessary. If a master key is used and the key is not
+// encrypted, it is encrypted once loading is complete.
+func (s *fdbStore) loadPrivateKey(c *fdb.Collection) (crypto.PrivateKey, error) {
+	b, err := fdb.Bytes(c.Open("privkey"))
+	if err != nil {
+		return nil, err
+	}
+
+	pk, encrypted, err := s.crypter.decodePrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if !encrypted && s.crypter != nil && !s.readOnly {
+		s.unencryptedKeys = append(s.unencryptedKeys, unencryptedKey{c, pk})
+	}
+
+	return pk, nil
+}
+
+// Encrypts the keys found unencrypted while loading.
+func (s *fdbStore) encryptUnencryptedKeys() error {
+	for _, uk := range s.unencryptedKeys {
+		log.Debugf("encrypting private key in %s", uk.c.Name())
+		err := s.saveKey(uk.c, uk.pk)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.unencryptedKeys = nil
+	return nil
+}
+
+// Links the "privkey" file of a certificate to its private key. If a master
+// key is used, the key is exported unencrypted for use by daemons, and the
+// link points to the exported key.
+func (s *fdbStore) linkCertificateKey(c *fdb.Collection, k *Key) error {
+	if s.crypter == nil {
+		return c.WriteLink("privkey", fdb.Link{Target: "keys/" + k.ID + "/privkey"})
+	}
+
+	ec := s.db.Collection("export/" + k.ID)
+	if !fdb.Exists(ec, "privkey") {
+		err := s.savePlaintextKey(ec, k.PrivateKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.WriteLink("privkey", fdb.Link{Target: "export/" + k.ID + "/privkey"})
+}
+
 // Save a private key inside a key ID collection under the given collection.
 func (s *fdbStore) saveKeyUnderID(c *fdb.Collection, privateKey crypto.PrivateKey) (keyID string, err error) {
 	keyID, err = determineKeyIDFromKey(privateKey)
@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// In-memory ACME client store. {{{1
+
+// A store which keeps everything in memory. It behaves like a state directory
+// which is never modified by anything else: objects are identified in the same
+// way, and, as with a state directory, saved targets are only parsed (and
+// hence only visible) once Reload is called, and the certificate key and
+// cached status of certificates are determined on Reload.
+//
+// Objects are kept by reference, so changes to them are visible without
+// saving them, unlike with a state directory.
+type memStore struct {
+	certs     map[string]*Certificate   // key: certificate ID
+	accounts  map[string]*Account       // key: account ID
+	keys      map[string]*Key           // key: key ID
+	targets   map[string]*Target        // key: target filename
+	preferred map[string]*Certificate   // key: hostname
+	failures  map[string]*TargetFailure // key: target filename
+
+	defaultTarget *Target
+
+	// Serialized targets, as they would be stored in "desired" and
+	// "conf/target".
+	targetFiles       map[string][]byte // key: target filename
+	defaultTargetFile []byte
+
+	// Files written using WriteMiscellaneousConfFile.
+	confFiles map[string][]byte // key: filename
+
+	locked bool
+}
+
+// Create a new, empty, in-memory store. This is intended for tests and for
+// applications which embed the library and manage their own persistence.
+func NewMem() (Store, error) {
+	s := &memStore{
+		certs:       map[string]*Certificate{},
+		accounts:    map[string]*Account{},
+		keys:        map[string]*Key{},
+		targets:     map[string]*Target{},
+		preferred:   map[string]*Certificate{},
+		failures:    map[string]*TargetFailure{},
+		targetFiles: map[string][]byte{},
+		confFiles:   map[string][]byte{},
+	}
+
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+var errNeutered = errors.New("cannot store private keys after the storage package has been neutered")
+
+func (s *memStore) Close() error {
+	s.locked = false
+	return nil
+}
+
+// An in-memory store has no path.
+func (s *memStore) Path() string {
+	return ""
+}
+
+// Parses saved targets and determines the keys of certificates.
+func (s *memStore) Reload() error {
+	for _, c := range s.certs {
+		c.Cached = len(c.Certificates) > 0
+		c.Key = nil
+		if !c.Cached {
+			continue
+		}
+
+		xcrt, err := x509.ParseCertificate(c.Certificates[0])
+		if err != nil {
+			return err
+		}
+
+		c.Key = s.keys[determineKeyIDFromCert(xcrt)]
+	}
+
+	for _, a := range s.accounts {
+		if a.Authorizations == nil {
+			a.Authorizations = map[string]*Authorization{}
+		}
+		if a.Orders == nil {
+			a.Orders = map[string]*Order{}
+		}
+	}
+
+	return s.loadTargets()
+}
+
+func (s *memStore) loadTargets() error {
+	s.defaultTarget = &Target{}
+	if s.defaultTargetFile != nil {
+		dtgt, err := parseTarget("target", s.defaultTargetFile, nil)
+		if err != nil {
+			log.Errore(err, "error loading default target file")
+		} else {
+			dtgt.genericise()
+			s.defaultTarget = dtgt
+		}
+	}
+
+	s.targets = map[string]*Target{}
+	for filename, b := range s.targetFiles {
+		tgt, err := parseTarget(filename, b, s.defaultTarget)
+		log.Errore(err, "failed to load target ", filename)
+		if err == nil {
+			s.targets[filename] = tgt
+		}
+	}
+
+	return nil
+}
+
+func (s *memStore) Lock(wait bool) error {
+	if s.locked {
+		return errors.New("store is already locked")
+	}
+
+	s.locked = true
+	return nil
+}
+
+func (s *memStore) Unlock() error {
+	if !s.locked {
+		return errors.New("store is not locked")
+	}
+
+	s.locked = false
+	return nil
+}
+
+func (s *memStore) WriteMiscellaneousConfFile(filename string, data []byte) error {
+	s.confFiles[filename] = append([]byte(nil), data...)
+	return nil
+}
+
+// Trivial accessors. {{{1
+
+func (s *memStore) AccountByID(accountID string) *Account {
+	return s.accounts[accountID]
+}
+
+func (s *memStore) AccountByDirectoryURL(directoryURL string) *Account {
+	for _, a := range s.accounts {
+		if !a.Retired && a.MatchesURL(directoryURL) {
+			return a
+		}
+	}
+
+	return nil
+}
+
+func (s *memStore) VisitAccounts(f func(a *Account) error) error {
+	for _, a := range s.accounts {
+		err := f(a)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *memStore) CertificateByID(certificateID string) *Certificate {
+	return s.certs[certificateID]
+}
+
+func (s *memStore) VisitCertificates(f func(c *Certificate) error) error {
+	for _, c := range s.certs {
+		err := f(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *memStore) KeyByID(keyID string) *Key {
+	return s.keys[keyID]
+}
+
+func (s *memStore) VisitKeys(f func(k *Key) error) error {
+	for _, k := range s.keys {
+		err := f(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *memStore) TargetByFilename(filename string) *Target {
+	return s.targets[filename]
+}
+
+func (s *memStore) VisitTargets(f func(t *Target) error) error {
+	for _, t := range s.targets {
+		err := f(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Return the default target. Persist changes to the default target by calling SaveTarget.
+func (s *memStore) DefaultTarget() *Target {
+	return s.defaultTarget
+}
+
+func (s *memStore) TargetFailure(filename string) *TargetFailure {
+	return s.failures[filename]
+}
+
+func (s *memStore) VisitPreferredCertificates(f func(hostname string, c *Certificate) error) error {
+	for hostname, c := range s.preferred {
+		err := f(hostname, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *memStore) PreferredCertificateForHostname(hostname string) (*Certificate, error) {
+	c := s.preferred[hostname]
+	if c == nil {
+		return nil, fmt.Errorf("not found: %q", hostname)
+	}
+
+	return c, nil
+}
+
+func (s *memStore) SetPreferredCertificateForHostname(hostname string, c *Certificate) error {
+	if s.certs[c.ID()] == nil {
+		return fmt.Errorf("certificate does not exist: %s", c.ID())
+	}
+
+	s.preferred[hostname] = c
+	return nil
+}
+
+// Saving {{{1
+
+func (s *memStore) SaveTarget(t *Target) error {
+	b, err := marshalTarget(t, t == s.defaultTarget)
+	if err != nil {
+		return err
+	}
+
+	if t == s.defaultTarget {
+		s.defaultTargetFile = b
+	} else {
+		s.targetFiles[t.Filename] = b
+	}
+
+	return nil
+}
+
+func (s *memStore) RemoveTarget(filename string) error {
+	delete(s.targetFiles, filename)
+	return s.RemoveTargetFailure(filename)
+}
+
+func (s *memStore) SaveTargetFailure(tf *TargetFailure) error {
+	s.failures[tf.TargetFilename] = tf
+	return nil
+}
+
+func (s *memStore) RemoveTargetFailure(filename string) error {
+	delete(s.failures, filename)
+	return nil
+}
+
+func (s *memStore) SaveCertificate(cert *Certificate) error {
+	s.certs[cert.ID()] = cert
+	return nil
+}
+
+func (s *memStore) SaveAccount(a *Account) error {
+	s.accounts[a.ID()] = a
+	return nil
+}
+
+func (s *memStore) RekeyAccount(a *Account, newKey crypto.PrivateKey, commit func() error) (*Account, error) {
+	newAccountID, err := determineAccountID(a.DirectoryURL, newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.accounts[newAccountID]; ok {
+		return nil, fmt.Errorf("account already exists: %s", newAccountID)
+	}
+
+	err = commit()
+	if err != nil {
+		return nil, err
+	}
+
+	na := *a
+	na.PrivateKey = newKey
+
+	delete(s.accounts, a.ID())
+	s.accounts[newAccountID] = &na
+	return &na, nil
+}
+
+// Removal {{{1
+
+func (s *memStore) RemoveCertificate(certificateID string) error {
+	_, ok := s.certs[certificateID]
+	if !ok {
+		return fmt.Errorf("certificate does not exist: %s", certificateID)
+	}
+
+	delete(s.certs, certificateID)
+	return nil
+}
+
+func (s *memStore) RemoveKey(keyID string) error {
+	_, ok := s.keys[keyID]
+	if !ok {
+		return fmt.Errorf("key does not exist: %s", keyID)
+	}
+
+	delete(s.keys, keyID)
+	return nil
+}
+
+// Importing {{{1
+
+func (s *memStore) ImportKey(privateKey crypto.PrivateKey) (*Key, error) {
+	if isNeutered {
+		return nil, errNeutered
+	}
+
+	keyID, err := determineKeyIDFromKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	k, ok := s.keys[keyID]
+	if ok {
+		return k, nil
+	}
+
+	hasTouchedSensitiveData = true
+	k = &Key{
+		PrivateKey: privateKey,
+		ID:         keyID,
+	}
+
+	s.keys[keyID] = k
+	return k, nil
+}
+
+func (s *memStore) ImportCertificate(url string) (*Certificate, error) {
+	certID := determineCertificateID(url)
+	c, ok := s.certs[certID]
+	if ok {
+		return c, nil
+	}
+
+	c = &Certificate{
+		URL: url,
+	}
+
+	s.certs[certID] = c
+	return c, nil
+}
+
+func (s *memStore) ImportAccount(directoryURL string, privateKey crypto.PrivateKey) (*Account, error) {
+	if isNeutered {
+		return nil, errNeutered
+	}
+
+	accountID, err := determineAccountID(directoryURL, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	a, ok := s.accounts[accountID]
+	if ok {
+		return a, nil
+	}
+
+	hasTouchedSensitiveData = true
+	a = &Account{
+		PrivateKey:   privateKey,
+		DirectoryURL: directoryURL,
+	}
+
+	s.accounts[accountID] = a
+	return a, nil
+}
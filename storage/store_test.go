@@ -0,0 +1,544 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/hlandau/acme/acmeapi"
+	"github.com/hlandau/acme/fdb"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestFDBStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	testStore(t, s)
+}
+
+func TestFDBRekeyRecovery(t *testing.T) {
+	const directoryURL = "https://ca.test/directory"
+
+	dir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := s.ImportAccount(directoryURL, testPrivateKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate the process dying once the server has been asked to change the
+	// key.
+	npk := testPrivateKey(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.RekeyAccount(a, npk, func() error {
+			runtime.Goexit()
+			return nil
+		})
+	}()
+	<-done
+	s.Close()
+
+	// Simulate the process dying before then for another key.
+	serverPart, _ := accountURLPart(directoryURL)
+	abandoned := filepath.Join(dir, "accounts", serverPart, rekeyStagingPrefix+"abandoned")
+	writeStateFiles(t, dir, map[string]string{
+		filepath.Join("accounts", serverPart, rekeyStagingPrefix+"abandoned", "privkey"): "",
+	})
+
+	s, err = NewFDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	newAccountID, _ := determineAccountID(directoryURL, npk)
+	na := s.AccountByID(newAccountID)
+	if na == nil || na.Retired || s.AccountByDirectoryURL(directoryURL) != na {
+		t.Fatalf("staged key not installed: %#v", na)
+	}
+
+	if oa := s.AccountByID(a.ID()); oa == nil || !oa.Retired {
+		t.Fatalf("old account not retired: %#v", oa)
+	}
+
+	if _, err := os.Stat(abandoned); !os.IsNotExist(err) {
+		t.Fatalf("abandoned staged key not removed: %v", err)
+	}
+}
+
+func TestFDBRekeyFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testRekeyFailure(t, func() Store {
+		s, err := NewFDB(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	})
+}
+
+func TestBoltRekeyFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testRekeyFailure(t, func() Store {
+		s, err := NewBolt(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	})
+}
+
+var errRekeyRejected = &acmeapi.HTTPError{
+	Res:     &http.Response{Status: "400 Bad Request"},
+	Problem: &acmeapi.Problem{Type: string(acmeapi.ErrMalformed)},
+}
+
+// Tests that a persistent store, opened by calling open, keeps a new account
+// key if changing it with the server fails without the server rejecting the
+// change, since the server may have changed it anyway.
+func testRekeyFailure(t *testing.T, open func() Store) {
+	const directoryURL = "https://ca.test/directory"
+
+	s := open()
+	a, err := s.ImportAccount(directoryURL, testPrivateKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A rejected change is forgotten.
+	rpk := testPrivateKey(t)
+	_, err = s.RekeyAccount(a, rpk, func() error {
+		return errRekeyRejected
+	})
+	if err != errRekeyRejected {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	npk := testPrivateKey(t)
+	_, err = s.RekeyAccount(a, npk, func() error {
+		return errors.New("connection reset")
+	})
+	if err == nil {
+		t.Fatalf("rekeying succeeded despite failure")
+	}
+	s.Close()
+
+	s = open()
+	defer s.Close()
+
+	rejectedAccountID, _ := determineAccountID(directoryURL, rpk)
+	if s.AccountByID(rejectedAccountID) != nil {
+		t.Fatalf("rejected key installed")
+	}
+
+	newAccountID, _ := determineAccountID(directoryURL, npk)
+	na := s.AccountByID(newAccountID)
+	if na == nil || na.Retired || s.AccountByDirectoryURL(directoryURL) != na {
+		t.Fatalf("new key not installed: %#v", na)
+	}
+
+	if oa := s.AccountByID(a.ID()); oa == nil || !oa.Retired {
+		t.Fatalf("old account not retired: %#v", oa)
+	}
+}
+
+func TestFDBReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.SaveTarget(&Target{
+		Filename: "example.com",
+		Satisfy:  TargetSatisfy{Names: []string{"example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	leftover := filepath.Join("tmp", "leftover")
+	writeStateFiles(t, dir, map[string]string{leftover: ""})
+
+	s, err = NewFDBWithConfig(FDBConfig{Path: dir, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tgt := s.TargetByFilename("example.com")
+	if tgt == nil {
+		t.Fatalf("target not loaded")
+	}
+
+	err = s.SaveTarget(tgt)
+	if !errors.Is(err, fdb.ErrReadOnly) {
+		t.Fatalf("unexpected error saving to read-only state directory: %v", err)
+	}
+
+	err = s.Lock(false)
+	if !errors.Is(err, fdb.ErrReadOnly) {
+		t.Fatalf("unexpected error locking read-only state directory: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, leftover)); err != nil {
+		t.Fatalf("opening read-only changed the state directory: %v", err)
+	}
+
+	// A state directory which needs migrating cannot be opened read-only.
+	legacyDir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(legacyDir)
+
+	writeStateFiles(t, legacyDir, legacyStateFiles)
+
+	_, err = NewFDBWithConfig(FDBConfig{Path: legacyDir, ReadOnly: true})
+	if err != ErrSchemaTooOld {
+		t.Fatalf("unexpected error opening unmigrated state directory read-only: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(legacyDir, "tmp")); !os.IsNotExist(err) {
+		t.Fatalf("unmigrated state directory was opened: %v", err)
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBolt(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	testStore(t, s)
+
+	// The database is locked while it is open.
+	_, err = NewBolt(dir)
+	if err != ErrLocked {
+		t.Fatalf("unexpected error opening database twice: %v", err)
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	s, err := NewMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	testStore(t, s)
+}
+
+// Tests the behaviour common to all Store implementations, given an empty
+// store.
+func testStore(t *testing.T, s Store) {
+	const directoryURL = "https://ca.test/directory"
+
+	if s.DefaultTarget() == nil {
+		t.Fatalf("no default target")
+	}
+
+	// Keys.
+	pk := testPrivateKey(t)
+	k, err := s.ImportKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyID, _ := determineKeyIDFromKey(pk)
+	if k.ID != keyID || s.KeyByID(keyID) != k {
+		t.Fatalf("unexpected key: %v", k)
+	}
+
+	if k2, err := s.ImportKey(pk); err != nil || k2 != k {
+		t.Fatalf("key imported twice: %v %v", k2, err)
+	}
+
+	// Accounts.
+	apk := testPrivateKey(t)
+	a, err := s.ImportAccount(directoryURL, apk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accountID, _ := determineAccountID(directoryURL, apk)
+	if a.ID() != accountID || s.AccountByID(accountID) != a || s.AccountByDirectoryURL(directoryURL) != a {
+		t.Fatalf("unexpected account: %v", a)
+	}
+
+	if a2, err := s.ImportAccount(directoryURL, apk); err != nil || a2 != a {
+		t.Fatalf("account imported twice: %v %v", a2, err)
+	}
+
+	// Certificates.
+	const certURL = "https://ca.test/cert/1"
+	c, err := s.ImportCertificate(certURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certID := determineCertificateID(certURL)
+	if c.ID() != certID || s.CertificateByID(certID) != c || c.Cached {
+		t.Fatalf("unexpected certificate: %v", c)
+	}
+
+	c.Certificates = [][]byte{testCertificate(t, pk, "example.com")}
+	c.Cached = true
+	err = s.SaveCertificate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Targets. Saved targets only become visible on reload.
+	dt := s.DefaultTarget()
+	dt.Request.Provider = directoryURL
+	err = s.SaveTarget(dt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tgt := &Target{
+		Satisfy: TargetSatisfy{
+			Names: []string{"example.com"},
+		},
+	}
+	err = s.SaveTarget(tgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tgt.Filename == "" {
+		t.Fatalf("target not given a filename")
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.DefaultTarget().Request.Provider != directoryURL {
+		t.Fatalf("default target not saved")
+	}
+
+	tgt2 := s.TargetByFilename(tgt.Filename)
+	if tgt2 == nil {
+		t.Fatalf("target not saved")
+	}
+
+	if tgt2.Request.Provider != directoryURL || len(tgt2.Request.Names) != 1 || tgt2.Request.Names[0] != "example.com" {
+		t.Fatalf("unexpected target: %#v", tgt2)
+	}
+
+	// The certificate key is found on reload.
+	c = s.CertificateByID(certID)
+	if c == nil || !c.Cached || c.Key == nil || c.Key.ID != keyID {
+		t.Fatalf("unexpected certificate after reload: %#v", c)
+	}
+
+	// Preferred certificates.
+	err = s.SetPreferredCertificateForHostname("example.com", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := s.PreferredCertificateForHostname("example.com")
+	if err != nil || pc.ID() != certID {
+		t.Fatalf("unexpected preferred certificate: %v %v", pc, err)
+	}
+
+	if _, err := s.PreferredCertificateForHostname("example.net"); err == nil {
+		t.Fatalf("unexpected preferred certificate")
+	}
+
+	// Target failures.
+	tf := &TargetFailure{
+		TargetFilename: tgt.Filename,
+		Count:          1,
+		NextAttempt:    time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+	err = s.SaveTargetFailure(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf2 := s.TargetFailure(tgt.Filename)
+	if tf2 == nil || tf2.Count != 1 || !tf2.NextAttempt.Equal(tf.NextAttempt) {
+		t.Fatalf("unexpected target failure: %#v", tf2)
+	}
+
+	// Removing a target removes its failure record.
+	err = s.RemoveTarget(tgt.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.TargetByFilename(tgt.Filename) != nil || s.TargetFailure(tgt.Filename) != nil {
+		t.Fatalf("target not removed")
+	}
+
+	// Rekeying is abandoned if the server rejects the change.
+	a = s.AccountByID(accountID)
+	npk := testPrivateKey(t)
+	_, err = s.RekeyAccount(a, npk, func() error {
+		return errRekeyRejected
+	})
+	if err == nil || s.AccountByID(accountID) == nil {
+		t.Fatalf("account rekeyed despite failure: %v", err)
+	}
+
+	na, err := s.RekeyAccount(a, npk, func() error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newAccountID, _ := determineAccountID(directoryURL, npk)
+	if na.ID() != newAccountID || s.AccountByID(accountID) != nil || s.AccountByDirectoryURL(directoryURL) != na {
+		t.Fatalf("account not rekeyed: %v", na)
+	}
+
+	// Retired accounts are not used.
+	na.Retired = true
+	err = s.SaveAccount(na)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.AccountByID(newAccountID) == nil || s.AccountByDirectoryURL(directoryURL) != nil {
+		t.Fatalf("retired account used")
+	}
+
+	// Locking.
+	err = s.Lock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Unlock() == nil {
+		t.Fatalf("unlocked twice")
+	}
+
+	// Removal.
+	err = s.RemoveCertificate(certID)
+	if err != nil || s.CertificateByID(certID) != nil {
+		t.Fatalf("certificate not removed: %v", err)
+	}
+
+	err = s.RemoveKey(keyID)
+	if err != nil || s.KeyByID(keyID) != nil {
+		t.Fatalf("key not removed: %v", err)
+	}
+
+	if s.RemoveKey(keyID) == nil {
+		t.Fatalf("key removed twice")
+	}
+}
+
+func testPrivateKey(t *testing.T) crypto.PrivateKey {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pk
+}
+
+// Returns a DER-encoded self-signed certificate for the given name.
+func testCertificate(t *testing.T, pk crypto.PrivateKey, name string) []byte {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, getPublicKey(pk), pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
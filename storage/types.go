@@ -3,10 +3,13 @@ package storage
 import (
 	"crypto"
 	"encoding/base32"
+	"encoding/base64"
 	"fmt"
 	"github.com/hlandau/acme/acmeapi"
 	"github.com/jmhodges/clock"
 	"github.com/satori/go.uuid"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -22,6 +25,17 @@ type Account struct {
 	// Disposable. Authorizations.
 	Authorizations map[string]*Authorization
 
+	// Disposable. In-progress orders, keyed by target filename.
+	Orders map[string]*Order
+
+	// N. External account binding credentials used when registering the
+	// account, if the provider requires them.
+	ExternalAccountBinding *ExternalAccountBinding
+
+	// N. True if the account has been deactivated with the provider. Retired
+	// accounts are kept for reference but are never used.
+	Retired bool
+
 	// ID: determined from DirectoryURL and PrivateKey.
 	// Path: formed from ID.
 	// Registration URL: can be recovered automatically.
@@ -44,6 +58,34 @@ func (a *Account) String() string {
 	return fmt.Sprintf("Account(%v)", a.ID())
 }
 
+// External account binding credentials, as issued by a provider.
+type ExternalAccountBinding struct {
+	// N. The MAC key identifier.
+	KeyID string `yaml:"key-id,omitempty"`
+
+	// N. The MAC key, in the base64url form in which providers issue it.
+	HMACKey string `yaml:"hmac-key,omitempty"`
+}
+
+// Returns the decoded MAC key.
+func (eab *ExternalAccountBinding) DecodeHMACKey() ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(eab.HMACKey), "="))
+}
+
+// Validates the credentials for basic sanity.
+func (eab *ExternalAccountBinding) Validate() error {
+	if eab.KeyID == "" {
+		return fmt.Errorf("external account binding key ID must be specified")
+	}
+
+	k, err := eab.DecodeHMACKey()
+	if err != nil || len(k) == 0 {
+		return fmt.Errorf("external account binding HMAC key must be a non-empty base64url string")
+	}
+
+	return nil
+}
+
 // Represents an authorization.
 type Authorization struct {
 	// N. The authorized hostname.
@@ -61,11 +103,49 @@ func (a *Authorization) IsValid(clock clock.Clock) bool {
 	return clock.Now().Before(a.Expires)
 }
 
+// Represents an order which is in progress. Orders are recorded so that an
+// interrupted reconcile can resume them rather than creating new orders.
+type Order struct {
+	// N. The filename of the target for which the order was created.
+	TargetFilename string
+
+	// N. The order URL.
+	URL string
+}
+
+// Records failed attempts to obtain a certificate for a target, so that
+// further attempts can be delayed. Removed once a certificate is obtained.
+type TargetFailure struct {
+	// N. The filename of the target.
+	TargetFilename string `yaml:"-"`
+
+	// N. The number of consecutive failed attempts.
+	Count int `yaml:"count"`
+
+	// N. No further attempt should be made before this time.
+	NextAttempt time.Time `yaml:"next-attempt"`
+
+	// N. The most recent failed attempts, oldest first.
+	History []FailedAttempt `yaml:"history,omitempty"`
+}
+
+// A failed attempt to obtain a certificate for a target.
+type FailedAttempt struct {
+	Time  time.Time `yaml:"time"`
+	Error string    `yaml:"error"`
+}
+
+// Returns true iff no attempt to obtain a certificate should be made yet.
+func (tf *TargetFailure) InBackoff(clock clock.Clock) bool {
+	return clock.Now().Before(tf.NextAttempt)
+}
+
 // Represents the "satisfy" section of a target file.
 type TargetSatisfy struct {
 	// N. List of SANs required to satisfy this target. May include hostnames
-	// (and maybe one day SRV-IDs). May include wildcard hostnames, but ACME
-	// doesn't support those yet.
+	// (and maybe one day SRV-IDs). May include wildcard hostnames such as
+	// "*.example.com", which can only be obtained using dns-01 from providers
+	// supporting orders.
 	Names []string `yaml:"names,omitempty"`
 
 	// D. Reduced name set, after disjunction operation. Derived from Names.
@@ -99,6 +179,15 @@ type TargetRequest struct {
 
 	// N. Request OCSP Must Staple in CSRs?
 	OCSPMustStaple bool `yaml:"ocsp-must-staple,omitempty"`
+
+	// Settings controlling when certificates satisfying the target are
+	// renewed.
+	Renewal TargetRequestRenewal `yaml:"renewal,omitempty"`
+
+	// N. External account binding credentials, keyed by provider directory
+	// URL. Used when registering an account with a provider which requires
+	// them.
+	ExternalAccountBindings map[string]*ExternalAccountBinding `yaml:"external-account-bindings,omitempty"`
 }
 
 // Settings for keys generated as part of certificate requests.
@@ -128,6 +217,101 @@ func (k *TargetRequestKey) String() string {
 	}
 }
 
+// Settings controlling when certificates are renewed. If neither Margin nor
+// LifetimeFraction is set, certificates are renewed 30 days before expiry or
+// when a third of their validity period remains, whichever is later.
+type TargetRequestRenewal struct {
+	// N. Renew certificates once they are within this duration of expiry.
+	Margin Duration `yaml:"margin,omitempty"`
+
+	// N. Renew certificates once this fraction of their validity period
+	// remains, e.g. 0.33. If Margin is also set, whichever is later applies.
+	LifetimeFraction float64 `yaml:"lifetime-fraction,omitempty"`
+
+	// N. Renew certificates up to this much earlier than otherwise, by an
+	// amount chosen at random for each certificate, so that certificates
+	// issued together are not all renewed together.
+	Jitter Duration `yaml:"jitter,omitempty"`
+}
+
+// Returns true iff the renewal time is explicitly configured, rather than
+// determined by default.
+func (r *TargetRequestRenewal) IsSet() bool {
+	return r.Margin != 0 || r.LifetimeFraction != 0
+}
+
+// Validates the settings for basic sanity.
+func (r *TargetRequestRenewal) Validate() error {
+	if r.Margin < 0 || r.Jitter < 0 {
+		return fmt.Errorf("renewal margin and jitter must not be negative")
+	}
+
+	if r.LifetimeFraction < 0 || r.LifetimeFraction >= 1 {
+		return fmt.Errorf("renewal lifetime fraction must be at least 0 and less than 1")
+	}
+
+	return nil
+}
+
+// A duration, expressed in YAML as a string such as "72h" or "30m", or as a
+// number of days such as "14d".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	td := time.Duration(d)
+	switch {
+	case td == 0:
+		return "0s"
+	case td%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", td/(24*time.Hour))
+	case td%time.Hour == 0:
+		return fmt.Sprintf("%dh", td/time.Hour)
+	case td%time.Minute == 0:
+		return fmt.Sprintf("%dm", td/time.Minute)
+	default:
+		return td.String()
+	}
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	err := unmarshal(&s)
+	if err != nil {
+		return err
+	}
+
+	pd, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = pd
+	return nil
+}
+
+// Parses a duration as expressed in YAML.
+func ParseDuration(s string) (Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.ParseUint(s[:len(s)-1], 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %q", s)
+		}
+
+		return Duration(time.Duration(n) * 24 * time.Hour), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+
+	return Duration(d), nil
+}
+
 // Settings relating to the completion of challenges.
 type TargetRequestChallenge struct {
 	// N. Webroot paths to use when completing challenges.
@@ -140,12 +324,116 @@ type TargetRequestChallenge struct {
 	// HTTP challenges will be performed without self-testing.
 	HTTPSelfTest *bool `yaml:"http-self-test,omitempty"`
 
+	// N. If set, dns-01 challenges are completed by sending RFC 2136 dynamic
+	// updates to a DNS server rather than by invoking hooks.
+	RFC2136 *TargetRequestChallengeRFC2136 `yaml:"rfc2136,omitempty"`
+
+	// N. Number of seconds to wait for a dns-01 challenge record to be served
+	// by all authoritative nameservers. If zero, a default is used. If
+	// negative, do not wait.
+	DNSPropagationTimeout int `yaml:"dns-propagation-timeout,omitempty"`
+
+	// N. If set, dns-01 challenge records for a name are placed at that name
+	// under this zone, to which _acme-challenge.<name> is expected to be a
+	// CNAME, rather than looking up the CNAME.
+	DNSDelegationZone string `yaml:"dns-delegation-zone,omitempty"`
+
+	// N. If set, dns-01 challenges are completed by answering DNS queries for
+	// challenge records directly, rather than by invoking hooks.
+	DNSServer *TargetRequestChallengeDNSServer `yaml:"dns-server,omitempty"`
+
+	// N. Maximum number of authorizations to obtain at once when requesting a
+	// certificate. Defaults to 1. If greater than 1, any challenge hooks must
+	// be safe to run concurrently.
+	AuthorizationParallelism int `yaml:"authorization-parallelism,omitempty"`
+
 	// N. Environment variables to pass to hooks.
 	Env map[string]string `yaml:"env,omitempty"`
 	// N. Inherited environment variables. Used internally.
 	InheritedEnv map[string]string `yaml:"-"`
 }
 
+// Settings for completing dns-01 challenges using RFC 2136 dynamic updates.
+type TargetRequestChallengeRFC2136 struct {
+	// N. The primary nameserver to send updates to, as "host" or "host:port".
+	Server string `yaml:"server,omitempty"`
+
+	// N. The zone to update. If not set, it is determined by querying the
+	// server.
+	Zone string `yaml:"zone,omitempty"`
+
+	// N. The name of the TSIG key used to sign updates. If not set, updates are
+	// not signed.
+	TSIGKeyName string `yaml:"tsig-key-name,omitempty"`
+
+	// N. The TSIG algorithm, e.g. "hmac-sha256" (the default).
+	TSIGAlgorithm string `yaml:"tsig-algorithm,omitempty"`
+
+	// N. The TSIG secret, in base64 form as produced by tsig-keygen.
+	TSIGSecret string `yaml:"tsig-secret,omitempty"`
+}
+
+// Settings for completing dns-01 challenges by acting as the authoritative
+// nameserver for a zone into which _acme-challenge names are delegated.
+type TargetRequestChallengeDNSServer struct {
+	// N. The zone served.
+	Zone string `yaml:"zone,omitempty"`
+
+	// N. The hostname of the nameserver, as named in the NS records delegating
+	// the zone. Defaults to the zone name.
+	Nameserver string `yaml:"nameserver,omitempty"`
+
+	// N. Addresses to listen on. Defaults to ":53".
+	Listen []string `yaml:"listen,omitempty"`
+}
+
+// Validates the settings for basic sanity.
+func (c *TargetRequestChallengeDNSServer) Validate() error {
+	if c.Zone == "" {
+		return fmt.Errorf("DNS server zone must be specified")
+	}
+
+	for _, addr := range c.Listen {
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid DNS server listen address %q: %v", addr, err)
+		}
+	}
+
+	return nil
+}
+
+var tsigAlgorithms = map[string]struct{}{
+	"hmac-md5.sig-alg.reg.int": {},
+	"hmac-sha1":                {},
+	"hmac-sha224":              {},
+	"hmac-sha256":              {},
+	"hmac-sha384":              {},
+	"hmac-sha512":              {},
+}
+
+// Validates the settings for basic sanity.
+func (c *TargetRequestChallengeRFC2136) Validate() error {
+	if c.Server == "" {
+		return fmt.Errorf("RFC 2136 server must be specified")
+	}
+
+	if c.TSIGAlgorithm != "" {
+		if _, ok := tsigAlgorithms[strings.TrimSuffix(strings.ToLower(c.TSIGAlgorithm), ".")]; !ok {
+			return fmt.Errorf("unsupported TSIG algorithm: %q", c.TSIGAlgorithm)
+		}
+	}
+
+	if c.TSIGKeyName != "" {
+		k, err := base64.StdEncoding.DecodeString(c.TSIGSecret)
+		if err != nil || len(k) == 0 {
+			return fmt.Errorf("TSIG secret must be a non-empty base64 string")
+		}
+	}
+
+	return nil
+}
+
 // Represents a stored target descriptor.
 type Target struct {
 	// Specifies conditions which must be met.
@@ -157,12 +445,6 @@ type Target struct {
 	// N. Priority. See state storage specification.
 	Priority int `yaml:"priority,omitempty"`
 
-	// LEGACY. Names to be satisfied. Moved to Satisfy.Names.
-	LegacyNames []string `yaml:"names,omitempty"`
-
-	// LEGACY. Provider URL to used. Moved to Request.Provider.
-	LegacyProvider string `yaml:"provider,omitempty"`
-
 	// Internal use. The filename under which the target is stored.
 	Filename string `yaml:"-"`
 }
@@ -177,7 +459,32 @@ func (t *Target) Validate() error {
 		return fmt.Errorf("invalid provider URL: %q", t.Request.Provider)
 	}
 
-	return nil
+	for provider, eab := range t.Request.ExternalAccountBindings {
+		if !acmeapi.ValidURL(provider) {
+			return fmt.Errorf("invalid provider URL: %q", provider)
+		}
+
+		err := eab.Validate()
+		if err != nil {
+			return fmt.Errorf("%s: %v", provider, err)
+		}
+	}
+
+	if c := t.Request.Challenge.RFC2136; c != nil {
+		err := c.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c := t.Request.Challenge.DNSServer; c != nil {
+		err := c.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.Request.Renewal.Validate()
 }
 
 func (tgt *Target) ensureFilename() {
@@ -191,7 +498,8 @@ func (tgt *Target) ensureFilename() {
 
 	nprefix := ""
 	if len(tgt.Satisfy.Names) > 0 {
-		nprefix = tgt.Satisfy.Names[0] + "-"
+		// Avoid "*" in filenames, as it is awkward to use in a shell.
+		nprefix = strings.Replace(tgt.Satisfy.Names[0], "*", "_", -1) + "-"
 	}
 
 	b := uuid.NewV4().Bytes()
@@ -215,6 +523,21 @@ func (t *Target) Copy() *Target {
 		tt.Request.Challenge.InheritedEnv[k] = v
 	}
 	tt.Request.Challenge.Env = nil
+	if t.Request.ExternalAccountBindings != nil {
+		tt.Request.ExternalAccountBindings = map[string]*ExternalAccountBinding{}
+		for k, v := range t.Request.ExternalAccountBindings {
+			tt.Request.ExternalAccountBindings[k] = v
+		}
+	}
+	if t.Request.Challenge.RFC2136 != nil {
+		c := *t.Request.Challenge.RFC2136
+		tt.Request.Challenge.RFC2136 = &c
+	}
+	if t.Request.Challenge.DNSServer != nil {
+		c := *t.Request.Challenge.DNSServer
+		c.Listen = append([]string(nil), c.Listen...)
+		tt.Request.Challenge.DNSServer = &c
+	}
 	return &tt
 }
 
@@ -230,7 +553,6 @@ func (t *Target) genericise() {
 	t.Satisfy.Names = nil
 	t.Satisfy.ReducedNames = nil
 	t.Request.Names = nil
-	t.LegacyNames = nil
 }
 
 // Represents stored certificate information.
@@ -254,10 +576,32 @@ type Certificate struct {
 	// D. The private key for the certificate.
 	Key *Key
 
+	// N. Renewal timing suggested by the issuer, if it provides renewal
+	// information. nil if it does not, or if none has been obtained yet.
+	RenewalInfo *RenewalInfo
+
 	// D. ID: formed from hash of certificate URL.
 	// D. Path: formed from ID.
 }
 
+// Renewal timing for a certificate obtained from its issuer (ACME Renewal
+// Information).
+type RenewalInfo struct {
+	// N. The window during which the issuer suggests renewing the certificate.
+	WindowStart time.Time `yaml:"window-start"`
+	WindowEnd   time.Time `yaml:"window-end"`
+
+	// N. The time at which the certificate is to be renewed, chosen at random
+	// within the window. Chosen again if the window changes.
+	RenewAt time.Time `yaml:"renew-at"`
+
+	// N. The renewal information should not be fetched again before this time.
+	NextCheck time.Time `yaml:"next-check"`
+
+	// N. Optional. A page explaining the window.
+	ExplanationURL string `yaml:"explanation-url,omitempty"`
+}
+
 // Returns a string summary of the certificate.
 func (c *Certificate) String() string {
 	return fmt.Sprintf("Certificate(%v)", c.ID())
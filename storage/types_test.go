@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"gopkg.in/yaml.v2"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTargetRequestRenewal(t *testing.T) {
+	var tgt Target
+	err := yaml.Unmarshal([]byte(`
+request:
+  renewal:
+    margin: 14d
+    lifetime-fraction: 0.5
+    jitter: 12h
+`), &tgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rp := &tgt.Request.Renewal
+	if rp.Margin != Duration(14*24*time.Hour) || rp.LifetimeFraction != 0.5 || rp.Jitter != Duration(12*time.Hour) || !rp.IsSet() {
+		t.Fatalf("unexpected renewal settings: %#v", rp)
+	}
+
+	err = tgt.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := yaml.Marshal(&tgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), "margin: 14d\n") || !strings.Contains(string(b), "jitter: 12h\n") {
+		t.Fatalf("unexpected serialization: %s", b)
+	}
+
+	rp.LifetimeFraction = 1
+	if tgt.Validate() == nil {
+		t.Fatalf("invalid lifetime fraction accepted")
+	}
+
+	err = yaml.Unmarshal([]byte("request:\n  renewal:\n    margin: 14 days\n"), &tgt)
+	if err == nil {
+		t.Fatalf("invalid duration accepted")
+	}
+}
@@ -8,8 +8,11 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base32"
+	"errors"
 	"fmt"
+	"github.com/hlandau/acme/acmeapi"
 	"github.com/hlandau/acme/acmeapi/acmeutils"
+	"gopkg.in/yaml.v2"
 	"io"
 	"math/big"
 	"net/url"
@@ -268,6 +271,14 @@ func normalizeNames(names []string) error {
 	return nil
 }
 
+// Returns true iff err shows that the server refused a request with a problem
+// document, and so did not carry it out. For other errors, such as a timeout,
+// the server may or may not have carried out the request.
+func serverRejected(err error) bool {
+	var he *acmeapi.HTTPError
+	return errors.As(err, &he) && he.Problem != nil
+}
+
 // Used to return multiple errors, for example when several targets cannot be
 // reconciled. This prevents one failing target from blocking others.
 type MultiError []error
@@ -282,3 +293,84 @@ func (merr MultiError) Error() string {
 	}
 	return "the following errors occurred:\n" + s
 }
+
+// Returns the errors, so that they can be examined using errors.Is and
+// errors.As.
+func (merr MultiError) Unwrap() []error {
+	return merr
+}
+
+// Parses a target file. Settings not given in the file are inherited from
+// defaultTarget, which is nil when parsing the default target itself.
+func parseTarget(filename string, b []byte, defaultTarget *Target) (*Target, error) {
+	var tgt *Target
+	if defaultTarget == nil {
+		tgt = &Target{}
+	} else {
+		tgt = defaultTarget.CopyGeneric()
+	}
+
+	tgt.Filename = filename
+
+	err := yaml.Unmarshal(b, tgt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Top-level "names" and "provider" values are moved into place when the
+	// state directory is migrated. A file which could not be parsed then is
+	// left alone, so they may still appear; reject them rather than ignore
+	// them, which would leave the target requesting the wrong names.
+	var legacy struct {
+		Names    interface{} `yaml:"names"`
+		Provider interface{} `yaml:"provider"`
+	}
+	if yaml.Unmarshal(b, &legacy) == nil && (legacy.Names != nil || legacy.Provider != nil) {
+		return nil, fmt.Errorf("invalid target: %s: top-level \"names\" and \"provider\" are no longer supported; move them to \"satisfy: names\" and \"request: provider\"", filename)
+	}
+
+	if len(tgt.Satisfy.Names) == 0 {
+		tgt.Satisfy.Names = []string{filename}
+	}
+
+	err = normalizeNames(tgt.Satisfy.Names)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %s: %v", filename, err)
+	}
+
+	if len(tgt.Request.Names) == 0 {
+		tgt.Request.Names = tgt.Satisfy.Names
+		tgt.Request.implicitNames = true
+	}
+
+	// tgt.Request.Account is not set; it is for use by other code.
+
+	return tgt, nil
+}
+
+// Serializes a target for saving, after validating it. A target other than
+// the default target is given a filename if it does not have one.
+func marshalTarget(t *Target, isDefault bool) ([]byte, error) {
+	// Some basic validation.
+	err := t.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if !isDefault {
+		t.ensureFilename()
+	}
+
+	tcopy := *t
+
+	if isDefault {
+		tcopy.genericise()
+	}
+
+	// don't serialize default request names list
+	if tcopy.Request.implicitNames {
+		tcopy.Request.Names = nil
+	}
+
+	return yaml.Marshal(&tcopy)
+}
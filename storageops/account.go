@@ -0,0 +1,100 @@
+package storageops
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"github.com/hlandau/acme/acmeapi"
+	"github.com/hlandau/acme/solver"
+	"github.com/hlandau/acme/storage"
+	"golang.org/x/net/context"
+)
+
+// Changes the private key of an account with the server and moves the account
+// to its new ID. If newKey is nil, a new key is generated according to the
+// default target's key settings. Returns the account under its new ID.
+func RolloverAccount(store storage.Store, a *storage.Account, newKey crypto.PrivateKey) (*storage.Account, error) {
+	if a.Retired {
+		return nil, fmt.Errorf("%v is retired", a)
+	}
+
+	r := makeReconcile(store)
+
+	if newKey == nil {
+		var err error
+		newKey, err = generateKey(&store.DefaultTarget().Request.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	na, err := store.RekeyAccount(a, newKey, func() error {
+		return r.getClientForAccount(a).ChangeKey(newKey, context.TODO())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Noticef("rolled over %v to %v", a, na)
+	return na, nil
+}
+
+// Replaces the contact URIs registered for an account with the server,
+// registering the account if necessary.
+func UpdateAccountContact(store storage.Store, a *storage.Account, contactURIs []string) error {
+	if a.Retired {
+		return fmt.Errorf("%v is retired", a)
+	}
+
+	r := makeReconcile(store)
+
+	reg, err := newRegistration(a)
+	if err != nil {
+		return err
+	}
+
+	reg.ContactURIs = contactURIs
+	return solver.AssistedUpsertRegistration(r.getClientForAccount(a), reg, nil, context.TODO())
+}
+
+// Deactivates an account with the server and marks it as retired, so that it
+// is never used again. A new account will be created for the provider when
+// one is next needed. If the server reports that the account does not exist
+// or has already been deactivated, it is only retired.
+func DeactivateAccount(store storage.Store, a *storage.Account) error {
+	return makeReconcile(store).deactivateAccount(a)
+}
+
+func (r *reconcile) deactivateAccount(a *storage.Account) error {
+	if a.Retired {
+		return nil
+	}
+
+	err := r.getClientForAccount(a).DeactivateRegistration(&acmeapi.Registration{}, context.TODO())
+	if errors.Is(err, acmeapi.ErrAccountDoesNotExist) || errors.Is(err, acmeapi.ErrUnauthorized) {
+		log.Warne(err, "provider does not recognise ", a, ", retiring it without deactivating it")
+		return RetireAccount(r.store, a)
+	} else if err != nil {
+		return err
+	}
+
+	log.Noticef("deactivated %v", a)
+	return RetireAccount(r.store, a)
+}
+
+// Marks an account as retired without contacting the server, so that it is
+// never used again, for example because the provider has shut down.
+func RetireAccount(store storage.Store, a *storage.Account) error {
+	if a.Retired {
+		return nil
+	}
+
+	a.Retired = true
+	err := store.SaveAccount(a)
+	if err != nil {
+		a.Retired = false
+		return err
+	}
+
+	return nil
+}
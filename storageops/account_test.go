@@ -0,0 +1,52 @@
+package storageops
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDeactivateAccount(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		retired    bool
+	}{
+		{name: "deactivated", statusCode: 200, body: `{"status":"deactivated"}`, retired: true},
+		{name: "does-not-exist", statusCode: 400, body: `{"type":"urn:ietf:params:acme:error:accountDoesNotExist"}`, retired: true},
+		{name: "unauthorized", statusCode: 403, body: `{"type":"urn:ietf:params:acme:error:unauthorized"}`, retired: true},
+		{name: "server-error", statusCode: 500, body: `{"type":"urn:ietf:params:acme:error:serverInternal"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestOrderServer(t)
+			r, _, acct := srv.reconcile(t)
+
+			srv.mt.AddHandlerFunc("ca.test/account/1", func(rw http.ResponseWriter, req *http.Request) {
+				srv.decodeRequest(rw, req, nil)
+				if tt.statusCode == 200 {
+					rw.Header().Set("Content-Type", "application/json")
+				} else {
+					rw.Header().Set("Content-Type", "application/problem+json")
+				}
+				rw.WriteHeader(tt.statusCode)
+				rw.Write([]byte(tt.body))
+			})
+
+			err := r.deactivateAccount(acct)
+			if (err == nil) != tt.retired {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err = r.store.Reload()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if a := r.store.AccountByID(acct.ID()); a.Retired != tt.retired {
+				t.Fatalf("account retired: %v, expected %v", a.Retired, tt.retired)
+			}
+		})
+	}
+}
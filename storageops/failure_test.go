@@ -0,0 +1,210 @@
+package storageops
+
+import (
+	"errors"
+	"github.com/hlandau/acme/acmeapi"
+	"github.com/hlandau/acme/storage"
+	"github.com/jmhodges/clock"
+	"testing"
+	"time"
+)
+
+const testDirectoryURL = "https://ca.test/directory"
+
+var errFailed = errors.New("failed")
+
+// Replaces InternalClock with a fake clock for the duration of a test.
+func fakeClock(t *testing.T) clock.FakeClock {
+	fc := clock.NewFake()
+	fc.Set(time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC))
+
+	prev := InternalClock
+	InternalClock = fc
+	t.Cleanup(func() {
+		InternalClock = prev
+	})
+
+	return fc
+}
+
+func testReconcile(t *testing.T) (*reconcile, *storage.Target) {
+	s, err := storage.NewMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tgt := &storage.Target{
+		Filename: "example.com",
+		Satisfy:  storage.TargetSatisfy{Names: []string{"example.com"}},
+		Request:  storage.TargetRequest{Provider: testDirectoryURL},
+	}
+
+	err = s.SaveTarget(tgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return makeReconcile(s), s.TargetByFilename("example.com")
+}
+
+func TestDeferTarget(t *testing.T) {
+	fc := fakeClock(t)
+	r, tgt := testReconcile(t)
+
+	err := r.recordTargetFailure(tgt, errFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deferring a target because its provider is rate limiting requests does
+	// not count as a failed attempt.
+	retryAfter := fc.Now().Add(6 * time.Hour)
+	err = r.deferTarget(tgt, retryAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf := r.store.TargetFailure(tgt.Filename)
+	if tf.Count != 1 || len(tf.History) != 1 || !tf.NextAttempt.Equal(retryAfter) {
+		t.Fatalf("unexpected failure record: %#v", tf)
+	}
+
+	// An earlier time does not bring the next attempt forward.
+	err = r.deferTarget(tgt, fc.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tf := r.store.TargetFailure(tgt.Filename); !tf.NextAttempt.Equal(retryAfter) {
+		t.Fatalf("next attempt brought forward: %v", tf.NextAttempt)
+	}
+}
+
+func TestFailureBackoff(t *testing.T) {
+	tests := []struct {
+		count    int
+		expected time.Duration
+	}{
+		{0, 1 * time.Hour},
+		{1, 1 * time.Hour},
+		{2, 2 * time.Hour},
+		{3, 4 * time.Hour},
+		{4, 8 * time.Hour},
+		{5, 16 * time.Hour},
+		{6, 16 * time.Hour},
+		{100, 16 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if d := failureBackoff(tt.count); d != tt.expected {
+			t.Errorf("failureBackoff(%d) = %v, expected %v", tt.count, d, tt.expected)
+		}
+	}
+}
+
+func TestRecordTargetFailure(t *testing.T) {
+	fc := fakeClock(t)
+	r, tgt := testReconcile(t)
+
+	start := fc.Now()
+	for i := 1; i <= maxFailureHistory+2; i++ {
+		err := r.recordTargetFailure(tgt, errFailed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tf := r.store.TargetFailure(tgt.Filename)
+		if tf.Count != i || !tf.NextAttempt.Equal(fc.Now().Add(failureBackoff(i))) {
+			t.Fatalf("unexpected failure record after %d failures: %#v", i, tf)
+		}
+
+		fc.Add(time.Minute)
+	}
+
+	// Only the most recent attempts are kept.
+	tf := r.store.TargetFailure(tgt.Filename)
+	if len(tf.History) != maxFailureHistory || !tf.History[0].Time.Equal(start.Add(2*time.Minute)) ||
+		tf.History[0].Error != errFailed.Error() {
+		t.Fatalf("unexpected failure history: %#v", tf.History)
+	}
+
+	// The next attempt is not made before the time given by a provider which
+	// is rate limiting requests.
+	retryAfter := fc.Now().Add(48 * time.Hour)
+	err := r.recordTargetFailure(tgt, &acmeapi.RateLimitError{
+		HTTPError:  &acmeapi.HTTPError{},
+		RetryAfter: retryAfter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tf := r.store.TargetFailure(tgt.Filename); !tf.NextAttempt.Equal(retryAfter) {
+		t.Fatalf("rate limit not respected: %v", tf.NextAttempt)
+	}
+}
+
+func TestTargetBackoff(t *testing.T) {
+	fc := fakeClock(t)
+	r, tgt := testReconcile(t)
+
+	if r.targetBackoff(tgt) != nil {
+		t.Fatalf("target without failures in backoff")
+	}
+
+	err := r.recordTargetFailure(tgt, errFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.recordTargetFailure(tgt, errFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Skipped until the next attempt is due, unless forced.
+	if r.targetBackoff(tgt) == nil {
+		t.Fatalf("target not in backoff after failure")
+	}
+
+	r.force = true
+	if r.targetBackoff(tgt) != nil {
+		t.Fatalf("target in backoff although forced")
+	}
+	r.force = false
+
+	fc.Add(failureBackoff(2) - time.Second)
+	if r.targetBackoff(tgt) == nil {
+		t.Fatalf("target not in backoff before next attempt")
+	}
+
+	fc.Add(time.Second)
+	if r.targetBackoff(tgt) != nil {
+		t.Fatalf("target in backoff when next attempt is due")
+	}
+
+	// The failures are forgotten once a certificate is obtained.
+	err = r.clearTargetFailure(tgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tf := r.store.TargetFailure(tgt.Filename); tf != nil {
+		t.Fatalf("failure record not removed: %#v", tf)
+	}
+
+	err = r.recordTargetFailure(tgt, errFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf := r.store.TargetFailure(tgt.Filename)
+	if tf.Count != 1 || len(tf.History) != 1 || !tf.NextAttempt.Equal(fc.Now().Add(failureBackoffMin)) {
+		t.Fatalf("failures not reset: %#v", tf)
+	}
+}
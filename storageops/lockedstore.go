@@ -0,0 +1,274 @@
+package storageops
+
+import (
+	"crypto"
+	"github.com/hlandau/acme/storage"
+	"sync"
+)
+
+// Wraps a store so that it can be used from several goroutines at once. Each
+// call is made with a mutex held. The Visit methods call the visitor function
+// without holding it, so that it may use the store.
+//
+// Objects returned by the store are not protected; callers must coordinate
+// changes to shared objects such as accounts themselves.
+type lockedStore struct {
+	s     storage.Store
+	mutex sync.Mutex
+}
+
+func (ls *lockedStore) Close() error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.Close()
+}
+
+func (ls *lockedStore) Reload() error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.Reload()
+}
+
+func (ls *lockedStore) Path() string {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.Path()
+}
+
+func (ls *lockedStore) AccountByID(accountID string) *storage.Account {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.AccountByID(accountID)
+}
+
+func (ls *lockedStore) AccountByDirectoryURL(directoryURL string) *storage.Account {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.AccountByDirectoryURL(directoryURL)
+}
+
+func (ls *lockedStore) CertificateByID(certificateID string) *storage.Certificate {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.CertificateByID(certificateID)
+}
+
+func (ls *lockedStore) KeyByID(keyID string) *storage.Key {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.KeyByID(keyID)
+}
+
+func (ls *lockedStore) TargetByFilename(filename string) *storage.Target {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.TargetByFilename(filename)
+}
+
+func (ls *lockedStore) DefaultTarget() *storage.Target {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.DefaultTarget()
+}
+
+func (ls *lockedStore) TargetFailure(filename string) *storage.TargetFailure {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.TargetFailure(filename)
+}
+
+func (ls *lockedStore) PreferredCertificateForHostname(hostname string) (*storage.Certificate, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.PreferredCertificateForHostname(hostname)
+}
+
+func (ls *lockedStore) VisitPreferredCertificates(f func(hostname string, c *storage.Certificate) error) error {
+	var hostnames []string
+	var certs []*storage.Certificate
+	ls.mutex.Lock()
+	ls.s.VisitPreferredCertificates(func(hostname string, c *storage.Certificate) error {
+		hostnames = append(hostnames, hostname)
+		certs = append(certs, c)
+		return nil
+	})
+	ls.mutex.Unlock()
+
+	for i := range hostnames {
+		err := f(hostnames[i], certs[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ls *lockedStore) VisitAccounts(f func(*storage.Account) error) error {
+	var accounts []*storage.Account
+	ls.mutex.Lock()
+	ls.s.VisitAccounts(func(a *storage.Account) error {
+		accounts = append(accounts, a)
+		return nil
+	})
+	ls.mutex.Unlock()
+
+	for _, a := range accounts {
+		err := f(a)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ls *lockedStore) VisitCertificates(f func(*storage.Certificate) error) error {
+	var certs []*storage.Certificate
+	ls.mutex.Lock()
+	ls.s.VisitCertificates(func(c *storage.Certificate) error {
+		certs = append(certs, c)
+		return nil
+	})
+	ls.mutex.Unlock()
+
+	for _, c := range certs {
+		err := f(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ls *lockedStore) VisitKeys(f func(*storage.Key) error) error {
+	var keys []*storage.Key
+	ls.mutex.Lock()
+	ls.s.VisitKeys(func(k *storage.Key) error {
+		keys = append(keys, k)
+		return nil
+	})
+	ls.mutex.Unlock()
+
+	for _, k := range keys {
+		err := f(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ls *lockedStore) VisitTargets(f func(*storage.Target) error) error {
+	var targets []*storage.Target
+	ls.mutex.Lock()
+	ls.s.VisitTargets(func(t *storage.Target) error {
+		targets = append(targets, t)
+		return nil
+	})
+	ls.mutex.Unlock()
+
+	for _, t := range targets {
+		err := f(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ls *lockedStore) SaveTarget(t *storage.Target) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.SaveTarget(t)
+}
+
+func (ls *lockedStore) RemoveTarget(filename string) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.RemoveTarget(filename)
+}
+
+func (ls *lockedStore) SaveTargetFailure(tf *storage.TargetFailure) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.SaveTargetFailure(tf)
+}
+
+func (ls *lockedStore) RemoveTargetFailure(filename string) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.RemoveTargetFailure(filename)
+}
+
+func (ls *lockedStore) SaveCertificate(c *storage.Certificate) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.SaveCertificate(c)
+}
+
+func (ls *lockedStore) SaveAccount(a *storage.Account) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.SaveAccount(a)
+}
+
+func (ls *lockedStore) RekeyAccount(a *storage.Account, newKey crypto.PrivateKey, commit func() error) (*storage.Account, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.RekeyAccount(a, newKey, commit)
+}
+
+func (ls *lockedStore) RemoveCertificate(certificateID string) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.RemoveCertificate(certificateID)
+}
+
+func (ls *lockedStore) RemoveKey(keyID string) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.RemoveKey(keyID)
+}
+
+func (ls *lockedStore) ImportKey(privateKey crypto.PrivateKey) (*storage.Key, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.ImportKey(privateKey)
+}
+
+func (ls *lockedStore) ImportAccount(directoryURL string, privateKey crypto.PrivateKey) (*storage.Account, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.ImportAccount(directoryURL, privateKey)
+}
+
+func (ls *lockedStore) ImportCertificate(url string) (*storage.Certificate, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.ImportCertificate(url)
+}
+
+func (ls *lockedStore) SetPreferredCertificateForHostname(hostname string, c *storage.Certificate) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.SetPreferredCertificateForHostname(hostname, c)
+}
+
+func (ls *lockedStore) WriteMiscellaneousConfFile(filename string, data []byte) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.s.WriteMiscellaneousConfFile(filename, data)
+}
+
+func (ls *lockedStore) Lock(wait bool) error {
+	// Not under the mutex, since waiting for the lock could take a long time.
+	return ls.s.Lock(wait)
+}
+
+func (ls *lockedStore) Unlock() error {
+	return ls.s.Unlock()
+}
@@ -0,0 +1,224 @@
+package storageops
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hlandau/acme/acmeapi"
+	"github.com/hlandau/acme/solver"
+	"github.com/hlandau/acme/storage"
+	"golang.org/x/net/context"
+)
+
+// Requests a certificate for a target from an RFC 8555 server. One order is
+// created per target. The order URL is recorded in the account so that if
+// the process is interrupted, the next reconcile resumes the same order.
+func (r *reconcile) requestCertificateForTargetViaOrder(t *storage.Target, acct *storage.Account) error {
+	cl := r.getClientForAccount(acct)
+
+	order, err := r.resumeOrCreateOrder(t, acct)
+	if err != nil {
+		return err
+	}
+
+	if order.Status == acmeapi.StatusPending {
+		err = r.completeOrderAuthorizations(order, acct, t.Filename, &t.Request.Challenge)
+		if err != nil {
+			return err
+		}
+
+		err = cl.LoadOrder(order, context.TODO())
+		if err != nil {
+			return err
+		}
+	}
+
+	if order.Status == acmeapi.StatusReady {
+		csr, err := r.createCSR(t)
+		if err != nil {
+			return err
+		}
+
+		log.Debugf("%v: finalizing order %v", t, order.URI)
+		err = cl.FinalizeOrder(order, csr, context.TODO())
+		if err != nil {
+			log.Errore(err, "could not finalize order")
+			return err
+		}
+	}
+
+	err = cl.WaitForOrder(order, context.TODO())
+	if err != nil {
+		return err
+	}
+
+	if order.Status != acmeapi.StatusValid {
+		if order.Status.Final() {
+			// The order can never succeed, so don't try to resume it.
+			log.Errore(r.forgetOrder(t, acct), "could not forget failed order")
+		}
+
+		if order.Error != nil {
+			return fmt.Errorf("order %v has unexpected status %q: %w", order.URI, order.Status, order.Error)
+		}
+
+		return fmt.Errorf("order %v has unexpected status %q", order.URI, order.Status)
+	}
+
+	c, err := r.store.ImportCertificate(order.CertificateURI)
+	if err != nil {
+		log.Errore(err, "could not import certificate")
+		return err
+	}
+
+	err = r.downloadCertificate(c)
+	if err != nil {
+		log.Errore(err, "failed to download certificate")
+		return err
+	}
+
+	return r.forgetOrder(t, acct)
+}
+
+// Loads the order in progress for a target, if there is one and it can still
+// be used. Otherwise creates a new order and records it.
+func (r *reconcile) resumeOrCreateOrder(t *storage.Target, acct *storage.Account) (*acmeapi.Order, error) {
+	r.mutex.Lock()
+	so := acct.Orders[t.Filename]
+	r.mutex.Unlock()
+
+	if so != nil {
+		order := &acmeapi.Order{
+			URI: so.URL,
+		}
+
+		err := r.getClientForAccount(acct).LoadOrder(order, context.TODO())
+		switch {
+		case err != nil:
+			log.Warne(err, t, ": could not load existing order, creating a new one")
+		case !orderHasNames(order, t.Request.Names):
+			log.Debugf("%v: names have changed since order %v was created, creating a new one", t, order.URI)
+		case order.Status.Final() && order.Status != acmeapi.StatusValid:
+			log.Debugf("%v: existing order %v has status %q, creating a new one", t, order.URI, order.Status)
+		default:
+			log.Debugf("%v: resuming order %v with status %q", t, order.URI, order.Status)
+			return order, nil
+		}
+	}
+
+	order, err := r.createOrder(t.Request.Names, r.replacedCertificateID(t, acct), acct)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if acct.Orders == nil {
+		acct.Orders = map[string]*storage.Order{}
+	}
+
+	acct.Orders[t.Filename] = &storage.Order{
+		TargetFilename: t.Filename,
+		URL:            order.URI,
+	}
+
+	err = r.store.SaveAccount(acct)
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// Creates an order for the given names. If replaces is set, it is the
+// identifier of the certificate which the order replaces.
+func (r *reconcile) createOrder(names []string, replaces string, acct *storage.Account) (*acmeapi.Order, error) {
+	order := &acmeapi.Order{
+		Replaces: replaces,
+	}
+	for _, name := range names {
+		order.Identifiers = append(order.Identifiers, acmeapi.NewIdentifier(name))
+	}
+
+	cl := r.getClientForAccount(acct)
+	err := cl.NewOrder(order, context.TODO())
+	if replaces != "" && errors.Is(err, acmeapi.ErrAlreadyReplaced) {
+		// A previous order replacing the certificate was abandoned; this one
+		// need not be marked as a replacement.
+		log.Debugf("certificate %v already replaced, creating order without replacing it", replaces)
+		order.Replaces = ""
+		err = cl.NewOrder(order, context.TODO())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("created order %v", order.URI)
+	return order, nil
+}
+
+// Removes the record of the order in progress for a target.
+func (r *reconcile) forgetOrder(t *storage.Target, acct *storage.Account) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := acct.Orders[t.Filename]; !ok {
+		return nil
+	}
+
+	delete(acct.Orders, t.Filename)
+	return r.store.SaveAccount(acct)
+}
+
+// Returns true iff the order is for exactly the given names.
+func orderHasNames(order *acmeapi.Order, names []string) bool {
+	m := map[string]struct{}{}
+	for _, name := range names {
+		m[name] = struct{}{}
+	}
+
+	if len(order.Identifiers) != len(m) {
+		return false
+	}
+
+	for _, ident := range order.Identifiers {
+		if _, ok := m[ident.Value]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Completes the authorizations returned for an order.
+func (r *reconcile) completeOrderAuthorizations(order *acmeapi.Order, acct *storage.Account, targetFilename string, trc *storage.TargetRequestChallenge) error {
+	cl := r.getClientForAccount(acct)
+
+	merr := runParallel(len(order.AuthorizationURIs), trc.AuthorizationParallelism, func(i int) error {
+		az := &acmeapi.Authorization{
+			URI: order.AuthorizationURIs[i],
+		}
+
+		err := cl.LoadAuthorization(az, context.TODO())
+		if err != nil {
+			return &AuthorizationError{Name: az.URI, Err: err}
+		}
+
+		name := az.Identifier.Value
+		if az.Status != acmeapi.StatusValid {
+			log.Debugf("trying to complete authorization for %q", name)
+			err = solver.CompleteAuthorization(cl, az, r.challengeConfig(name, targetFilename, trc), context.TODO())
+			if err != nil {
+				log.Errore(err, "could not complete authorization for ", name)
+				return &AuthorizationError{Name: name, Err: err}
+			}
+		}
+
+		return r.saveAuthorization(acct, az)
+	})
+	if len(merr) != 0 {
+		return merr
+	}
+
+	return nil
+}
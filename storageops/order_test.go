@@ -0,0 +1,280 @@
+package storageops
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/hlandau/acme/acmeapi"
+	"github.com/hlandau/acme/storage"
+	"github.com/hlandau/goutils/test"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// A minimal RFC 8555 server which creates and serves orders. Request
+// signatures are not checked.
+type testOrderServer struct {
+	t  *testing.T
+	mt test.HTTPMockTransport
+
+	orders  map[string]*acmeapi.Order // key: order URL
+	nonce   int
+	created []orderRequest
+
+	// If set, requests for orders replacing a certificate fail.
+	alreadyReplaced bool
+}
+
+type orderRequest struct {
+	Identifiers []acmeapi.Identifier `json:"identifiers"`
+	Replaces    string               `json:"replaces"`
+}
+
+func newTestOrderServer(t *testing.T) *testOrderServer {
+	srv := &testOrderServer{
+		t:      t,
+		orders: map[string]*acmeapi.Order{},
+	}
+
+	srv.mt.AddHandlerFunc("ca.test/directory", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(200)
+		rw.Write([]byte(`{
+      "newNonce": "https://ca.test/nonce",
+      "newAccount": "https://ca.test/account",
+      "newOrder": "https://ca.test/order",
+      "renewalInfo": "https://ca.test/renewal-info"
+    }`))
+	})
+
+	srv.mt.AddHandlerFunc("ca.test/nonce", func(rw http.ResponseWriter, req *http.Request) {
+		srv.issueNonce(rw)
+		rw.WriteHeader(200)
+	})
+
+	srv.mt.AddHandlerFunc("ca.test/order", func(rw http.ResponseWriter, req *http.Request) {
+		var oreq orderRequest
+		srv.decodeRequest(rw, req, &oreq)
+		srv.created = append(srv.created, oreq)
+
+		if oreq.Replaces != "" && srv.alreadyReplaced {
+			rw.Header().Set("Content-Type", "application/problem+json")
+			rw.WriteHeader(409)
+			rw.Write([]byte(`{"type":"urn:ietf:params:acme:error:alreadyReplaced"}`))
+			return
+		}
+
+		order := srv.addOrder(acmeapi.StatusPending, oreq.Identifiers)
+		rw.Header().Set("Location", order.URI)
+		srv.writeOrder(rw, 201, order)
+	})
+
+	return srv
+}
+
+func (srv *testOrderServer) issueNonce(rw http.ResponseWriter) {
+	srv.nonce++
+	rw.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", srv.nonce))
+}
+
+// Decodes the payload of a JWS request into v.
+func (srv *testOrderServer) decodeRequest(rw http.ResponseWriter, req *http.Request, v interface{}) {
+	srv.issueNonce(rw)
+
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&jws)
+	if err != nil {
+		srv.t.Fatalf("malformed request: %v", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		srv.t.Fatalf("malformed request payload: %v", err)
+	}
+
+	if v != nil && len(payload) > 0 {
+		err = json.Unmarshal(payload, v)
+		if err != nil {
+			srv.t.Fatalf("malformed request payload: %v", err)
+		}
+	}
+}
+
+func (srv *testOrderServer) writeOrder(rw http.ResponseWriter, statusCode int, order *acmeapi.Order) {
+	b, err := json.Marshal(order)
+	if err != nil {
+		srv.t.Fatal(err)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	rw.Write(b)
+}
+
+// Adds an order for the given names which can be loaded by its URL.
+func (srv *testOrderServer) addOrder(status acmeapi.Status, identifiers []acmeapi.Identifier) *acmeapi.Order {
+	order := &acmeapi.Order{
+		URI:               fmt.Sprintf("https://ca.test/order/%d", len(srv.orders)+1),
+		Status:            status,
+		Identifiers:       identifiers,
+		AuthorizationURIs: []string{"https://ca.test/authz/1"},
+		FinalizeURI:       "https://ca.test/finalize/1",
+	}
+
+	srv.orders[order.URI] = order
+	srv.mt.AddHandlerFunc(order.URI[len("https://"):], func(rw http.ResponseWriter, req *http.Request) {
+		srv.decodeRequest(rw, req, nil)
+		srv.writeOrder(rw, 200, order)
+	})
+
+	return order
+}
+
+// Returns the reconcile state with a client for an account which uses the
+// server, and the account.
+func (srv *testOrderServer) reconcile(t *testing.T) (*reconcile, *storage.Target, *storage.Account) {
+	r, tgt := testReconcile(t)
+
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acct, err := r.store.ImportAccount(testDirectoryURL, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.store.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.accountClients[acct] = &acmeapi.Client{
+		HTTPClient: &http.Client{
+			Transport: &srv.mt,
+		},
+		AccountKey:   pk,
+		DirectoryURL: testDirectoryURL,
+		AccountURL:   "https://ca.test/account/1",
+	}
+
+	return r, tgt, acct
+}
+
+func TestResumeOrCreateOrder(t *testing.T) {
+	names := []string{"example.com"}
+	identifiers := []acmeapi.Identifier{acmeapi.NewIdentifier("example.com")}
+
+	tests := []struct {
+		name string
+
+		// The status of the stored order, or "" if none is stored. If the
+		// status is StatusUnknown, the order cannot be loaded, as if it had
+		// expired and been removed.
+		status acmeapi.Status
+
+		identifiers []acmeapi.Identifier
+		resumed     bool
+	}{
+		{name: "none"},
+		{name: "pending", status: acmeapi.StatusPending, identifiers: identifiers, resumed: true},
+		{name: "ready", status: acmeapi.StatusReady, identifiers: identifiers, resumed: true},
+		{name: "valid", status: acmeapi.StatusValid, identifiers: identifiers, resumed: true},
+		{name: "invalid", status: acmeapi.StatusInvalid, identifiers: identifiers},
+		{name: "expired", status: acmeapi.StatusUnknown, identifiers: identifiers},
+		{name: "names-changed", status: acmeapi.StatusPending, identifiers: []acmeapi.Identifier{acmeapi.NewIdentifier("example.net")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestOrderServer(t)
+			r, tgt, acct := srv.reconcile(t)
+			tgt.Request.Names = names
+
+			var stored string
+			switch tt.status {
+			case "":
+			case acmeapi.StatusUnknown:
+				stored = "https://ca.test/order/removed"
+			default:
+				stored = srv.addOrder(tt.status, tt.identifiers).URI
+			}
+
+			if stored != "" {
+				acct.Orders[tgt.Filename] = &storage.Order{
+					TargetFilename: tgt.Filename,
+					URL:            stored,
+				}
+			}
+
+			order, err := r.resumeOrCreateOrder(tgt, acct)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.resumed {
+				if order.URI != stored || order.Status != tt.status || len(srv.created) != 0 {
+					t.Fatalf("order not resumed: %#v %d", order, len(srv.created))
+				}
+			} else {
+				if order.URI == stored || len(srv.created) != 1 || !reflect.DeepEqual(srv.created[0].Identifiers, identifiers) {
+					t.Fatalf("order not created: %#v %#v", order, srv.created)
+				}
+			}
+
+			// The order is recorded so that it can be resumed.
+			so := r.store.AccountByID(acct.ID()).Orders[tgt.Filename]
+			if so == nil || so.URL != order.URI {
+				t.Fatalf("order not recorded: %#v", so)
+			}
+		})
+	}
+}
+
+func TestCreateOrderReplacing(t *testing.T) {
+	fc := fakeClock(t)
+
+	for _, alreadyReplaced := range []bool{false, true} {
+		srv := newTestOrderServer(t)
+		srv.alreadyReplaced = alreadyReplaced
+		r, tgt, acct := srv.reconcile(t)
+
+		addTestCertificate(t, r.store, "example.com", fc.Now().Add(-80*day), fc.Now().Add(10*day))
+
+		replaces := r.replacedCertificateID(tgt, acct)
+		if replaces == "" {
+			t.Fatalf("no certificate to replace")
+		}
+
+		order, err := r.createOrder(tgt.Satisfy.Names, replaces, acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// If the certificate has already been replaced, the order is retried
+		// without replacing it.
+		expected := []orderRequest{{Replaces: replaces}}
+		if alreadyReplaced {
+			expected = append(expected, orderRequest{})
+		}
+
+		for i := range expected {
+			expected[i].Identifiers = []acmeapi.Identifier{acmeapi.NewIdentifier("example.com")}
+		}
+
+		if !reflect.DeepEqual(srv.created, expected) {
+			t.Fatalf("unexpected order requests: %#v", srv.created)
+		}
+
+		if srv.orders[order.URI] == nil || (order.Replaces != "") == alreadyReplaced {
+			t.Fatalf("unexpected order: %#v", order)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package storageops
+
+import (
+	"fmt"
+	"github.com/hlandau/acme/storage"
+	"time"
+)
+
+// Describes what the reconcile operation would do if run now. A plan is
+// determined using only the information in the state directory: nothing is
+// changed, and no requests are made to ACME servers. In particular, renewal
+// information is not fetched, and authorizations are assumed to be needed
+// for any names for which no valid authorization is recorded.
+type Plan struct {
+	// IDs of certificates which would be downloaded.
+	Downloads []string `json:"downloads,omitempty"`
+
+	// IDs of certificates which would be revoked.
+	Revocations []string `json:"revocations,omitempty"`
+
+	// Directory URLs of providers for which accounts would be created.
+	NewAccounts []string `json:"newAccounts,omitempty"`
+
+	// Targets for which certificates would be requested, or which would be
+	// skipped although they need a certificate.
+	Targets []*TargetPlan `json:"targets,omitempty"`
+
+	// Changes to the "live" directory, given the certificates which already
+	// exist. Certificates obtained by the reconcile operation would cause
+	// further changes.
+	Links []*LinkPlan `json:"links,omitempty"`
+}
+
+// Returns true iff reconciling would do nothing.
+func (p *Plan) Empty() bool {
+	return len(p.Downloads) == 0 && len(p.Revocations) == 0 && len(p.NewAccounts) == 0 &&
+		len(p.Targets) == 0 && len(p.Links) == 0
+}
+
+// Describes what the reconcile operation would do for a target.
+type TargetPlan struct {
+	// The filename of the target.
+	Target string `json:"target"`
+
+	// The names which would be requested.
+	Names []string `json:"names"`
+
+	// The directory URL of the provider from which a certificate would be
+	// requested.
+	Provider string `json:"provider,omitempty"`
+
+	// The ID of the best certificate satisfying the target, if there is one.
+	// Set if that certificate is due for renewal.
+	Certificate string `json:"certificate,omitempty"`
+
+	// The time at which the certificate became due for renewal, if there is
+	// one.
+	RenewAt *time.Time `json:"renewAt,omitempty"`
+
+	// The names for which new authorizations would be needed.
+	Authorizations []string `json:"authorizations,omitempty"`
+
+	// If set, no certificate would be requested for the target, for this
+	// reason.
+	Skip string `json:"skip,omitempty"`
+}
+
+// Describes a change to the "live" directory.
+type LinkPlan struct {
+	Hostname string `json:"hostname"`
+
+	// The ID of the certificate which would be linked.
+	Certificate string `json:"certificate"`
+
+	// The ID of the certificate currently linked, if any.
+	PreviousCertificate string `json:"previousCertificate,omitempty"`
+}
+
+// Determines what the reconcile operation would do, without doing it. See
+// Plan. Only the Force setting of cfg is used.
+func PlanReconcile(store storage.Store, cfg ReconcileConfig) (*Plan, error) {
+	r := makeReconcile(store)
+	r.force = cfg.Force
+
+	p := &Plan{}
+
+	store.VisitCertificates(func(c *storage.Certificate) error {
+		if !c.Cached {
+			p.Downloads = append(p.Downloads, c.ID())
+		}
+
+		if c.RevocationDesired && !c.Revoked {
+			p.Revocations = append(p.Revocations, c.ID())
+		}
+
+		return nil
+	})
+
+	newAccounts := map[string]struct{}{}
+	err := store.VisitTargets(func(t *storage.Target) error {
+		tp := r.planTarget(t)
+		if tp == nil {
+			return nil
+		}
+
+		p.Targets = append(p.Targets, tp)
+		if tp.Skip == "" && store.AccountByDirectoryURL(tp.Provider) == nil {
+			if _, ok := newAccounts[tp.Provider]; !ok {
+				newAccounts[tp.Provider] = struct{}{}
+				p.NewAccounts = append(p.NewAccounts, tp.Provider)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := r.relinkChanges()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ch := range changes {
+		lp := &LinkPlan{
+			Hostname:    ch.hostname,
+			Certificate: ch.c.ID(),
+		}
+		if ch.cprev != nil {
+			lp.PreviousCertificate = ch.cprev.ID()
+		}
+
+		p.Links = append(p.Links, lp)
+	}
+
+	return p, nil
+}
+
+// Determines what the reconcile operation would do for a target. Returns nil
+// if the target would be left alone.
+func (r *reconcile) planTarget(t *storage.Target) *TargetPlan {
+	tp := &TargetPlan{
+		Target: t.Filename,
+	}
+
+	c, err := FindBestCertificateSatisfying(r.store, t)
+	if err == nil {
+		if !CertificateNeedsRenewingForTarget(c, t) {
+			return nil
+		}
+
+		tp.Certificate = c.ID()
+		if renewAt, err := CertificateRenewalTime(c, t); err == nil {
+			tp.RenewAt = &renewAt
+		}
+	}
+
+	// Work on a copy, since this adds names to the request.
+	t = t.Copy()
+	t.Request.Names = append([]string(nil), t.Request.Names...)
+	ensureConceivablySatisfiable(t)
+	tp.Names = t.Request.Names
+
+	if tf := r.targetBackoff(t); tf != nil {
+		tp.Skip = fmt.Sprintf("waiting until %v after %d failed attempts", tf.NextAttempt.Local().Format(time.RFC3339), tf.Count)
+		return tp
+	}
+
+	if t.Request.Account != nil {
+		tp.Provider = t.Request.Account.DirectoryURL
+	} else {
+		tp.Provider, err = r.resolveDirectoryURL(t.Request.Provider)
+		if err != nil {
+			tp.Skip = err.Error()
+			return tp
+		}
+	}
+
+	acct := t.Request.Account
+	if acct == nil {
+		acct = r.store.AccountByDirectoryURL(tp.Provider)
+	}
+
+	if acct != nil {
+		tp.Authorizations = r.determineNecessaryAuthorizations(tp.Names, acct)
+	} else {
+		tp.Authorizations = tp.Names
+	}
+
+	return tp
+}
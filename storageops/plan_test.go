@@ -0,0 +1,172 @@
+package storageops
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/hlandau/acme/storage"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Adds a self-signed certificate for the given name, valid between the given
+// times, to the store.
+func addTestCertificate(t *testing.T, s storage.Store, name string, notBefore, notAfter time.Time) *storage.Certificate {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.ImportKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: name},
+		DNSNames:       []string{name},
+		NotBefore:      notBefore,
+		NotAfter:       notAfter,
+		AuthorityKeyId: []byte{1, 2, 3, 4},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &pk.PublicKey, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.ImportCertificate("https://ca.test/cert/" + name + "/" + notAfter.Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Certificates = [][]byte{der}
+	err = s.SaveCertificate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestPlanReconcile(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// Validity of an existing certificate, relative to now, if any.
+		notBefore, notAfter time.Duration
+
+		// Consecutive failed attempts to obtain a certificate.
+		failures int
+
+		force bool
+
+		expected *TargetPlan // nil if the target is left alone
+		skip     bool
+	}{
+		{
+			name:     "request",
+			expected: &TargetPlan{Names: []string{"example.com"}, Provider: testDirectoryURL, Authorizations: []string{"example.com"}},
+		},
+		{
+			name:      "renew",
+			notBefore: -80 * day,
+			notAfter:  10 * day,
+			expected:  &TargetPlan{Names: []string{"example.com"}, Provider: testDirectoryURL, Authorizations: []string{"example.com"}},
+		},
+		{
+			name:      "no-op",
+			notBefore: -10 * day,
+			notAfter:  80 * day,
+		},
+		{
+			name:     "skip-backoff",
+			failures: 3,
+			expected: &TargetPlan{Names: []string{"example.com"}},
+			skip:     true,
+		},
+		{
+			name:     "force-backoff",
+			failures: 3,
+			force:    true,
+			expected: &TargetPlan{Names: []string{"example.com"}, Provider: testDirectoryURL, Authorizations: []string{"example.com"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := fakeClock(t)
+			r, tgt := testReconcile(t)
+
+			var c *storage.Certificate
+			if tt.notAfter != 0 {
+				c = addTestCertificate(t, r.store, "example.com", fc.Now().Add(tt.notBefore), fc.Now().Add(tt.notAfter))
+			}
+
+			for i := 0; i < tt.failures; i++ {
+				err := r.recordTargetFailure(tgt, errFailed)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p, err := PlanReconcile(r.store, ReconcileConfig{Force: tt.force})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.expected == nil {
+				if len(p.Targets) != 0 || len(p.NewAccounts) != 0 {
+					t.Fatalf("unexpected plan: %#v", p)
+				}
+				return
+			}
+
+			if len(p.Targets) != 1 {
+				t.Fatalf("unexpected plan: %#v", p)
+			}
+
+			tp := p.Targets[0]
+			if (tp.Skip != "") != tt.skip {
+				t.Fatalf("unexpected skip reason: %q", tp.Skip)
+			}
+
+			if c != nil {
+				renewAt, err := CertificateRenewalTime(c, tgt)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if tp.Certificate != c.ID() || tp.RenewAt == nil || !tp.RenewAt.Equal(renewAt) {
+					t.Fatalf("unexpected renewal: %q %v", tp.Certificate, tp.RenewAt)
+				}
+			}
+
+			expected := *tt.expected
+			expected.Target = tgt.Filename
+			expected.Certificate, expected.RenewAt, expected.Skip = tp.Certificate, tp.RenewAt, tp.Skip
+			if !reflect.DeepEqual(tp, &expected) {
+				t.Fatalf("unexpected target plan: %#v", tp)
+			}
+
+			var newAccounts []string
+			if !tt.skip {
+				newAccounts = []string{testDirectoryURL}
+			}
+
+			if !reflect.DeepEqual(p.NewAccounts, newAccounts) {
+				t.Fatalf("unexpected new accounts: %q", p.NewAccounts)
+			}
+		})
+	}
+}
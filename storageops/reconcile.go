@@ -8,6 +8,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"errors"
 	"fmt"
 	"github.com/hlandau/acme/acmeapi"
 	"github.com/hlandau/acme/acmeapi/acmeendpoints"
@@ -19,8 +20,12 @@ import (
 	"github.com/hlandau/xlog"
 	"github.com/jmhodges/clock"
 	"golang.org/x/net/context"
+	"net"
+	"net/url"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 var log, Log = xlog.New("acme.storageops")
@@ -33,12 +38,28 @@ type reconcile struct {
 
 	// Cache of account clients to avoid duplicated directory lookups.
 	accountClients map[*storage.Account]*acmeapi.Client
+
+	// Protects accountClients and changes to accounts, which may be shared by
+	// targets processed concurrently.
+	mutex sync.Mutex
+
+	// Maximum number of targets to process at once.
+	parallelism int
+
+	// If true, targets are processed even if recent attempts failed.
+	force bool
+
+	// Providers which have refused requests during this run because a rate
+	// limit was exceeded, by directory URL. No further certificates are
+	// requested from them. Protected by mutex.
+	rateLimits map[string]*acmeapi.RateLimitError
 }
 
 func makeReconcile(store storage.Store) *reconcile {
 	return &reconcile{
 		store:          store,
 		accountClients: map[*storage.Account]*acmeapi.Client{},
+		rateLimits:     map[string]*acmeapi.RateLimitError{},
 	}
 }
 
@@ -53,13 +74,88 @@ func (r *reconcile) EnsureRegistration() error {
 		return err
 	}
 
-	cl := r.getClientForAccount(a)
-	return solver.AssistedUpsertRegistration(cl, nil, context.TODO())
+	return r.upsertRegistration(a)
+}
+
+// Registers the account if it is not already registered.
+func (r *reconcile) upsertRegistration(a *storage.Account) error {
+	reg, err := newRegistration(a)
+	if err != nil {
+		return err
+	}
+
+	return solver.AssistedUpsertRegistration(r.getClientForAccount(a), reg, nil, context.TODO())
+}
+
+// Returns a registration for use as the basis for registering an account.
+func newRegistration(a *storage.Account) (*acmeapi.Registration, error) {
+	reg := &acmeapi.Registration{}
+	if a.ExternalAccountBinding != nil {
+		hmacKey, err := a.ExternalAccountBinding.DecodeHMACKey()
+		if err != nil {
+			return nil, err
+		}
+
+		reg.ExternalAccountBinding = &acmeapi.ExternalAccountBinding{
+			KeyID:   a.ExternalAccountBinding.KeyID,
+			HMACKey: hmacKey,
+		}
+	}
+
+	return reg, nil
 }
 
-// Runs the reconcilation operation.
-func Reconcile(store storage.Store) error {
+// Records in the account any external account binding credentials configured
+// for its provider, so that they are available when it is registered.
+func (r *reconcile) attachExternalAccountBinding(a *storage.Account, tr *storage.TargetRequest) error {
+	eab := tr.ExternalAccountBindings[a.DirectoryURL]
+	if eab == nil || (a.ExternalAccountBinding != nil && *a.ExternalAccountBinding == *eab) {
+		return nil
+	}
+
+	a.ExternalAccountBinding = eab
+	return r.store.SaveAccount(a)
+}
+
+// Reconcile settings.
+type ReconcileConfig struct {
+	// If true and another process is reconciling the state directory, wait for
+	// it to finish. Otherwise, fail with storage.ErrLocked.
+	WaitForLock bool
+
+	// The maximum number of targets to request certificates for at once.
+	// Targets with hostnames in common are never processed at the same time.
+	// Defaults to 1.
+	Parallelism int
+
+	// If true, request certificates for targets even if recent attempts to do
+	// so failed and the next attempt would otherwise be delayed.
+	Force bool
+}
+
+// Runs the reconcilation operation. The state directory is locked for the
+// duration.
+func Reconcile(store storage.Store, cfg ReconcileConfig) error {
+	err := store.Lock(cfg.WaitForLock)
+	if err != nil {
+		return err
+	}
+
+	defer store.Unlock()
+
+	// Another process may have changed the state, for example deactivating an
+	// account, while we waited for the lock.
+	err = store.Reload()
+	if err != nil {
+		return err
+	}
+
 	r := makeReconcile(store)
+	r.force = cfg.Force
+	if cfg.Parallelism > 1 {
+		r.store = &lockedStore{s: store}
+		r.parallelism = cfg.Parallelism
+	}
 
 	reconcileErr := r.Reconcile()
 	log.Errore(reconcileErr, "failed to reconcile")
@@ -70,7 +166,7 @@ func Reconcile(store storage.Store) error {
 	relinkErr := r.Relink()
 	log.Errore(relinkErr, "failed to relink after reconcilation")
 
-	err := reconcileErr
+	err = reconcileErr
 	if err == nil {
 		err = reloadErr
 	}
@@ -90,13 +186,21 @@ func Relink(store storage.Store) error {
 	return err
 }
 
-func (r *reconcile) Relink() error {
+// A change to the preferred certificate for a hostname.
+type relinkChange struct {
+	hostname string
+	c, cprev *storage.Certificate // cprev is nil if there was none.
+}
+
+// Determines the changes to be made to the preferred certificates for
+// hostnames by the relink operation.
+func (r *reconcile) relinkChanges() ([]relinkChange, error) {
 	hostnameTargetMapping, err := r.disjoinTargets()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var updatedHostnames []string
+	var changes []relinkChange
 
 	for name, tgt := range hostnameTargetMapping {
 		c, err := FindBestCertificateSatisfying(r.store, tgt)
@@ -110,14 +214,37 @@ func (r *reconcile) Relink() error {
 		cprev, err := r.store.PreferredCertificateForHostname(name)
 
 		if c != cprev || err != nil {
-			log.Debugf("relinking: %v -> %v (was %v)", name, c, cprev)
-			updatedHostnames = append(updatedHostnames, name)
+			if err != nil {
+				cprev = nil
+			}
 
-			err = r.store.SetPreferredCertificateForHostname(name, c)
-			log.Errore(err, "failed to set preferred certificate for hostname")
+			changes = append(changes, relinkChange{name, c, cprev})
 		}
 	}
 
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].hostname < changes[j].hostname
+	})
+
+	return changes, nil
+}
+
+func (r *reconcile) Relink() error {
+	changes, err := r.relinkChanges()
+	if err != nil {
+		return err
+	}
+
+	var updatedHostnames []string
+
+	for _, ch := range changes {
+		log.Debugf("relinking: %v -> %v (was %v)", ch.hostname, ch.c, ch.cprev)
+		updatedHostnames = append(updatedHostnames, ch.hostname)
+
+		err = r.store.SetPreferredCertificateForHostname(ch.hostname, ch.c)
+		log.Errore(err, "failed to set preferred certificate for hostname")
+	}
+
 	ctx := &hooks.Context{
 		HooksDir: "",
 		StateDir: r.store.Path(),
@@ -235,7 +362,7 @@ func (r *reconcile) downloadUncachedCertificates() error {
 func (r *reconcile) downloadCertificate(c *storage.Certificate) error {
 	log.Debugf("downloading certificate %v", c)
 
-	cl := r.getGenericClient()
+	cl := r.getClientForCertificateURL(c.URL)
 
 	crt := acmeapi.Certificate{
 		URI: c.URL,
@@ -360,7 +487,38 @@ func (r *reconcile) getClientForDirectoryURL(directoryURL string) *acmeapi.Clien
 	return cl
 }
 
+// Returns a client suitable for loading the certificate at the given URL. RFC
+// 8555 servers only allow certificates to be downloaded using an account, so
+// if an account exists for a provider on the same host as the certificate, its
+// client is used.
+func (r *reconcile) getClientForCertificateURL(certificateURL string) *acmeapi.Client {
+	cu, err := url.Parse(certificateURL)
+	if err != nil {
+		return r.getGenericClient()
+	}
+
+	var acct *storage.Account
+	r.store.VisitAccounts(func(a *storage.Account) error {
+		du, err := url.Parse(a.DirectoryURL)
+		if err == nil && du.Host == cu.Host && !a.Retired {
+			acct = a
+			return storage.StopVisiting
+		}
+
+		return nil
+	})
+
+	if acct == nil {
+		return r.getGenericClient()
+	}
+
+	return r.getClientForAccount(acct)
+}
+
 func (r *reconcile) getClientForAccount(a *storage.Account) *acmeapi.Client {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	cl := r.accountClients[a]
 	if cl == nil {
 		cl = r.getClientForDirectoryURL(a.DirectoryURL)
@@ -373,25 +531,58 @@ func (r *reconcile) getClientForAccount(a *storage.Account) *acmeapi.Client {
 
 func (r *reconcile) getRevocationAuthorizations(acct *storage.Account, crt *x509.Certificate) error {
 	log.Debugf("obtaining authorizations needed to facilitate revocation")
-	return r.obtainNecessaryAuthorizations(crt.DNSNames, acct, "", &r.store.DefaultTarget().Request.Challenge)
+
+	trc := &r.store.DefaultTarget().Request.Challenge
+
+	supportsOrders, err := r.getClientForAccount(acct).SupportsOrders(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	names := append([]string(nil), crt.DNSNames...)
+	for _, ip := range crt.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	if supportsOrders {
+		// Authorizations can only be obtained by creating an order, which is
+		// abandoned once its authorizations are complete.
+		order, err := r.createOrder(names, "", acct)
+		if err != nil {
+			return err
+		}
+
+		return r.completeOrderAuthorizations(order, acct, "", trc)
+	}
+
+	return r.obtainNecessaryAuthorizations(names, acct, "", trc)
 }
 
 func (r *reconcile) obtainNecessaryAuthorizations(names []string, a *storage.Account, targetFilename string, ccfg *storage.TargetRequestChallenge) error {
 	authsNeeded := r.determineNecessaryAuthorizations(names, a)
 
-	for _, name := range authsNeeded {
+	merr := runParallel(len(authsNeeded), ccfg.AuthorizationParallelism, func(i int) error {
+		name := authsNeeded[i]
 		log.Debugf("trying to obtain authorization for %q", name)
 		err := r.obtainAuthorization(name, a, targetFilename, ccfg)
 		if err != nil {
 			log.Errore(err, "could not obtain authorization for ", name)
-			return err
+			return &AuthorizationError{Name: name, Err: err}
 		}
+
+		return nil
+	})
+	if len(merr) != 0 {
+		return merr
 	}
 
 	return nil
 }
 
 func (r *reconcile) determineNecessaryAuthorizations(names []string, a *storage.Account) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	needed := map[string]struct{}{}
 	for _, n := range names {
 		needed[n] = struct{}{}
@@ -414,15 +605,15 @@ func (r *reconcile) determineNecessaryAuthorizations(names []string, a *storage.
 	return neededs
 }
 
-func generateHookPEM(info *responder.TLSSNIChallengeInfo) (string, error) {
+func generateHookPEM(certificate []byte, key crypto.PrivateKey) (string, error) {
 	b := bytes.Buffer{}
 
-	err := acmeutils.SaveCertificates(&b, info.Certificate)
+	err := acmeutils.SaveCertificates(&b, certificate)
 	if err != nil {
 		return "", err
 	}
 
-	err = acmeutils.SavePrivateKey(&b, info.Key)
+	err = acmeutils.SavePrivateKey(&b, key)
 	if err != nil {
 		return "", err
 	}
@@ -431,8 +622,55 @@ func generateHookPEM(info *responder.TLSSNIChallengeInfo) (string, error) {
 }
 
 func (r *reconcile) obtainAuthorization(name string, a *storage.Account, targetFilename string, trc *storage.TargetRequestChallenge) error {
+	if acmeutils.IsWildcardHostname(name) {
+		// Wildcard names can only be authorized as part of an order.
+		return fmt.Errorf("cannot obtain authorization for wildcard name %q: provider does not support orders", name)
+	}
+
 	cl := r.getClientForAccount(a)
 
+	az, err := solver.Authorize(cl, name, r.challengeConfig(name, targetFilename, trc), context.TODO())
+	if err != nil {
+		return err
+	}
+
+	err = cl.LoadAuthorization(az, context.TODO())
+	if err != nil {
+		// Try proceeding anyway.
+		return nil
+	}
+
+	return r.saveAuthorization(a, az)
+}
+
+// Records a valid authorization in the account.
+func (r *reconcile) saveAuthorization(a *storage.Account, az *acmeapi.Authorization) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if a.Authorizations == nil {
+		a.Authorizations = map[string]*storage.Authorization{}
+	}
+
+	// Authorizations for wildcard names are distinct from those for the
+	// corresponding base names.
+	name := az.Identifier.Value
+	if az.Wildcard {
+		name = "*." + name
+	}
+
+	a.Authorizations[name] = &storage.Authorization{
+		URL:     az.URI,
+		Name:    name,
+		Expires: az.Expires,
+	}
+
+	return r.store.SaveAccount(a)
+}
+
+// Returns the responder configuration for authorizing the given name for
+// the given target.
+func (r *reconcile) challengeConfig(name, targetFilename string, trc *storage.TargetRequestChallenge) responder.ChallengeConfig {
 	ctx := &hooks.Context{
 		HooksDir: "",
 		StateDir: r.store.Path(),
@@ -451,15 +689,23 @@ func (r *reconcile) obtainAuthorization(name string, a *storage.Account, targetF
 			_, err := hooks.ChallengeHTTPStart(ctx, name, targetFilename, v.Filename, v.Body)
 			return err
 		case *responder.TLSSNIChallengeInfo:
-			hookPEM, err := generateHookPEM(v)
+			hookPEM, err := generateHookPEM(v.Certificate, v.Key)
 			if err != nil {
 				return err
 			}
 
 			_, err = hooks.ChallengeTLSSNIStart(ctx, name, targetFilename, v.Hostname1, v.Hostname2, hookPEM)
 			return err
+		case *responder.TLSALPNChallengeInfo:
+			hookPEM, err := generateHookPEM(v.Certificate, v.Key)
+			if err != nil {
+				return err
+			}
+
+			_, err = hooks.ChallengeTLSALPNStart(ctx, name, targetFilename, hookPEM)
+			return err
 		case *responder.DNSChallengeInfo:
-			installed, err := hooks.ChallengeDNSStart(ctx, name, targetFilename, v.Body)
+			installed, err := hooks.ChallengeDNSStart(ctx, name, targetFilename, v.Body, strings.TrimSuffix(v.RecordName, "."))
 			if err == nil && !installed {
 				return fmt.Errorf("could not install DNS challenge, no hooks succeeded")
 			}
@@ -474,15 +720,23 @@ func (r *reconcile) obtainAuthorization(name string, a *storage.Account, targetF
 		case *responder.HTTPChallengeInfo:
 			return hooks.ChallengeHTTPStop(ctx, name, targetFilename, v.Filename, v.Body)
 		case *responder.TLSSNIChallengeInfo:
-			hookPEM, err := generateHookPEM(v)
+			hookPEM, err := generateHookPEM(v.Certificate, v.Key)
 			if err != nil {
 				return err
 			}
 
 			_, err = hooks.ChallengeTLSSNIStop(ctx, name, targetFilename, v.Hostname1, v.Hostname2, hookPEM)
 			return err
+		case *responder.TLSALPNChallengeInfo:
+			hookPEM, err := generateHookPEM(v.Certificate, v.Key)
+			if err != nil {
+				return err
+			}
+
+			_, err = hooks.ChallengeTLSALPNStop(ctx, name, targetFilename, hookPEM)
+			return err
 		case *responder.DNSChallengeInfo:
-			uninstalled, err := hooks.ChallengeDNSStop(ctx, name, targetFilename, v.Body)
+			uninstalled, err := hooks.ChallengeDNSStop(ctx, name, targetFilename, v.Body, strings.TrimSuffix(v.RecordName, "."))
 			if err == nil && !uninstalled {
 				return fmt.Errorf("could not uninstall DNS challenge, no hooks succeeded")
 			}
@@ -497,42 +751,38 @@ func (r *reconcile) obtainAuthorization(name string, a *storage.Account, targetF
 		httpSelfTest = *trc.HTTPSelfTest
 	}
 
-	ccfg := responder.ChallengeConfig{
-		WebPaths:       trc.WebrootPaths,
-		HTTPPorts:      trc.HTTPPorts,
-		HTTPNoSelfTest: !httpSelfTest,
-		PriorKeyFunc:   r.getPriorKey,
-		StartHookFunc:  startHookFunc,
-		StopHookFunc:   stopHookFunc,
-	}
-
-	az, err := solver.Authorize(cl, name, ccfg, context.TODO())
-	if err != nil {
-		return err
-	}
-
-	err = cl.LoadAuthorization(az, context.TODO())
-	if err != nil {
-		// Try proceeding anyway.
-		return nil
-	}
-
-	if a.Authorizations == nil {
-		a.Authorizations = map[string]*storage.Authorization{}
+	var rfc2136 *responder.RFC2136Config
+	if c := trc.RFC2136; c != nil {
+		rfc2136 = &responder.RFC2136Config{
+			Server:        c.Server,
+			Zone:          c.Zone,
+			TSIGKeyName:   c.TSIGKeyName,
+			TSIGAlgorithm: c.TSIGAlgorithm,
+			TSIGSecret:    c.TSIGSecret,
+		}
 	}
 
-	a.Authorizations[az.Identifier.Value] = &storage.Authorization{
-		URL:     az.URI,
-		Name:    az.Identifier.Value,
-		Expires: az.Expires,
+	var dnsServer *responder.DNSServerConfig
+	if c := trc.DNSServer; c != nil {
+		dnsServer = &responder.DNSServerConfig{
+			Zone:        c.Zone,
+			Nameserver:  c.Nameserver,
+			ListenAddrs: c.Listen,
+		}
 	}
 
-	err = r.store.SaveAccount(a)
-	if err != nil {
-		return err
+	return responder.ChallengeConfig{
+		WebPaths:              trc.WebrootPaths,
+		HTTPPorts:             trc.HTTPPorts,
+		HTTPNoSelfTest:        !httpSelfTest,
+		PriorKeyFunc:          r.getPriorKey,
+		RFC2136:               rfc2136,
+		DNSPropagationTimeout: time.Duration(trc.DNSPropagationTimeout) * time.Second,
+		DNSDelegationZone:     trc.DNSDelegationZone,
+		DNSServer:             dnsServer,
+		StartHookFunc:         startHookFunc,
+		StopHookFunc:          stopHookFunc,
 	}
-
-	return nil
 }
 
 func (r *reconcile) getPriorKey(publicKey crypto.PublicKey) (crypto.PrivateKey, error) {
@@ -554,7 +804,9 @@ func (r *reconcile) getPriorKey(publicKey crypto.PublicKey) (crypto.PrivateKey,
 	return k.PrivateKey, nil
 }
 
-func (r *reconcile) getAccountByDirectoryURL(directoryURL string) (*storage.Account, error) {
+// Returns the directory URL to be used given a provider, which may be empty
+// to use the default provider.
+func (r *reconcile) resolveDirectoryURL(directoryURL string) (string, error) {
 	if directoryURL == "" {
 		directoryURL = r.store.DefaultTarget().Request.Provider
 	}
@@ -564,15 +816,33 @@ func (r *reconcile) getAccountByDirectoryURL(directoryURL string) (*storage.Acco
 	}
 
 	if !acmeapi.ValidURL(directoryURL) {
-		return nil, fmt.Errorf("directory URL is not a valid HTTPS URL")
+		return "", fmt.Errorf("directory URL is not a valid HTTPS URL")
+	}
+
+	return directoryURL, nil
+}
+
+func (r *reconcile) getAccountByDirectoryURL(directoryURL string) (*storage.Account, error) {
+	directoryURL, err := r.resolveDirectoryURL(directoryURL)
+	if err != nil {
+		return nil, err
 	}
 
 	ma := r.store.AccountByDirectoryURL(directoryURL)
-	if ma != nil {
-		return ma, nil
+	if ma == nil {
+		var err error
+		ma, err = r.createNewAccount(directoryURL)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return r.createNewAccount(directoryURL)
+	err = r.attachExternalAccountBinding(ma, &r.store.DefaultTarget().Request)
+	if err != nil {
+		return nil, err
+	}
+
+	return ma, nil
 }
 
 func (r *reconcile) createNewAccount(directoryURL string) (*storage.Account, error) {
@@ -595,27 +865,101 @@ func (r *reconcile) createNewAccount(directoryURL string) (*storage.Account, err
 	return a, nil
 }
 
+// A target for which a certificate is to be requested, and the account to be
+// used.
+type pendingTarget struct {
+	t    *storage.Target
+	acct *storage.Account
+}
+
 func (r *reconcile) processTargets() error {
 	var merr storage.MultiError
+	var merrMutex sync.Mutex
 
+	// Do not block satisfaction of other targets just because one fails;
+	// collect errors and return them as one.
+	targetFailed := func(t *storage.Target, err error) {
+		log.Errore(err, t, ": failed to request certificate")
+		log.Errore(r.recordTargetFailure(t, err), t, ": could not record failure")
+
+		merrMutex.Lock()
+		defer merrMutex.Unlock()
+		merr = append(merr, &TargetSpecificError{
+			Target: t,
+			Err:    err,
+		})
+	}
+
+	// Targets which are not attempted because the provider is rate limiting
+	// requests are not counted as failed attempts, so that one rate limit
+	// does not lengthen the backoff of unrelated targets.
+	targetSkipped := func(t *storage.Target, rle *acmeapi.RateLimitError) {
+		log.Errore(rle, t, ": not requesting certificate")
+		log.Errore(r.deferTarget(t, rle.RetryAfter), t, ": could not record failure")
+
+		merrMutex.Lock()
+		defer merrMutex.Unlock()
+		merr = append(merr, &TargetSpecificError{
+			Target: t,
+			Err:    rle,
+		})
+	}
+
+	// Accounts are prepared one target at a time, since registration may
+	// require interaction.
+	var pending []pendingTarget
 	r.store.VisitTargets(func(t *storage.Target) error {
+		// No requests are made on behalf of a target while it is in backoff,
+		// including for renewal information.
+		if tf := r.targetBackoff(t); tf != nil {
+			log.Warnf("%v: skipping target until %v after %d failed attempts", t, tf.NextAttempt.Local(), tf.Count)
+			return nil
+		}
+
 		c, err := FindBestCertificateSatisfying(r.store, t)
 		log.Debugf("%v: best certificate satisfying is %v, err=%v", t, c, err)
-		if err == nil && !CertificateNeedsRenewing(c) {
+		if err == nil {
+			// Fall back to the default renewal time if this fails.
+			log.Warne(r.updateRenewalInfo(c), t, ": could not obtain renewal information for ", c)
+		}
+
+		if err == nil && !CertificateNeedsRenewingForTarget(c, t) {
 			log.Debugf("%v: have best certificate which does not need renewing, skipping target", t)
 			return nil // continue
 		}
 
-		log.Debugf("%v: requesting certificate", t)
-		err = r.requestCertificateForTarget(t)
-		log.Errore(err, t, ": failed to request certificate")
+		acct, err := r.prepareTarget(t)
 		if err != nil {
-			// Do not block satisfaction of other targets just because one fails;
-			// collect errors and return them as one.
-			merr = append(merr, &TargetSpecificError{
-				Target: t,
-				Err:    err,
-			})
+			if acct != nil {
+				r.noteRateLimit(acct.DirectoryURL, err)
+			}
+
+			targetFailed(t, err)
+			return nil
+		}
+
+		pending = append(pending, pendingTarget{t, acct})
+		return nil
+	})
+
+	groups := groupTargets(pending)
+	runParallel(len(groups), r.parallelism, func(i int) error {
+		for _, pt := range groups[i] {
+			if rle := r.rateLimit(pt.acct.DirectoryURL); rle != nil {
+				log.Debugf("%v: not requesting certificate as provider is rate limiting requests", pt.t)
+				targetSkipped(pt.t, rle)
+				continue
+			}
+
+			log.Debugf("%v: requesting certificate", pt.t)
+			err := r.requestCertificateForTarget(pt.t, pt.acct)
+			if err != nil {
+				r.noteRateLimit(pt.acct.DirectoryURL, err)
+				targetFailed(pt.t, err)
+				continue
+			}
+
+			log.Errore(r.clearTargetFailure(pt.t), pt.t, ": could not remove failure record")
 		}
 
 		return nil
@@ -630,6 +974,154 @@ func (r *reconcile) processTargets() error {
 	return nil
 }
 
+// If err indicates that the provider with the given directory URL refused a
+// request because a rate limit was exceeded, records that no more requests
+// should be made to it during this run.
+func (r *reconcile) noteRateLimit(directoryURL string, err error) {
+	var rle *acmeapi.RateLimitError
+	if !errors.As(err, &rle) {
+		return
+	}
+
+	log.Warnf("provider %v is rate limiting requests; not making further requests to it", directoryURL)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rateLimits[directoryURL] = rle
+}
+
+// Returns the error with which the provider with the given directory URL
+// refused a request because a rate limit was exceeded, or nil.
+func (r *reconcile) rateLimit(directoryURL string) *acmeapi.RateLimitError {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rateLimits[directoryURL]
+}
+
+// Maximum number of failed attempts recorded for each target.
+const maxFailureHistory = 10
+
+// Records a failed attempt to obtain a certificate for the target, delaying
+// the next attempt.
+func (r *reconcile) recordTargetFailure(t *storage.Target, err error) error {
+	now := InternalClock.Now()
+
+	tf := r.targetFailure(t)
+	tf.Count++
+	tf.NextAttempt = now.Add(failureBackoff(tf.Count))
+
+	// If the provider said when issuance can resume, don't try before then.
+	var rle *acmeapi.RateLimitError
+	if errors.As(err, &rle) && rle.RetryAfter.After(tf.NextAttempt) {
+		tf.NextAttempt = rle.RetryAfter
+	}
+
+	tf.History = append(tf.History, storage.FailedAttempt{
+		Time:  now,
+		Error: err.Error(),
+	})
+	if len(tf.History) > maxFailureHistory {
+		tf.History = tf.History[len(tf.History)-maxFailureHistory:]
+	}
+
+	return r.store.SaveTargetFailure(tf)
+}
+
+// Delays the next attempt to obtain a certificate for the target until the
+// given time, if it is later than already recorded, without recording a
+// failed attempt.
+func (r *reconcile) deferTarget(t *storage.Target, until time.Time) error {
+	tf := r.targetFailure(t)
+	if !until.After(tf.NextAttempt) {
+		return nil
+	}
+
+	tf.NextAttempt = until
+	return r.store.SaveTargetFailure(tf)
+}
+
+// Returns the failure record for the target if no attempt to obtain a
+// certificate for it should be made yet, or nil. Always nil when forcing.
+func (r *reconcile) targetBackoff(t *storage.Target) *storage.TargetFailure {
+	tf := r.store.TargetFailure(t.Filename)
+	if tf == nil || r.force || !tf.InBackoff(InternalClock) {
+		return nil
+	}
+
+	return tf
+}
+
+// Forgets the failed attempts to obtain a certificate for the target, once one
+// has been obtained.
+func (r *reconcile) clearTargetFailure(t *storage.Target) error {
+	if r.store.TargetFailure(t.Filename) == nil {
+		return nil
+	}
+
+	return r.store.RemoveTargetFailure(t.Filename)
+}
+
+// Returns a copy of the failure record for the target, or a new record if
+// there is none, so that the record held by the store is not modified until
+// it is saved.
+func (r *reconcile) targetFailure(t *storage.Target) *storage.TargetFailure {
+	tf := r.store.TargetFailure(t.Filename)
+	if tf == nil {
+		return &storage.TargetFailure{TargetFilename: t.Filename}
+	}
+
+	tfc := *tf
+	tfc.History = append([]storage.FailedAttempt(nil), tf.History...)
+	return &tfc
+}
+
+// Partitions targets into groups such that targets in different groups have
+// no names in common, and so can be processed concurrently without competing
+// to complete the same challenges. Targets are in their original order within
+// each group.
+func groupTargets(pending []pendingTarget) [][]pendingTarget {
+	parent := make([]int, len(pending))
+	for i := range parent {
+		parent[i] = i
+	}
+
+	find := func(i int) int {
+		for parent[i] != i {
+			i = parent[i]
+		}
+		return i
+	}
+
+	firstWithName := map[string]int{}
+	for i, pt := range pending {
+		for _, name := range pt.t.Request.Names {
+			j, ok := firstWithName[name]
+			if !ok {
+				firstWithName[name] = i
+				continue
+			}
+
+			parent[find(i)] = find(j)
+		}
+	}
+
+	var groups [][]pendingTarget
+	groupByRoot := map[int]int{}
+	for i, pt := range pending {
+		root := find(i)
+		gi, ok := groupByRoot[root]
+		if !ok {
+			gi = len(groups)
+			groupByRoot[root] = gi
+			groups = append(groups, nil)
+		}
+
+		groups[gi] = append(groups[gi], pt)
+	}
+
+	return groups
+}
+
 func (r *reconcile) getRequestAccount(tr *storage.TargetRequest) (*storage.Account, error) {
 	if tr.Account != nil {
 		return tr.Account, nil
@@ -641,6 +1133,11 @@ func (r *reconcile) getRequestAccount(tr *storage.TargetRequest) (*storage.Accou
 		return nil, err
 	}
 
+	err = r.attachExternalAccountBinding(acct, tr)
+	if err != nil {
+		return nil, err
+	}
+
 	return acct, nil
 }
 
@@ -673,23 +1170,39 @@ func ensureConceivablySatisfiable(t *storage.Target) {
 	}
 }
 
-func (r *reconcile) requestCertificateForTarget(t *storage.Target) error {
-	//return fmt.Errorf("not requesting certificate") // debugging neuter
-
+// Determines the account to be used to request a certificate for a target,
+// registering it if necessary. If an error occurs after the account has been
+// determined, it is returned along with the error.
+func (r *reconcile) prepareTarget(t *storage.Target) (*storage.Account, error) {
 	ensureConceivablySatisfiable(t)
 
 	acct, err := r.getRequestAccount(&t.Request)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	err = r.upsertRegistration(acct)
+	if err != nil {
+		return acct, err
+	}
+
+	return acct, nil
+}
+
+func (r *reconcile) requestCertificateForTarget(t *storage.Target, acct *storage.Account) error {
+	//return fmt.Errorf("not requesting certificate") // debugging neuter
+
 	cl := r.getClientForAccount(acct)
 
-	err = solver.AssistedUpsertRegistration(cl, nil, context.TODO())
+	supportsOrders, err := cl.SupportsOrders(context.TODO())
 	if err != nil {
 		return err
 	}
 
+	if supportsOrders {
+		return r.requestCertificateForTargetViaOrder(t, acct)
+	}
+
 	err = r.obtainNecessaryAuthorizations(t.Request.Names, acct, t.Filename, &t.Request.Challenge)
 	if err != nil {
 		return err
@@ -732,11 +1245,18 @@ func (r *reconcile) createCSR(t *storage.Target) ([]byte, error) {
 		return nil, fmt.Errorf("cannot request a certificate with no names")
 	}
 
-	csr := &x509.CertificateRequest{
-		DNSNames: t.Request.Names,
-		Subject: pkix.Name{
-			CommonName: t.Request.Names[0],
-		},
+	csr := &x509.CertificateRequest{}
+	for _, name := range t.Request.Names {
+		if ip := net.ParseIP(name); ip != nil {
+			csr.IPAddresses = append(csr.IPAddresses, ip)
+		} else {
+			csr.DNSNames = append(csr.DNSNames, name)
+		}
+	}
+
+	// IP addresses are not placed in the common name.
+	if len(csr.DNSNames) > 0 {
+		csr.Subject.CommonName = csr.DNSNames[0]
 	}
 
 	if t.Request.OCSPMustStaple {
@@ -802,15 +1322,9 @@ func DoesCertificateSatisfy(c *storage.Certificate, t *storage.Target) bool {
 		return false
 	}
 
-	names := map[string]struct{}{}
-	for _, name := range cc.DNSNames {
-		names[name] = struct{}{}
-	}
-
 	for _, name := range t.Satisfy.Names {
-		_, ok := names[name]
-		if !ok {
-			log.Debugf("%v cannot satisfy %v because required hostname %q is not listed on it: %#v", c, t, name, cc.DNSNames)
+		if !certificateCoversName(cc, name) {
+			log.Debugf("%v cannot satisfy %v because required name %q is not listed on it: %#v %v", c, t, name, cc.DNSNames, cc.IPAddresses)
 			return false
 		}
 	}
@@ -819,6 +1333,28 @@ func DoesCertificateSatisfy(c *storage.Certificate, t *storage.Target) bool {
 	return true
 }
 
+// Returns true iff one of the certificate's SANs is valid for the given
+// hostname or IP address, taking wildcard SANs into account.
+func certificateCoversName(cc *x509.Certificate, name string) bool {
+	if ip := net.ParseIP(name); ip != nil {
+		for _, certIP := range cc.IPAddresses {
+			if certIP.Equal(ip) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, certName := range cc.DNSNames {
+		if acmeutils.HostnameMatches(certName, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func FindBestCertificateSatisfying(s storage.Store, t *storage.Target) (*storage.Certificate, error) {
 	var bestCert *storage.Certificate
 
@@ -875,25 +1411,61 @@ func CertificateBetterThan(a, b *storage.Certificate) (bool, error) {
 	return isAfter, nil
 }
 
+// Returns true if the certificate should be renewed under the default
+// renewal policy.
 func CertificateNeedsRenewing(c *storage.Certificate) bool {
+	return CertificateNeedsRenewingForTarget(c, nil)
+}
+
+// Returns true if the certificate should be renewed under the renewal policy
+// of the target, or the default policy if t is nil.
+func CertificateNeedsRenewingForTarget(c *storage.Certificate, t *storage.Target) bool {
 	if len(c.Certificates) == 0 {
 		log.Debugf("%v: not renewing because it has no actual certificates (???)", c)
 		return false
 	}
 
-	cc, err := x509.ParseCertificate(c.Certificates[0])
+	renewTime, err := CertificateRenewalTime(c, t)
 	if err != nil {
 		log.Debugf("%v: not renewing because its end certificate is unparseable", c)
 		return false
 	}
 
-	renewTime := renewTime(cc.NotBefore, cc.NotAfter)
 	needsRenewing := !InternalClock.Now().Before(renewTime)
 
-	log.Debugf("%v needsRenewing=%v notAfter=%v", c, needsRenewing, cc.NotAfter)
+	log.Debugf("%v needsRenewing=%v renewTime=%v", c, needsRenewing, renewTime)
 	return needsRenewing
 }
 
+// Returns the time at which the certificate should be renewed under the
+// renewal policy of the target, or the default policy if t is nil. If the
+// issuer has suggested a renewal time, that is used instead of the default
+// policy, or of the target's policy if it is earlier.
+func CertificateRenewalTime(c *storage.Certificate, t *storage.Target) (time.Time, error) {
+	if len(c.Certificates) == 0 {
+		return time.Time{}, fmt.Errorf("%v has no actual certificates", c)
+	}
+
+	cc, err := x509.ParseCertificate(c.Certificates[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var rp storage.TargetRequestRenewal
+	if t != nil {
+		rp = t.Request.Renewal
+	}
+
+	renewTime := renewTime(cc.NotBefore, cc.NotAfter, &rp, certificateJitter(c))
+	if ri := c.RenewalInfo; ri != nil && !ri.RenewAt.IsZero() {
+		if !rp.IsSet() || ri.RenewAt.Before(renewTime) {
+			renewTime = ri.RenewAt
+		}
+	}
+
+	return renewTime, nil
+}
+
 // This is used to detertmine whether to cull certificates.
 func CertificateGenerallyValid(c *storage.Certificate) bool {
 	// This function is very conservative because if we return false
@@ -0,0 +1,134 @@
+package storageops
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"github.com/hlandau/acme/acmeapi"
+	"github.com/hlandau/acme/storage"
+	"golang.org/x/net/context"
+	"io"
+	"math/big"
+	"net/url"
+	"time"
+)
+
+// The source of randomness used to choose renewal times within the windows
+// suggested by issuers. Replaced when testing.
+var renewalRand io.Reader = rand.Reader
+
+// Fetches the renewal information for a certificate from its issuer, if the
+// issuer provides it and the information previously obtained is due to be
+// checked again. The information is stored with the certificate, and is used
+// by CertificateRenewalTime in preference to the default renewal policy.
+func (r *reconcile) updateRenewalInfo(c *storage.Certificate) error {
+	if len(c.Certificates) == 0 {
+		return nil
+	}
+
+	if c.RenewalInfo != nil && InternalClock.Now().Before(c.RenewalInfo.NextCheck) {
+		return nil
+	}
+
+	// Renewal information can only be obtained for certificates issued by a
+	// provider for which we have an account, since otherwise the directory
+	// URL is not known.
+	cl := r.getClientForCertificateURL(c.URL)
+	if cl.DirectoryURL == "" {
+		return nil
+	}
+
+	// The stored information, if any, is used until the issuer is accepting
+	// requests again.
+	if r.rateLimit(cl.DirectoryURL) != nil {
+		return nil
+	}
+
+	crt, err := x509.ParseCertificate(c.Certificates[0])
+	if err != nil {
+		return err
+	}
+
+	ri, err := cl.LoadRenewalInfo(crt, context.TODO())
+	if errors.Is(err, acmeapi.ErrRenewalInfoNotSupported) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	c.RenewalInfo = chooseRenewalTime(c.RenewalInfo, ri)
+	log.Debugf("%v: issuer suggests renewal between %v and %v, will renew at %v",
+		c, ri.SuggestedWindow.Start, ri.SuggestedWindow.End, c.RenewalInfo.RenewAt)
+
+	return r.store.SaveCertificate(c)
+}
+
+// Returns the renewal information to be stored for a certificate given the
+// information previously stored, if any, and that just obtained from the
+// issuer. The renewal time is chosen at random within the suggested window,
+// so that certificates issued at the same time are not all renewed at once.
+// It is kept as long as the window does not change.
+func chooseRenewalTime(old *storage.RenewalInfo, ri *acmeapi.RenewalInfo) *storage.RenewalInfo {
+	w := ri.SuggestedWindow
+	nri := &storage.RenewalInfo{
+		WindowStart:    w.Start,
+		WindowEnd:      w.End,
+		NextCheck:      ri.RetryAfter,
+		ExplanationURL: ri.ExplanationURL,
+	}
+
+	if old != nil && old.WindowStart.Equal(w.Start) && old.WindowEnd.Equal(w.End) && !old.RenewAt.IsZero() {
+		nri.RenewAt = old.RenewAt
+		return nri
+	}
+
+	nri.RenewAt = w.Start
+	if !w.End.After(w.Start) {
+		return nri
+	}
+
+	n, err := rand.Int(renewalRand, big.NewInt(int64(w.End.Sub(w.Start))))
+	if err == nil {
+		nri.RenewAt = w.Start.Add(time.Duration(n.Int64()))
+	}
+
+	return nri
+}
+
+// Returns the identifier of the certificate to be replaced by a new order for
+// a target, or "" if there is none. A certificate is only replaced if it was
+// issued by the provider with which the order is being placed, and the
+// provider supports renewal information.
+func (r *reconcile) replacedCertificateID(t *storage.Target, acct *storage.Account) string {
+	c, err := FindBestCertificateSatisfying(r.store, t)
+	if err != nil || len(c.Certificates) == 0 {
+		return ""
+	}
+
+	cu, err := url.Parse(c.URL)
+	if err != nil {
+		return ""
+	}
+
+	du, err := url.Parse(acct.DirectoryURL)
+	if err != nil || du.Host != cu.Host {
+		return ""
+	}
+
+	supported, err := r.getClientForAccount(acct).SupportsRenewalInfo(context.TODO())
+	if err != nil || !supported {
+		return ""
+	}
+
+	crt, err := x509.ParseCertificate(c.Certificates[0])
+	if err != nil {
+		return ""
+	}
+
+	id, err := acmeapi.CertificateIdentifier(crt)
+	if err != nil {
+		return ""
+	}
+
+	return id
+}
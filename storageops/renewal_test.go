@@ -0,0 +1,257 @@
+package storageops
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"github.com/hlandau/acme/acmeapi"
+	"github.com/hlandau/acme/storage"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+func TestRenewTime(t *testing.T) {
+	notBefore := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(90 * day)
+
+	tests := []struct {
+		name      string
+		validity  time.Duration
+		rp        storage.TargetRequestRenewal
+		jitter    float64
+		renewSpan time.Duration // before expiry
+	}{
+		{name: "default", validity: 90 * day, renewSpan: 30 * day},
+		{name: "default-short", validity: 9 * day, renewSpan: 3 * day},
+		{name: "margin", validity: 90 * day, rp: storage.TargetRequestRenewal{Margin: storage.Duration(10 * day)}, renewSpan: 10 * day},
+		{name: "fraction", validity: 90 * day, rp: storage.TargetRequestRenewal{LifetimeFraction: 0.5}, renewSpan: 45 * day},
+		{name: "margin-and-fraction", validity: 90 * day, rp: storage.TargetRequestRenewal{Margin: storage.Duration(10 * day), LifetimeFraction: 0.5}, renewSpan: 10 * day},
+		{name: "fraction-and-margin", validity: 90 * day, rp: storage.TargetRequestRenewal{Margin: storage.Duration(50 * day), LifetimeFraction: 0.1}, renewSpan: 9 * day},
+		{name: "fraction-out-of-range", validity: 90 * day, rp: storage.TargetRequestRenewal{Margin: storage.Duration(10 * day), LifetimeFraction: 1.5}, renewSpan: 10 * day},
+		{name: "jitter-min", validity: 90 * day, rp: storage.TargetRequestRenewal{Jitter: storage.Duration(4 * day)}, renewSpan: 30 * day},
+		{name: "jitter-half", validity: 90 * day, rp: storage.TargetRequestRenewal{Jitter: storage.Duration(4 * day)}, jitter: 0.5, renewSpan: 32 * day},
+		{name: "jitter-with-margin", validity: 90 * day, rp: storage.TargetRequestRenewal{Margin: storage.Duration(10 * day), Jitter: storage.Duration(4 * day)}, jitter: 0.25, renewSpan: 11 * day},
+	}
+
+	for _, tt := range tests {
+		notAfter := notBefore.Add(tt.validity)
+		rt := renewTime(notBefore, notAfter, &tt.rp, tt.jitter)
+		if expected := notAfter.Add(-tt.renewSpan); !rt.Equal(expected) {
+			t.Errorf("%s: renewal time %v, expected %v", tt.name, rt, expected)
+		}
+	}
+
+	// Jitter only ever brings renewal forward, by less than the configured
+	// amount.
+	rp := &storage.TargetRequestRenewal{Jitter: storage.Duration(4 * day)}
+	latest := renewTime(notBefore, notAfter, &storage.TargetRequestRenewal{}, 0)
+	for _, jitter := range []float64{0, 0.1, 0.5, 0.9, 1 - 1.0/(1<<53)} {
+		rt := renewTime(notBefore, notAfter, rp, jitter)
+		if rt.After(latest) || !rt.After(latest.Add(-4*day)) {
+			t.Errorf("jitter %v: renewal time %v outside bounds", jitter, rt)
+		}
+	}
+}
+
+func TestCertificateJitter(t *testing.T) {
+	seen := map[float64]struct{}{}
+	for i := 0; i < 1000; i++ {
+		c := &storage.Certificate{URL: fmt.Sprintf("https://ca.test/cert/%d", i)}
+
+		j := certificateJitter(c)
+		if j < 0 || j >= 1 {
+			t.Fatalf("jitter %v out of range", j)
+		}
+
+		if certificateJitter(c) != j {
+			t.Fatalf("jitter for %v changed", c.URL)
+		}
+
+		seen[j] = struct{}{}
+	}
+
+	if len(seen) != 1000 {
+		t.Fatalf("jitter not distinct between certificates")
+	}
+}
+
+func TestCertificateRenewalTime(t *testing.T) {
+	fc := fakeClock(t)
+	r, tgt := testReconcile(t)
+
+	c := addTestCertificate(t, r.store, "example.com", fc.Now().Add(-60*day), fc.Now().Add(30*day))
+	cc, err := x509.ParseCertificate(c.Certificates[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jitter := storage.Duration(2 * day)
+	margin := storage.Duration(10 * day)
+	defaultTime := renewTime(cc.NotBefore, cc.NotAfter, &storage.TargetRequestRenewal{}, 0)
+	marginTime := cc.NotAfter.Add(-time.Duration(margin))
+	jitterTime := renewTime(cc.NotBefore, cc.NotAfter, &storage.TargetRequestRenewal{Jitter: jitter}, certificateJitter(c))
+
+	tests := []struct {
+		name     string
+		rp       storage.TargetRequestRenewal
+		ariTime  time.Time // suggested by the issuer, if not zero
+		expected time.Time
+	}{
+		{name: "default", expected: defaultTime},
+		{name: "jitter", rp: storage.TargetRequestRenewal{Jitter: jitter}, expected: jitterTime},
+		{name: "margin", rp: storage.TargetRequestRenewal{Margin: margin}, expected: marginTime},
+
+		// The issuer's suggestion replaces the default policy, but only brings
+		// a configured renewal time forward.
+		{name: "ari-later", ariTime: defaultTime.Add(5 * day), expected: defaultTime.Add(5 * day)},
+		{name: "ari-earlier", ariTime: defaultTime.Add(-5 * day), expected: defaultTime.Add(-5 * day)},
+		{name: "ari-later-margin", rp: storage.TargetRequestRenewal{Margin: margin}, ariTime: marginTime.Add(day), expected: marginTime},
+		{name: "ari-earlier-margin", rp: storage.TargetRequestRenewal{Margin: margin}, ariTime: marginTime.Add(-day), expected: marginTime.Add(-day)},
+	}
+
+	for _, tt := range tests {
+		c.RenewalInfo = nil
+		if !tt.ariTime.IsZero() {
+			c.RenewalInfo = &storage.RenewalInfo{RenewAt: tt.ariTime}
+		}
+
+		tgt.Request.Renewal = tt.rp
+		rt, err := CertificateRenewalTime(c, tgt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !rt.Equal(tt.expected) {
+			t.Errorf("%s: renewal time %v, expected %v", tt.name, rt, tt.expected)
+		}
+
+		// The certificate needs renewing from the renewal time on.
+		fc.Set(tt.expected.Add(-time.Second))
+		if CertificateNeedsRenewingForTarget(c, tgt) {
+			t.Errorf("%s: needs renewing before renewal time", tt.name)
+		}
+
+		fc.Set(tt.expected)
+		if !CertificateNeedsRenewingForTarget(c, tgt) {
+			t.Errorf("%s: does not need renewing at renewal time", tt.name)
+		}
+	}
+
+	// Without a target, the default policy applies.
+	c.RenewalInfo = nil
+	rt, err := CertificateRenewalTime(c, nil)
+	if err != nil || !rt.Equal(defaultTime) {
+		t.Fatalf("unexpected renewal time without target: %v %v", rt, err)
+	}
+}
+
+// Replaces the source of randomness used to choose renewal times for the
+// duration of a test.
+func setRenewalRand(t *testing.T, r io.Reader) {
+	prev := renewalRand
+	renewalRand = r
+	t.Cleanup(func() {
+		renewalRand = prev
+	})
+}
+
+func TestChooseRenewalTime(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	ri := &acmeapi.RenewalInfo{
+		SuggestedWindow: acmeapi.RenewalWindow{Start: start, End: start.Add(6 * time.Hour)},
+		RetryAfter:      start.Add(-18 * time.Hour),
+		ExplanationURL:  "https://ca.test/explanation",
+	}
+
+	// The lowest possible draw selects the start of the window.
+	setRenewalRand(t, bytes.NewReader(make([]byte, 64)))
+	nri := chooseRenewalTime(nil, ri)
+	if !nri.RenewAt.Equal(start) || !nri.WindowStart.Equal(start) || !nri.WindowEnd.Equal(ri.SuggestedWindow.End) ||
+		!nri.NextCheck.Equal(ri.RetryAfter) || nri.ExplanationURL != ri.ExplanationURL {
+		t.Fatalf("unexpected renewal information: %#v", nri)
+	}
+
+	// Otherwise, a time within the window is selected.
+	setRenewalRand(t, mathrand.New(mathrand.NewSource(1)))
+	times := map[time.Time]struct{}{}
+	for i := 0; i < 100; i++ {
+		nri := chooseRenewalTime(nil, ri)
+		if nri.RenewAt.Before(start) || !nri.RenewAt.Before(ri.SuggestedWindow.End) {
+			t.Fatalf("renewal time %v outside window", nri.RenewAt)
+		}
+
+		times[nri.RenewAt] = struct{}{}
+	}
+
+	if len(times) < 90 {
+		t.Fatalf("renewal times not chosen at random: %d distinct", len(times))
+	}
+
+	// The time is kept while the window is unchanged.
+	old := &storage.RenewalInfo{
+		WindowStart: start,
+		WindowEnd:   ri.SuggestedWindow.End,
+		RenewAt:     start.Add(time.Hour),
+	}
+
+	if nri := chooseRenewalTime(old, ri); !nri.RenewAt.Equal(old.RenewAt) {
+		t.Fatalf("renewal time changed for unchanged window: %v", nri.RenewAt)
+	}
+
+	ri.SuggestedWindow.Start = start.Add(-24 * time.Hour)
+	if nri := chooseRenewalTime(old, ri); nri.RenewAt.Equal(old.RenewAt) || nri.RenewAt.Before(ri.SuggestedWindow.Start) ||
+		!nri.RenewAt.Before(ri.SuggestedWindow.End) {
+		t.Fatalf("renewal time not chosen for changed window: %v", nri.RenewAt)
+	}
+
+	// An empty window selects its start.
+	ri.SuggestedWindow.End = ri.SuggestedWindow.Start
+	if nri := chooseRenewalTime(nil, ri); !nri.RenewAt.Equal(ri.SuggestedWindow.Start) {
+		t.Fatalf("unexpected renewal time for empty window: %v", nri.RenewAt)
+	}
+}
+
+func TestUpdateRenewalInfo(t *testing.T) {
+	fc := fakeClock(t)
+	srv := newTestOrderServer(t)
+	r, _, _ := srv.reconcile(t)
+
+	c := addTestCertificate(t, r.store, "example.com", fc.Now().Add(-60*day), fc.Now().Add(30*day))
+	cc, err := x509.ParseCertificate(c.Certificates[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := acmeapi.CertificateIdentifier(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := 0
+	start := fc.Now().Add(10 * day)
+	srv.mt.AddHandlerFunc("ca.test/renewal-info/"+id, func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(200)
+		fmt.Fprintf(rw, `{"suggestedWindow":{"start":%q,"end":%q}}`,
+			start.Format(time.RFC3339), start.Add(day).Format(time.RFC3339))
+	})
+
+	// No request is made to an issuer which is rate limiting requests.
+	r.rateLimits[testDirectoryURL] = &acmeapi.RateLimitError{HTTPError: &acmeapi.HTTPError{}}
+	err = r.updateRenewalInfo(c)
+	if err != nil || requests != 0 || c.RenewalInfo != nil {
+		t.Fatalf("renewal information requested while rate limited: %v %d", err, requests)
+	}
+
+	delete(r.rateLimits, testDirectoryURL)
+	err = r.updateRenewalInfo(c)
+	if err != nil || requests != 1 || c.RenewalInfo == nil || !c.RenewalInfo.WindowStart.Equal(start) {
+		t.Fatalf("renewal information not obtained: %v %d %#v", err, requests, c.RenewalInfo)
+	}
+}
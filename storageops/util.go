@@ -5,9 +5,12 @@ import (
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
 	"fmt"
 	"github.com/hlandau/acme/storage"
+	"sync"
 	"time"
 )
 
@@ -47,16 +50,47 @@ func targetGt(a *storage.Target, b *storage.Target) bool {
 // emails at 19 days, so...
 const renewalMargin = 30 * 24 * time.Hour // close enough to 30 days
 
-func renewTime(notBefore, notAfter time.Time) time.Time {
+// Returns the time at which a certificate valid between notBefore and
+// notAfter should be renewed under the given policy. jitter is a value in
+// [0, 1) determining how much of the policy's jitter is applied.
+func renewTime(notBefore, notAfter time.Time, rp *storage.TargetRequestRenewal, jitter float64) time.Time {
 	validityPeriod := notAfter.Sub(notBefore)
-	renewSpan := validityPeriod / 3
-	if renewSpan > renewalMargin {
-		renewSpan = renewalMargin
+
+	var renewSpan time.Duration
+	if rp.IsSet() {
+		if rp.Margin > 0 {
+			renewSpan = time.Duration(rp.Margin)
+		}
+
+		if f := rp.LifetimeFraction; f > 0 && f < 1 {
+			fspan := time.Duration(float64(validityPeriod) * f)
+			if renewSpan == 0 || fspan < renewSpan {
+				renewSpan = fspan
+			}
+		}
+	} else {
+		renewSpan = validityPeriod / 3
+		if renewSpan > renewalMargin {
+			renewSpan = renewalMargin
+		}
+	}
+
+	if rp.Jitter > 0 {
+		renewSpan += time.Duration(float64(rp.Jitter) * jitter)
 	}
 
 	return notAfter.Add(-renewSpan)
 }
 
+// Returns a value in [0, 1) which is fixed for a given certificate, used to
+// determine how much jitter is applied to its renewal time. It is derived
+// from the certificate rather than chosen at random each time so that the
+// renewal time does not change between runs.
+func certificateJitter(c *storage.Certificate) float64 {
+	h := sha256.Sum256([]byte(c.URL))
+	return float64(binary.BigEndian.Uint64(h[:])>>11) / (1 << 53)
+}
+
 func signatureAlgorithmFromKey(pk crypto.PrivateKey) (x509.SignatureAlgorithm, error) {
 	switch pk.(type) {
 	case *rsa.PrivateKey:
@@ -90,3 +124,79 @@ type TargetSpecificError struct {
 func (tse *TargetSpecificError) Error() string {
 	return fmt.Sprintf("error satisfying %v: %v", tse.Target, tse.Err)
 }
+
+func (tse *TargetSpecificError) Unwrap() error {
+	return tse.Err
+}
+
+// The delay before the first retry after an attempt to obtain a certificate
+// for a target fails. The delay doubles with each subsequent failure, up to
+// the maximum. The maximum is less than a day so that a daily cron job always
+// retries.
+var (
+	failureBackoffMin = 1 * time.Hour
+	failureBackoffMax = 16 * time.Hour
+)
+
+// Returns the delay before the next attempt to obtain a certificate for a
+// target after the given number of consecutive failures.
+func failureBackoff(count int) time.Duration {
+	d := failureBackoffMin
+	for i := 1; i < count && d < failureBackoffMax; i++ {
+		d *= 2
+	}
+
+	if d > failureBackoffMax {
+		d = failureBackoffMax
+	}
+
+	return d
+}
+
+// Error associated with authorizing a specific name. When authorizations are
+// obtained for several names at once, one is returned for each name which
+// fails.
+type AuthorizationError struct {
+	Name string
+	Err  error
+}
+
+func (ae *AuthorizationError) Error() string {
+	return fmt.Sprintf("could not obtain authorization for %q: %v", ae.Name, ae.Err)
+}
+
+func (ae *AuthorizationError) Unwrap() error {
+	return ae.Err
+}
+
+// Calls f for each index in [0, n), making at most limit calls at once (or
+// one at a time if limit is less than 1). Every call is made even if some
+// fail. Returns the errors returned, in index order.
+func runParallel(n, limit int, f func(i int) error) storage.MultiError {
+	if limit < 1 {
+		limit = 1
+	}
+
+	errs := make([]error, n)
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f(i)
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+
+	var merr storage.MultiError
+	for _, err := range errs {
+		if err != nil {
+			merr = append(merr, err)
+		}
+	}
+
+	return merr
+}